@@ -0,0 +1,434 @@
+// Client library for godistlockd
+//
+// A Client talks to one server of the cluster at a time, and moves on to the
+// next one given to it when the connection is lost. Locks are held by the
+// client's session, so they're kept through the other servers and refreshed
+// in the background until they're released.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/lietu/godistlockd/messages"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const VERSION = "1.0.0"
+
+// How long to wait for a server to answer, other than for the locks On waits
+// for
+const REQUEST_TIMEOUT = time.Second * 5
+
+var ErrNoServers = errors.New("No servers reachable")
+var ErrUnexpectedResponse = errors.New("Unexpected response")
+var ErrNotHeld = errors.New("Lock not held by the session")
+var ErrInvalidTimeout = errors.New("Lock timeout has to be at least a millisecond")
+
+// The server refused the request, e.g. because it's draining
+type ErrFailed struct {
+	Reason string
+}
+
+func (e *ErrFailed) Error() string {
+	return fmt.Sprintf("Request failed: %s", e.Reason)
+}
+
+type Client struct {
+	Addresses   []string
+	Timeout     time.Duration
+	// Set to connect with TLS
+	TLS         *tls.Config
+	// Given by the first server we talk to, and kept when moving on to others
+	Session     string
+	mutex       *sync.Mutex
+	conn        *connection
+	next        int
+	nonce       uint64
+	locks       map[*Lock]bool
+	closed      bool
+}
+
+// Connect to the first reachable server of addresses
+func Dial(addresses []string) (*Client, error) {
+	c := NewClient(addresses)
+
+	if _, err := c.connection(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// The connection to send requests over, connecting to the next server if the
+// previous one was lost
+func (c *Client) connection() (*connection, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	if c.conn != nil && c.conn.isAlive() {
+		return c.conn, nil
+	}
+
+	for range c.Addresses {
+		address := c.Addresses[c.next]
+		c.next = (c.next + 1) % len(c.Addresses)
+
+		cn, err := c.connect(address)
+
+		if err != nil {
+			continue
+		}
+
+		c.conn = cn
+		return cn, nil
+	}
+
+	return nil, ErrNoServers
+}
+
+// Connect to address and say HELLO, continuing the session if we have one
+func (c *Client) connect(address string) (*connection, error) {
+	var conn net.Conn
+	var err error
+
+	if c.TLS != nil {
+		dialer := &net.Dialer{Timeout: c.Timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, c.TLS)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, c.Timeout)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cn := newConnection(address, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	nonce := c.newNonce()
+	hello := &messages.ClientIncomingHello{Version: VERSION, Nonce: nonce, Session: c.Session}
+	response, err := cn.request(ctx, nonce, hello)
+
+	if err == nil {
+		if msg, ok := response.(*messages.ClientHelloResponse); ok {
+			c.Session = msg.Session
+			return cn, nil
+		}
+
+		err = ErrUnexpectedResponse
+	}
+
+	cn.close(err)
+
+	return nil, err
+}
+
+func (c *Client) newNonce() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.nonce, 1), 36)
+}
+
+// Send the message build gives for a new nonce and wait for the response
+func (c *Client) request(ctx context.Context, build func(nonce string) messages.Message) (messages.Message, error) {
+	cn, err := c.connection()
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := c.newNonce()
+	response, err := cn.request(ctx, nonce, build(nonce))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return checkResponse(response)
+}
+
+// The protocol counts in milliseconds, and the lock is refreshed a few times
+// per timeout
+func validTimeout(timeout time.Duration) bool {
+	return timeout >= time.Millisecond
+}
+
+func checkResponse(response messages.Message) (messages.Message, error) {
+	if msg, ok := response.(*messages.ClientOutgoingFail); ok {
+		return nil, &ErrFailed{msg.Reason}
+	}
+
+	return response, nil
+}
+
+// Wait until we get lock name, to hold for timeout at a time. If ctx has a
+// deadline the server stops waiting for the lock by then as well.
+func (c *Client) On(ctx context.Context, name string, timeout time.Duration) (*Lock, error) {
+	if !validTimeout(timeout) {
+		return nil, ErrInvalidTimeout
+	}
+
+	var wait time.Duration
+
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+
+		if wait <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+
+		// The protocol counts in milliseconds
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+	}
+
+	cn, err := c.connection()
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := c.newNonce()
+	w, err := cn.expect(nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	on := &messages.ClientIncomingOn{Lock: name, Timeout: timeout, Nonce: nonce, Wait: wait}
+
+	if err := cn.send(on); err != nil {
+		cn.forget(nonce)
+		return nil, err
+	}
+
+	msg, err := cn.wait(ctx, w)
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		// The server might still give us the lock, let it go if it does
+		go c.abandon(cn, nonce, name, w)
+		return nil, err
+	}
+
+	cn.forget(nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = checkResponse(msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg := msg.(type) {
+	case *messages.ClientOutgoingGive:
+		return c.newLock(name, msg.Fence, timeout), nil
+	case *messages.ClientOutgoingNo:
+		// Waited until the deadline
+		return nil, context.DeadlineExceeded
+	}
+
+	return nil, ErrUnexpectedResponse
+}
+
+func (c *Client) abandon(cn *connection, nonce string, name string, w *waiter) {
+	defer cn.forget(nonce)
+
+	msg, err := cn.wait(context.Background(), w)
+
+	if err != nil {
+		return
+	}
+
+	if give, ok := msg.(*messages.ClientOutgoingGive); ok {
+		cn.send(&messages.ClientIncomingOff{Lock: name, Fence: give.Fence, Nonce: c.newNonce()})
+	}
+}
+
+// Get lock name if nobody else has it, to hold for timeout at a time. Returns
+// nil if somebody else has it.
+func (c *Client) Try(name string, timeout time.Duration) (*Lock, error) {
+	if !validTimeout(timeout) {
+		return nil, ErrInvalidTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	msg, err := c.request(ctx, func(nonce string) messages.Message {
+		return &messages.ClientIncomingTry{Lock: name, Timeout: timeout, Nonce: nonce}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg := msg.(type) {
+	case *messages.ClientOutgoingGive:
+		return c.newLock(name, msg.Fence, timeout), nil
+	case *messages.ClientOutgoingNo:
+		return nil, nil
+	}
+
+	return nil, ErrUnexpectedResponse
+}
+
+// The fence of whoever holds lock name, "" if nobody does
+func (c *Client) Is(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	msg, err := c.request(ctx, func(nonce string) messages.Message {
+		return &messages.ClientIncomingIs{Lock: name, Nonce: nonce}
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	switch msg := msg.(type) {
+	case *messages.ClientOutgoingLock:
+		return msg.Fence, nil
+	case *messages.ClientOutgoingNo:
+		return "", nil
+	}
+
+	return "", ErrUnexpectedResponse
+}
+
+// Release lock name, with fence also when it was taken by another client of
+// the same session or through another server. Returns ErrNotHeld if the
+// session didn't hold it.
+func (c *Client) Release(name string, fence string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	msg, err := c.request(ctx, func(nonce string) messages.Message {
+		return &messages.ClientIncomingOff{Lock: name, Fence: fence, Nonce: nonce}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	switch msg.(type) {
+	case *messages.ClientOutgoingConf:
+		return nil
+	case *messages.ClientOutgoingNo:
+		return ErrNotHeld
+	}
+
+	return ErrUnexpectedResponse
+}
+
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// The stats of the server we're connected to
+func (c *Client) Stats() ([]Stat, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	cn, err := c.connection()
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := c.newNonce()
+	w, err := cn.expect(nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cn.forget(nonce)
+
+	if err := cn.send(&messages.ClientIncomingStats{Nonce: nonce}); err != nil {
+		return nil, err
+	}
+
+	stats := []Stat{}
+
+	for {
+		msg, err := cn.wait(ctx, w)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *messages.ClientOutgoingStats:
+			stats = append(stats, Stat{msg.Name, msg.Value})
+		case *messages.ClientOutgoingStatsEnd:
+			return stats, nil
+		default:
+			return nil, ErrUnexpectedResponse
+		}
+	}
+}
+
+func (c *Client) newLock(name string, fence string, timeout time.Duration) *Lock {
+	l := newLock(c, name, fence, timeout)
+
+	c.mutex.Lock()
+	c.locks[l] = true
+	c.mutex.Unlock()
+
+	go l.keepAlive()
+
+	return l
+}
+
+func (c *Client) forgetLock(l *Lock) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.locks, l)
+}
+
+// Disconnect, which releases all the locks we hold
+func (c *Client) Close() {
+	c.mutex.Lock()
+	c.closed = true
+	cn := c.conn
+	locks := c.locks
+	c.locks = map[*Lock]bool{}
+	c.mutex.Unlock()
+
+	if cn != nil {
+		cn.close(ErrClosed)
+	}
+
+	for l := range locks {
+		l.stop()
+	}
+}
+
+func NewClient(addresses []string) *Client {
+	c := Client{}
+	c.Addresses = addresses
+	c.Timeout = REQUEST_TIMEOUT
+	c.Session = ""
+	c.mutex = &sync.Mutex{}
+	c.next = 0
+	c.locks = map[*Lock]bool{}
+	c.closed = false
+
+	return &c
+}
@@ -0,0 +1,417 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/lietu/godistlockd/messages"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Speaks the server side of the client protocol, answering with whatever
+// respond gives
+type fakeServer struct {
+	listener net.Listener
+	respond  func(msg messages.Message) messages.Message
+	mutex    *sync.Mutex
+	received []messages.Message
+	conns    []net.Conn
+}
+
+// Several responses to one request
+type responses []messages.Message
+
+func (r responses) ToBytes() []byte {
+	lines := [][]byte{}
+	for _, msg := range r {
+		lines = append(lines, msg.ToBytes())
+	}
+
+	return bytes.Join(lines, []byte("\n"))
+}
+
+func (fs *fakeServer) run() {
+	for {
+		conn, err := fs.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		fs.mutex.Lock()
+		fs.conns = append(fs.conns, conn)
+		fs.mutex.Unlock()
+
+		go fs.handle(conn)
+	}
+}
+
+func (fs *fakeServer) handle(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		_, msg, err := messages.LoadMessage("client_incoming", scanner.Bytes())
+
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		fs.mutex.Lock()
+		fs.received = append(fs.received, msg)
+		fs.mutex.Unlock()
+
+		if hello, ok := msg.(*messages.ClientIncomingHello); ok {
+			session := hello.Session
+			if session == "" {
+				session = "session"
+			}
+
+			out := messages.NewClientOutgoingHello(hello.Nonce, "fake", "1.0.0", session)
+			conn.Write(append(out.ToBytes(), '\n'))
+			continue
+		}
+
+		if out := fs.respond(msg); out != nil {
+			conn.Write(append(out.ToBytes(), '\n'))
+		}
+	}
+}
+
+func (fs *fakeServer) address() string {
+	return fs.listener.Addr().String()
+}
+
+func (fs *fakeServer) receivedMessages() []messages.Message {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return append([]messages.Message{}, fs.received...)
+}
+
+// Drop the clients' connections, as if the server died
+func (fs *fakeServer) stop() {
+	fs.listener.Close()
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for _, conn := range fs.conns {
+		conn.Close()
+	}
+}
+
+func newFakeServer(t *testing.T, respond func(msg messages.Message) messages.Message) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := fakeServer{}
+	fs.listener = listener
+	fs.respond = respond
+	fs.mutex = &sync.Mutex{}
+
+	go fs.run()
+
+	return &fs
+}
+
+func unusedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener.Close()
+
+	return listener.Addr().String()
+}
+
+func TestClientFailover(t *testing.T) {
+	server := newFakeServer(t, func(msg messages.Message) messages.Message {
+		switch msg := msg.(type) {
+		case *messages.ClientIncomingTry:
+			return messages.NewClientOutgoingGive(msg.Nonce, "7")
+		case *messages.ClientIncomingIs:
+			return messages.NewClientOutgoingNo(msg.Nonce)
+		}
+		return nil
+	})
+	defer server.stop()
+
+	c, err := Dial([]string{unusedAddress(t), server.address()})
+
+	if err != nil {
+		t.Fatal("Didn't move on to the next server:", err)
+	}
+	defer c.Close()
+
+	if c.Session != "session" {
+		t.Error("Didn't pick up the session")
+	}
+
+	lock, err := c.Try("foo", time.Second)
+
+	if err != nil || lock == nil || lock.Fence != "7" {
+		t.Error("Failed to get lock with TRY")
+	}
+
+	fence, err := c.Is("bar")
+
+	if err != nil || fence != "" {
+		t.Error("Unexpected response to IS")
+	}
+}
+
+func TestClientNoServers(t *testing.T) {
+	_, err := Dial([]string{unusedAddress(t)})
+
+	if err != ErrNoServers {
+		t.Error("Expected no servers to be reachable, got", err)
+	}
+}
+
+func TestClientOnDeadline(t *testing.T) {
+	server := newFakeServer(t, func(msg messages.Message) messages.Message {
+		if on, ok := msg.(*messages.ClientIncomingOn); ok {
+			time.Sleep(on.Wait)
+			return messages.NewClientOutgoingNo(on.Nonce)
+		}
+		return nil
+	})
+	defer server.stop()
+
+	c, err := Dial([]string{server.address()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+	defer cancel()
+
+	lock, err := c.On(ctx, "foo", time.Second)
+
+	if lock != nil || err != context.DeadlineExceeded {
+		t.Error("Expected to give up waiting, got", err)
+	}
+
+	received := server.receivedMessages()
+	on, ok := received[len(received) - 1].(*messages.ClientIncomingOn)
+
+	if !ok || on.Wait <= 0 || on.Wait > time.Millisecond * 50 {
+		t.Error("Server wasn't told how long to wait")
+	}
+}
+
+func TestClientInvalidTimeout(t *testing.T) {
+	server := newFakeServer(t, func(msg messages.Message) messages.Message {
+		switch msg := msg.(type) {
+		case *messages.ClientIncomingOn:
+			return messages.NewClientOutgoingGive(msg.Nonce, "7")
+		case *messages.ClientIncomingTry:
+			return messages.NewClientOutgoingGive(msg.Nonce, "7")
+		}
+		return nil
+	})
+	defer server.stop()
+
+	c, err := Dial([]string{server.address()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.On(context.Background(), "foo", 0); err != ErrInvalidTimeout {
+		t.Error("Got lock without a timeout:", err)
+	}
+
+	if _, err := c.Try("foo", time.Nanosecond); err != ErrInvalidTimeout {
+		t.Error("Got lock with a timeout shorter than the protocol allows:", err)
+	}
+
+	if len(server.receivedMessages()) != 1 {
+		t.Error("Invalid timeouts were sent to the server")
+	}
+}
+
+func TestLockRefresh(t *testing.T) {
+	mutex := sync.Mutex{}
+	refreshes := 0
+
+	server := newFakeServer(t, func(msg messages.Message) messages.Message {
+		switch msg := msg.(type) {
+		case *messages.ClientIncomingOn:
+			return messages.NewClientOutgoingGive(msg.Nonce, "7")
+		case *messages.ClientIncomingRefresh:
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if msg.Fence != "7" {
+				return messages.NewClientOutgoingNo(msg.Nonce)
+			}
+
+			refreshes += 1
+			if refreshes > 2 {
+				// Lost it somehow
+				return messages.NewClientOutgoingNo(msg.Nonce)
+			}
+
+			return messages.NewClientOutgoingGive(msg.Nonce, msg.Fence)
+		}
+		return nil
+	})
+	defer server.stop()
+
+	c, err := Dial([]string{server.address()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	lock, err := c.On(context.Background(), "foo", time.Millisecond * 30)
+
+	if err != nil || lock == nil {
+		t.Fatal("Failed to get lock with ON")
+	}
+
+	select {
+	case <-lock.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("Lock wasn't noticed lost")
+	}
+
+	mutex.Lock()
+	if refreshes != 3 {
+		t.Error("Unexpected number of refreshes", refreshes)
+	}
+	mutex.Unlock()
+}
+
+func TestLockRefreshFailover(t *testing.T) {
+	first := newFakeServer(t, func(msg messages.Message) messages.Message {
+		if on, ok := msg.(*messages.ClientIncomingOn); ok {
+			return messages.NewClientOutgoingGive(on.Nonce, "7")
+		}
+		return nil
+	})
+
+	refreshed := make(chan *messages.ClientIncomingRefresh, 10)
+	second := newFakeServer(t, func(msg messages.Message) messages.Message {
+		switch msg := msg.(type) {
+		case *messages.ClientIncomingRefresh:
+			refreshed <- msg
+			return messages.NewClientOutgoingGive(msg.Nonce, msg.Fence)
+		case *messages.ClientIncomingOff:
+			return messages.NewClientOutgoingConf(msg.Nonce)
+		}
+		return nil
+	})
+	defer second.stop()
+
+	c, err := Dial([]string{first.address(), second.address()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	lock, err := c.On(context.Background(), "foo", time.Millisecond * 300)
+
+	if err != nil || lock == nil {
+		t.Fatal("Failed to get lock with ON")
+	}
+
+	first.stop()
+
+	select {
+	case refresh := <-refreshed:
+		if refresh.Lock != "foo" || refresh.Fence != "7" {
+			t.Error("Refreshed the wrong lock")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Lock wasn't refreshed through the other server")
+	}
+
+	hello, ok := second.receivedMessages()[0].(*messages.ClientIncomingHello)
+
+	if !ok || hello.Session != "session" {
+		t.Error("Didn't continue the session on the other server")
+	}
+
+	if lock.Context().Err() != nil {
+		t.Error("Lock was lost while failing over")
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Error("Failed to release lock:", err)
+	}
+
+	if lock.Context().Err() == nil {
+		t.Error("Lock context wasn't cancelled on release")
+	}
+}
+
+func TestClientRelease(t *testing.T) {
+	server := newFakeServer(t, func(msg messages.Message) messages.Message {
+		if off, ok := msg.(*messages.ClientIncomingOff); ok {
+			if off.Fence != "7" {
+				return messages.NewClientOutgoingNo(off.Nonce)
+			}
+
+			return messages.NewClientOutgoingConf(off.Nonce)
+		}
+		return nil
+	})
+	defer server.stop()
+
+	c, err := Dial([]string{server.address()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Release("foo", "7"); err != nil {
+		t.Error("Failed to release lock:", err)
+	}
+
+	if err := c.Release("foo", "8"); err != ErrNotHeld {
+		t.Error("Releasing a lock that isn't held didn't fail:", err)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	server := newFakeServer(t, func(msg messages.Message) messages.Message {
+		if stats, ok := msg.(*messages.ClientIncomingStats); ok {
+			return responses{
+				messages.NewClientOutgoingStats(stats.Nonce, "locks_held", "1"),
+				messages.NewClientOutgoingStats(stats.Nonce, "locks_held", "2"),
+				messages.NewClientOutgoingStatsEnd(stats.Nonce),
+			}
+		}
+		return nil
+	})
+	defer server.stop()
+
+	c, err := Dial([]string{server.address()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stats, err := c.Stats()
+
+	if err != nil || len(stats) != 2 || stats[1].Name != "locks_held" || stats[1].Value != "2" {
+		t.Error("Unexpected stats", stats, err)
+	}
+}
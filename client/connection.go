@@ -0,0 +1,205 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/lietu/godistlockd/messages"
+	"net"
+	"sync"
+)
+
+var ErrClosed = errors.New("Connection closed")
+
+// A request waiting for its responses, most get just one
+type waiter struct {
+	responses chan messages.Message
+	gone      chan bool
+}
+
+// A connection to one of the servers, requests are sent over it as they come
+// and matched with their responses by nonce
+type connection struct {
+	address    string
+	conn       net.Conn
+	writeMutex *sync.Mutex
+	mutex      *sync.Mutex
+	pending    map[string]*waiter
+	alive      bool
+	err        error
+	closed     chan bool
+}
+
+// Send msg without waiting for a response, for messages that don't get one
+func (cn *connection) send(msg messages.Message) error {
+	cn.writeMutex.Lock()
+	defer cn.writeMutex.Unlock()
+
+	data := append(msg.ToBytes(), '\n')
+
+	if _, err := cn.conn.Write(data); err != nil {
+		cn.close(err)
+		return err
+	}
+
+	return nil
+}
+
+// Send msg and wait for the response with nonce
+func (cn *connection) request(ctx context.Context, nonce string, msg messages.Message) (messages.Message, error) {
+	w, err := cn.expect(nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cn.forget(nonce)
+
+	if err := cn.send(msg); err != nil {
+		return nil, err
+	}
+
+	return cn.wait(ctx, w)
+}
+
+// Get the responses with nonce to wait for, until it's forgotten
+func (cn *connection) expect(nonce string) (*waiter, error) {
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+
+	if !cn.alive {
+		return nil, cn.err
+	}
+
+	w := &waiter{make(chan messages.Message, 1), make(chan bool)}
+	cn.pending[nonce] = w
+
+	return w, nil
+}
+
+// The next response for w
+func (cn *connection) wait(ctx context.Context, w *waiter) (messages.Message, error) {
+	select {
+	case result := <-w.responses:
+		return result, nil
+	case <-cn.closed:
+		return nil, cn.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cn *connection) forget(nonce string) {
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+
+	if w, ok := cn.pending[nonce]; ok {
+		close(w.gone)
+		delete(cn.pending, nonce)
+	}
+}
+
+func (cn *connection) incoming(src []byte) {
+	_, msg, err := messages.LoadMessage("client_outgoing", src)
+
+	if err != nil {
+		cn.close(err)
+		return
+	}
+
+	if e, ok := msg.(*messages.ClientErrResponse); ok {
+		// The server hangs up after these
+		cn.close(errors.New(e.Message))
+		return
+	}
+
+	cn.mutex.Lock()
+	w, ok := cn.pending[responseNonce(msg)]
+	cn.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case w.responses <- msg:
+	case <-w.gone:
+	}
+}
+
+func (cn *connection) run() {
+	scanner := bufio.NewScanner(cn.conn)
+	for scanner.Scan() {
+		cn.incoming(scanner.Bytes())
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = ErrClosed
+	}
+
+	cn.close(err)
+}
+
+// Close the connection, failing the requests still waiting with err
+func (cn *connection) close(err error) {
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+
+	if cn.alive {
+		cn.alive = false
+		cn.err = err
+		cn.conn.Close()
+		close(cn.closed)
+	}
+}
+
+func (cn *connection) isAlive() bool {
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+
+	return cn.alive
+}
+
+func responseNonce(msg messages.Message) string {
+	switch msg := msg.(type) {
+	case *messages.ClientHelloResponse:
+		return msg.Nonce
+	case *messages.ClientOutgoingGive:
+		return msg.Nonce
+	case *messages.ClientOutgoingMultiGive:
+		return msg.Nonce
+	case *messages.ClientOutgoingLock:
+		return msg.Nonce
+	case *messages.ClientOutgoingNo:
+		return msg.Nonce
+	case *messages.ClientOutgoingConf:
+		return msg.Nonce
+	case *messages.ClientOutgoingQueued:
+		return msg.Nonce
+	case *messages.ClientOutgoingStats:
+		return msg.Nonce
+	case *messages.ClientOutgoingStatsEnd:
+		return msg.Nonce
+	case *messages.ClientOutgoingFail:
+		return msg.Nonce
+	}
+
+	return ""
+}
+
+func newConnection(address string, conn net.Conn) *connection {
+	cn := connection{}
+	cn.address = address
+	cn.conn = conn
+	cn.writeMutex = &sync.Mutex{}
+	cn.mutex = &sync.Mutex{}
+	cn.pending = map[string]*waiter{}
+	cn.alive = true
+	cn.err = nil
+	cn.closed = make(chan bool)
+
+	go cn.run()
+
+	return &cn
+}
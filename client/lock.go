@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"github.com/lietu/godistlockd/messages"
+	"sync"
+	"time"
+)
+
+// A lock held by the client, refreshed in the background until it's released
+// or lost
+type Lock struct {
+	Name     string
+	Fence    string
+	Timeout  time.Duration
+	client   *Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	released chan bool
+	stopOnce *sync.Once
+}
+
+// Cancelled once the lock is no longer held: it was released, the client was
+// closed, or it couldn't be refreshed before it timed out
+func (l *Lock) Context() context.Context {
+	return l.ctx
+}
+
+// Let go of the lock
+func (l *Lock) Release() error {
+	l.stop()
+
+	// With the fence in case we got it through another server
+	return l.client.Release(l.Name, l.Fence)
+}
+
+func (l *Lock) stop() {
+	l.stopOnce.Do(func() {
+		close(l.released)
+		l.cancel()
+		l.client.forgetLock(l)
+	})
+}
+
+// Refresh the lock a few times per timeout, through whichever server we're
+// connected to, until it's released or can't be refreshed before it expires
+func (l *Lock) keepAlive() {
+	ticker := time.NewTicker(l.Timeout / 3)
+	defer ticker.Stop()
+
+	expires := time.Now().Add(l.Timeout)
+
+	for {
+		select {
+		case <-l.released:
+			return
+		case <-ticker.C:
+		}
+
+		if !time.Now().Before(expires) {
+			l.stop()
+			return
+		}
+
+		sent := time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), expires)
+
+		msg, err := l.client.request(ctx, func(nonce string) messages.Message {
+			return &messages.ClientIncomingRefresh{Lock: l.Name, Fence: l.Fence, Timeout: l.Timeout, Nonce: nonce}
+		})
+
+		cancel()
+
+		if err != nil {
+			// Try again, maybe through another server
+			continue
+		}
+
+		switch msg.(type) {
+		case *messages.ClientOutgoingGive:
+			expires = sent.Add(l.Timeout)
+		case *messages.ClientOutgoingNo:
+			// Expired or taken over already
+			l.stop()
+			return
+		}
+	}
+}
+
+func newLock(client *Client, name string, fence string, timeout time.Duration) *Lock {
+	l := Lock{}
+	l.Name = name
+	l.Fence = fence
+	l.Timeout = timeout
+	l.client = client
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	l.released = make(chan bool)
+	l.stopOnce = &sync.Once{}
+
+	return &l
+}
@@ -0,0 +1,287 @@
+// Command line client for godistlockd, for operators and shell scripts
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"github.com/lietu/godistlockd/client"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes besides 0 for success, exec exits with the command's own
+const EXIT_NOT_HELD = 1
+const EXIT_ERROR = 2
+const EXIT_LOST = 3
+
+var servers = flag.String("servers", "", "Comma separated client addresses of the servers, or set GODISTLOCK_SERVERS (default \"localhost:10000\")")
+var session = flag.String("session", "", "Session to continue, e.g. to release a lock it holds")
+var useTLS = flag.Bool("tls", false, "Connect with TLS, implied by the other -tls-* flags")
+var tlsCA = flag.String("tls-ca", "", "CA to check the server certificates against instead of the system ones")
+var tlsCert = flag.String("tls-cert", "", "Certificate to show the servers, if they ask for one")
+var tlsKey = flag.String("tls-key", "", "Key of the certificate")
+var timeout = flag.Duration("timeout", time.Second * 10, "How long the lock is held at a time, it's refreshed until released")
+var maxWait = flag.Duration("wait", 0, "How long to wait for the lock at most, 0 for as long as it takes")
+
+func usage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, "Usage: %s [flags] <command> [args]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  lock <lock>                Wait for the lock, print its fence, hold it until interrupted")
+	fmt.Fprintln(out, "  try <lock>                 Like lock, but exit right away if somebody else has it")
+	fmt.Fprintln(out, "  release <lock> <fence>     Release a lock held by the -session, or left behind by a server")
+	fmt.Fprintln(out, "  is <lock>                  Print the fence of the lock if it's held")
+	fmt.Fprintln(out, "  stats                      Print the stats of the server")
+	fmt.Fprintln(out, "  exec <lock> <command> ...  Run the command while holding the lock, its fence is given in")
+	fmt.Fprintln(out, "                             GODISTLOCK_FENCE")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nExits with %d if the lock isn't held, %d on errors and %d if the lock was lost.\n", EXIT_NOT_HELD, EXIT_ERROR, EXIT_LOST)
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format + "\n", args...)
+	os.Exit(EXIT_ERROR)
+}
+
+func serverList() []string {
+	list := *servers
+
+	if list == "" {
+		list = os.Getenv("GODISTLOCK_SERVERS")
+	}
+
+	if list == "" {
+		list = "localhost:10000"
+	}
+
+	addresses := []string{}
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+func tlsConfig() *tls.Config {
+	if !*useTLS && *tlsCA == "" && *tlsCert == "" {
+		return nil
+	}
+
+	config := &tls.Config{}
+
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+
+		if err != nil {
+			fail("Failed to read %s: %s", *tlsCA, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			fail("No certificates found in %s", *tlsCA)
+		}
+	}
+
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+
+		if err != nil {
+			fail("Failed to load %s: %s", *tlsCert, err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config
+}
+
+// Take the lock, waiting for it if wait is set, exits if it can't be had
+func acquire(c *client.Client, name string, wait bool) *client.Lock {
+	var lock *client.Lock
+	var err error
+
+	if !wait {
+		lock, err = c.Try(name, *timeout)
+	} else if *maxWait > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), *maxWait)
+		lock, err = c.On(ctx, name, *timeout)
+		cancel()
+	} else {
+		lock, err = c.On(context.Background(), name, *timeout)
+	}
+
+	if err == context.DeadlineExceeded {
+		err = nil
+	}
+
+	if err != nil {
+		fail("Failed to get lock %s: %s", name, err)
+	}
+
+	if lock == nil {
+		fmt.Fprintf(os.Stderr, "Lock %s is held by somebody else\n", name)
+		os.Exit(EXIT_NOT_HELD)
+	}
+
+	return lock
+}
+
+func hold(c *client.Client, name string, wait bool) {
+	lock := acquire(c, name, wait)
+	fmt.Println(lock.Fence)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-signals:
+		lock.Release()
+	case <-lock.Context().Done():
+		fmt.Fprintf(os.Stderr, "Lost lock %s\n", name)
+		os.Exit(EXIT_LOST)
+	}
+}
+
+func release(c *client.Client, name string, fence string) {
+	// A new session wouldn't hold anything
+	if *session == "" {
+		fail("Releasing lock %s needs the -session holding it", name)
+	}
+
+	err := c.Release(name, fence)
+
+	if err == client.ErrNotHeld {
+		fmt.Fprintf(os.Stderr, "Lock %s isn't held by the session\n", name)
+		os.Exit(EXIT_NOT_HELD)
+	}
+
+	if err != nil {
+		fail("Failed to release lock %s: %s", name, err)
+	}
+}
+
+func is(c *client.Client, name string) {
+	fence, err := c.Is(name)
+
+	if err != nil {
+		fail("Failed to check lock %s: %s", name, err)
+	}
+
+	if fence == "" {
+		os.Exit(EXIT_NOT_HELD)
+	}
+
+	fmt.Println(fence)
+}
+
+func stats(c *client.Client) {
+	list, err := c.Stats()
+
+	if err != nil {
+		fail("Failed to get stats: %s", err)
+	}
+
+	for _, stat := range list {
+		fmt.Printf("%s %s\n", stat.Name, stat.Value)
+	}
+}
+
+// Run command while holding lock name, stopping it if the lock is lost. Exits
+// with the command's exit code.
+func run(c *client.Client, name string, command []string) {
+	lock := acquire(c, name, true)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "GODISTLOCK_LOCK=" + name, "GODISTLOCK_FENCE=" + lock.Fence)
+
+	if err := cmd.Start(); err != nil {
+		lock.Release()
+		fail("Failed to run %s: %s", command[0], err)
+	}
+
+	// The command decides what to do about these, we wait for it either way
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case sig := <-signals:
+			cmd.Process.Signal(sig)
+		case <-lock.Context().Done():
+			fmt.Fprintf(os.Stderr, "Lost lock %s, stopping %s\n", name, command[0])
+			cmd.Process.Signal(syscall.SIGTERM)
+			<-exited
+			os.Exit(EXIT_LOST)
+		case err := <-exited:
+			lock.Release()
+
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+				os.Exit(exitErr.ExitCode())
+			}
+
+			if err != nil {
+				fail("Failed to run %s: %s", command[0], err)
+			}
+
+			return
+		}
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+
+	if len(args) == 0 {
+		usage()
+		os.Exit(EXIT_ERROR)
+	}
+
+	c := client.NewClient(serverList())
+	c.Session = *session
+	c.TLS = tlsConfig()
+	defer c.Close()
+
+	command, args := args[0], args[1:]
+
+	switch {
+	case command == "lock" && len(args) == 1:
+		hold(c, args[0], true)
+	case command == "try" && len(args) == 1:
+		hold(c, args[0], false)
+	case command == "release" && len(args) == 2:
+		release(c, args[0], args[1])
+	case command == "is" && len(args) == 1:
+		is(c, args[0])
+	case command == "stats" && len(args) == 0:
+		stats(c)
+	case command == "exec" && len(args) >= 2:
+		run(c, args[0], args[1:])
+	default:
+		usage()
+		os.Exit(EXIT_ERROR)
+	}
+}
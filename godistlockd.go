@@ -4,20 +4,139 @@ package main
 import (
 	"flag"
 	"github.com/lietu/godistlockd/server"
-	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-var clientPort = flag.Int("clients", 10000, "Port to bind to for client connections")
-var relayPort = flag.Int("relays", 20000, "Port to bind to for relay connections")
+// Settings are read from the config file, then GODISTLOCKD_* environment
+// variables, and last from the command line, later ones winning
+var configFile = flag.String("config", "", "Path to TOML config file, or set GODISTLOCKD_CONFIG")
+var id = flag.String("id", "", "ID of this server, defaults to server-on-port-<relay port>")
+var version = flag.String("version", "", "Version to report to clients and other servers")
+var clientAddress = flag.String("clients", "", "Address or port to bind to for client connections (default \":10000\")")
+var relayAddress = flag.String("relays", "", "Address or port to bind to for relay connections (default \":20000\")")
+var peers = flag.String("peers", "", "Comma separated relay addresses of the servers in the cluster")
+var relayTimeout = flag.Duration("relay-timeout", time.Second, "How long to wait for other servers to respond")
+var prepareTimeout = flag.Duration("prepare-timeout", time.Second, "How long preliminary locks are held while agreeing on a lock")
+var drainTimeout = flag.Duration("drain-timeout", time.Second * 30, "How long to wait for clients to release their locks when shutting down")
+var dataDir = flag.String("data-dir", "", "Directory to keep state that has to survive restarts in")
+var walSync = flag.String("wal-sync", "", "When to fsync the lock log: always, interval or never (default \"always\")")
+var snapshotInterval = flag.Duration("snapshot-interval", time.Minute, "How often to compact the lock log into a snapshot")
+var semaphores = flag.String("semaphores", "", "Comma separated permit counts of semaphores, like vendor-api=5")
+var maxInFlight = flag.Int("max-in-flight", 64, "How many requests of a client connection are handled at once")
+var tlsCert = flag.String("tls-cert", "", "Certificate to speak TLS with on both ports")
+var tlsKey = flag.String("tls-key", "", "Key of the TLS certificate")
+var tlsCA = flag.String("tls-ca", "", "CA to check the certificates of other servers and clients against")
+var tlsClientAuth = flag.Bool("tls-client-auth", false, "Require clients to show a certificate signed by the CA")
+var clusterKey = flag.String("cluster-key", "", "Secret other servers have to prove they know to join the cluster, better set in the config file or environment")
 var testing = flag.Bool("testing", false, "Enable testing stuff")
 
+func loadConfig() *server.Config {
+	config := server.NewConfig()
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(server.ENV_PREFIX + "CONFIG")
+	}
+
+	if path != "" {
+		if err := config.LoadFile(path); err != nil {
+			log.Fatalf("Failed to load config file %s: %s", path, err)
+		}
+	}
+
+	if err := config.LoadEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "id":
+			config.Id = *id
+		case "version":
+			config.Version = *version
+		case "clients":
+			config.ClientAddress = *clientAddress
+		case "relays":
+			config.RelayAddress = *relayAddress
+		case "peers":
+			config.Peers = server.SplitList(*peers)
+		case "relay-timeout":
+			config.RelayTimeout.Duration = *relayTimeout
+		case "prepare-timeout":
+			config.PrepareTimeout.Duration = *prepareTimeout
+		case "drain-timeout":
+			config.DrainTimeout.Duration = *drainTimeout
+		case "data-dir":
+			config.DataDir = *dataDir
+		case "wal-sync":
+			config.WalSync = *walSync
+		case "snapshot-interval":
+			config.SnapshotInterval.Duration = *snapshotInterval
+		case "semaphores":
+			parsed, err := server.ParseSemaphores(*semaphores)
+
+			if err != nil {
+				log.Fatalf("Invalid -semaphores: %s", err)
+			}
+
+			config.Semaphores = parsed
+		case "max-in-flight":
+			config.MaxInFlight = *maxInFlight
+		case "tls-cert":
+			config.TLSCert = *tlsCert
+		case "tls-key":
+			config.TLSKey = *tlsKey
+		case "tls-ca":
+			config.TLSCA = *tlsCA
+		case "tls-client-auth":
+			config.TLSClientAuth = *tlsClientAuth
+		case "cluster-key":
+			config.ClusterKey = *clusterKey
+		case "testing":
+			config.Testing = *testing
+		}
+	})
+
+	config.Finalize()
+
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	return config
+}
+
+// The first SIGINT/SIGTERM starts draining, another one exits right away
+func handleSignals(s *server.Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	<-signals
+	go s.Drain()
+
+	<-signals
+	log.Fatal("Received another signal, exiting without waiting for locks")
+}
+
+// SIGHUP reloads the TLS certificates
+func handleReload(s *server.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		s.ReloadTLS()
+	}
+}
+
 func main() {
 	flag.Parse()
 
-	server := server.NewServer()
-	// TODO: Configure
-	server.Id = fmt.Sprintf("server-on-port-%d", *relayPort)
-	server.Version = "1.0.0"
-	server.Testing = *testing
-	server.Run(*clientPort, *relayPort)
-}
\ No newline at end of file
+	server := server.NewServer(loadConfig())
+	go handleSignals(server)
+	go handleReload(server)
+	server.Run()
+}
@@ -1,28 +1,103 @@
 package messages
 
-import "time"
+import (
+	"time"
+	"strconv"
+)
 
-// `HELLO <version> <nonce>` -> Hi, I'm a client running version <version>
-// `ON <lock> <timeout> <nonce>` -> Wait until you get lock, keep locked until timeout, will return a token for fencing
-// `OFF <lock> <nonce>` -> Release lock
+// `HELLO <version> <nonce> [<session>]` -> Hi, I'm a client running version <version>, optionally continuing an earlier <session>
+// `ON <lock> <timeout> <nonce> [<wait>]` -> Wait until you get lock, keep locked until timeout, will return a token for fencing. With <wait> give up after waiting that long
+// `OFF <lock> [<fence>] <nonce>` -> Release lock, with <fence> also a lock taken through another server
 // `TRY <lock> <timeout> <nonce>` -> Check if you can get lock, get it if you can, will return a token for fencing
+// `SON <lock> <timeout> <nonce>` -> Like ON, but for reading: others may hold the lock in shared mode at the same time
+// `STRY <lock> <timeout> <nonce>` -> Like TRY, but for reading
+// `PON <lock> <timeout> <nonce> [<permits>]` -> Wait until you get one of the permits of semaphore <lock>, <permits> can be left out if the server knows it
+// `PTRY <lock> <timeout> <nonce> [<permits>]` -> Like PON, but don't wait
+// `MON <timeout> <nonce> <lock1> <lock2> ...` -> Wait until you get all of the locks at once, will return a token for fencing for each
 // `REFRESH <lock> <fence> <timeout> <nonce>` -> I want to keep this lock for a bit longer
-// `IS <lock> <nonce>` -> Check if the lock is engaged, returns fence token (nonce) if it is
+// `IS <lock> <nonce> [cluster]` -> Check if the lock is engaged, returns fence token (nonce) if it is, optionally asking the cluster
 // `STATS <nonce>` -> Get count of locks and other stats about the system
+// `POS <lock> <nonce>` -> Where am I in line for the lock, answered with QUEUED or NO if not waiting for it
 
 type ClientIncomingHello struct {
 	Version string
 	Nonce   string
+	Session string
 }
 
 type ClientIncomingOn struct {
 	Lock    string
 	Timeout time.Duration
 	Nonce   string
+	// How long to wait at most, 0 for as long as it takes
+	Wait    time.Duration
 }
 
 type ClientIncomingOff struct {
 	Lock    string
+	Fence   string
+	Nonce   string
+}
+
+type ClientIncomingTry struct {
+	Lock    string
+	Timeout time.Duration
+	Nonce   string
+}
+
+type ClientIncomingSharedOn struct {
+	Lock    string
+	Timeout time.Duration
+	Nonce   string
+}
+
+type ClientIncomingSharedTry struct {
+	Lock    string
+	Timeout time.Duration
+	Nonce   string
+}
+
+type ClientIncomingPermitOn struct {
+	Lock    string
+	Timeout time.Duration
+	Nonce   string
+	// 0 if not given
+	Permits int
+}
+
+type ClientIncomingPermitTry struct {
+	Lock    string
+	Timeout time.Duration
+	Nonce   string
+	// 0 if not given
+	Permits int
+}
+
+type ClientIncomingMultiOn struct {
+	Timeout time.Duration
+	Nonce   string
+	Locks   []string
+}
+
+type ClientIncomingIs struct {
+	Lock    string
+	Nonce   string
+	Cluster bool
+}
+
+type ClientIncomingStats struct {
+	Nonce string
+}
+
+type ClientIncomingPosition struct {
+	Lock  string
+	Nonce string
+}
+
+type ClientIncomingRefresh struct {
+	Lock    string
+	Fence   string
+	Timeout time.Duration
 	Nonce   string
 }
 
@@ -34,6 +109,10 @@ func (msg *ClientIncomingHello) ToBytes() []byte {
 		msg.Nonce,
 	}
 
+	if msg.Session != "" {
+		args = append(args, msg.Session)
+	}
+
 	return ToBytes("HELLO", args)
 }
 
@@ -46,6 +125,10 @@ func (msg *ClientIncomingOn) ToBytes() []byte {
 		msg.Nonce,
 	}
 
+	if msg.Wait > 0 {
+		args = append(args, DurationToString(msg.Wait))
+	}
+
 	return ToBytes("ON", args)
 }
 
@@ -54,16 +137,149 @@ func (msg *ClientIncomingOn) ToBytes() []byte {
 func (msg *ClientIncomingOff) ToBytes() []byte {
 	args := []string{
 		msg.Lock,
-		msg.Nonce,
 	}
 
+	if msg.Fence != "" {
+		args = append(args, msg.Fence)
+	}
+
+	args = append(args, msg.Nonce)
+
 	return ToBytes("OFF", args)
 }
 
+// ClientIncomingTry
+
+func (msg *ClientIncomingTry) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	return ToBytes("TRY", args)
+}
+
+// ClientIncomingSharedOn
+
+func (msg *ClientIncomingSharedOn) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	return ToBytes("SON", args)
+}
+
+// ClientIncomingSharedTry
+
+func (msg *ClientIncomingSharedTry) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	return ToBytes("STRY", args)
+}
+
+// ClientIncomingPermitOn
+
+func (msg *ClientIncomingPermitOn) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	if msg.Permits > 0 {
+		args = append(args, strconv.Itoa(msg.Permits))
+	}
+
+	return ToBytes("PON", args)
+}
+
+// ClientIncomingPermitTry
+
+func (msg *ClientIncomingPermitTry) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	if msg.Permits > 0 {
+		args = append(args, strconv.Itoa(msg.Permits))
+	}
+
+	return ToBytes("PTRY", args)
+}
+
+// ClientIncomingMultiOn
+
+func (msg *ClientIncomingMultiOn) ToBytes() []byte {
+	args := []string{
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	return ToBytes("MON", append(args, msg.Locks...))
+}
+
+// ClientIncomingIs
+
+func (msg *ClientIncomingIs) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		msg.Nonce,
+	}
+
+	if msg.Cluster {
+		args = append(args, "cluster")
+	}
+
+	return ToBytes("IS", args)
+}
+
+// ClientIncomingStats
+
+func (msg *ClientIncomingStats) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("STATS", args)
+}
+
+// ClientIncomingPosition
+
+func (msg *ClientIncomingPosition) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		msg.Nonce,
+	}
+
+	return ToBytes("POS", args)
+}
+
+// ClientIncomingRefresh
+
+func (msg *ClientIncomingRefresh) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		msg.Fence,
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	return ToBytes("REFRESH", args)
+}
+
 // Constructors
 
 func NewClientIncomingHello(args []string) (msg Message, err error) {
-	if len(args) != 2 {
+	if len(args) != 2 && len(args) != 3 {
 		err = ErrInvalidMessage
 		return
 	}
@@ -71,6 +287,11 @@ func NewClientIncomingHello(args []string) (msg Message, err error) {
 	m := ClientIncomingHello{}
 	m.Version = args[0]
 	m.Nonce = args[1]
+	m.Session = ""
+
+	if len(args) == 3 {
+		m.Session = args[2]
+	}
 
 	msg = &m
 
@@ -78,7 +299,7 @@ func NewClientIncomingHello(args []string) (msg Message, err error) {
 }
 
 func NewClientIncomingOn(args []string) (msg Message, err error) {
-	if len(args) != 3 {
+	if len(args) != 3 && len(args) != 4 {
 		err = ErrInvalidMessage
 		return
 	}
@@ -93,19 +314,269 @@ func NewClientIncomingOn(args []string) (msg Message, err error) {
 
 	m.Nonce = args[2]
 
+	if len(args) == 4 {
+		m.Wait, err = StringToDuration(args[3])
+
+		if err != nil {
+			return
+		}
+
+		if m.Wait <= 0 {
+			err = ErrInvalidMessage
+			return
+		}
+	}
+
 	msg = &m
 
 	return
 }
 
 func NewClientIncomingOff(args []string) (msg Message, err error) {
-	if len(args) != 2 {
+	if len(args) != 2 && len(args) != 3 {
 		err = ErrInvalidMessage
 		return
 	}
 
 	m := ClientIncomingOff{}
 	m.Lock = args[0]
+	m.Fence = ""
+	m.Nonce = args[len(args) - 1]
+
+	if len(args) == 3 {
+		m.Fence = args[1]
+	}
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingTry(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingTry{}
+	m.Lock = args[0]
+	m.Timeout, err = StringToDuration(args[1])
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[2]
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingSharedOn(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingSharedOn{}
+	m.Lock = args[0]
+	m.Timeout, err = StringToDuration(args[1])
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[2]
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingSharedTry(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingSharedTry{}
+	m.Lock = args[0]
+	m.Timeout, err = StringToDuration(args[1])
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[2]
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingRefresh(args []string) (msg Message, err error) {
+	if len(args) != 4 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingRefresh{}
+	m.Lock = args[0]
+	m.Fence = args[1]
+	m.Timeout, err = StringToDuration(args[2])
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[3]
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingMultiOn(args []string) (msg Message, err error) {
+	if len(args) < 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingMultiOn{}
+	m.Timeout, err = StringToDuration(args[0])
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[1]
+	m.Locks, err = parseLocks(args[2:])
+
+	if err != nil {
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingPermitOn(args []string) (msg Message, err error) {
+	if len(args) != 3 && len(args) != 4 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingPermitOn{}
+	m.Lock = args[0]
+	m.Timeout, err = StringToDuration(args[1])
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[2]
+
+	if len(args) == 4 {
+		m.Permits, err = parsePermits(args[3])
+
+		if err != nil {
+			return
+		}
+	}
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingPermitTry(args []string) (msg Message, err error) {
+	if len(args) != 3 && len(args) != 4 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingPermitTry{}
+	m.Lock = args[0]
+	m.Timeout, err = StringToDuration(args[1])
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[2]
+
+	if len(args) == 4 {
+		m.Permits, err = parsePermits(args[3])
+
+		if err != nil {
+			return
+		}
+	}
+
+	msg = &m
+
+	return
+}
+
+func parsePermits(src string) (int, error) {
+	permits, err := strconv.Atoi(src)
+
+	if err != nil || permits < 1 {
+		return 0, ErrInvalidMessage
+	}
+
+	return permits, nil
+}
+
+func NewClientIncomingIs(args []string) (msg Message, err error) {
+	if len(args) != 2 && len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingIs{}
+	m.Lock = args[0]
+	m.Nonce = args[1]
+	m.Cluster = false
+
+	if len(args) == 3 {
+		if args[2] != "cluster" {
+			err = ErrInvalidMessage
+			return
+		}
+
+		m.Cluster = true
+	}
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingStats(args []string) (msg Message, err error) {
+	if len(args) != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingStats{}
+	m.Nonce = args[0]
+
+	msg = &m
+
+	return
+}
+
+func NewClientIncomingPosition(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := ClientIncomingPosition{}
+	m.Lock = args[0]
 	m.Nonce = args[1]
 
 	msg = &m
@@ -117,4 +588,14 @@ func init() {
 	RegisterMessageType("client_incoming", "HELLO", NewClientIncomingHello)
 	RegisterMessageType("client_incoming", "ON", NewClientIncomingOn)
 	RegisterMessageType("client_incoming", "OFF", NewClientIncomingOff)
+	RegisterMessageType("client_incoming", "TRY", NewClientIncomingTry)
+	RegisterMessageType("client_incoming", "SON", NewClientIncomingSharedOn)
+	RegisterMessageType("client_incoming", "STRY", NewClientIncomingSharedTry)
+	RegisterMessageType("client_incoming", "PON", NewClientIncomingPermitOn)
+	RegisterMessageType("client_incoming", "PTRY", NewClientIncomingPermitTry)
+	RegisterMessageType("client_incoming", "MON", NewClientIncomingMultiOn)
+	RegisterMessageType("client_incoming", "REFRESH", NewClientIncomingRefresh)
+	RegisterMessageType("client_incoming", "IS", NewClientIncomingIs)
+	RegisterMessageType("client_incoming", "STATS", NewClientIncomingStats)
+	RegisterMessageType("client_incoming", "POS", NewClientIncomingPosition)
 }
@@ -38,6 +38,38 @@ func TestClientIncomingHello(t *testing.T) {
 	}
 }
 
+func TestClientIncomingHelloSession(t *testing.T) {
+	incoming := []byte("HELLO 1.0.0 mynonce mysession")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingHello")
+		return
+	}
+
+	cih, ok := msg.(*ClientIncomingHello)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingHello")
+		return
+	}
+
+	if cih.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	if cih.Session != "mysession" {
+		t.Error("Failed to parse session")
+		return
+	}
+
+	outgoing := cih.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
 func TestClientIncomingOn(t *testing.T) {
 	incoming := []byte("ON lock 123 mynonce")
 	_, msg, err := LoadMessage("client_incoming", incoming)
@@ -69,12 +101,43 @@ func TestClientIncomingOn(t *testing.T) {
 		return
 	}
 
+	if cih.Wait != 0 {
+		t.Error("Failed to default to waiting for as long as it takes")
+		return
+	}
+
 	outgoing := cih.ToBytes()
 	if !bytes.Equal(outgoing, incoming) {
 		t.Error("Failed to convert back to bytes:", string(outgoing))
 	}
 }
 
+func TestClientIncomingOnWait(t *testing.T) {
+	incoming := []byte("ON lock 123 mynonce 500")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingOn")
+		return
+	}
+
+	cih := msg.(*ClientIncomingOn)
+
+	if cih.Wait != time.Millisecond * 500 || cih.Nonce != "mynonce" {
+		t.Error("Failed to parse wait")
+		return
+	}
+
+	outgoing := cih.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	if _, _, err := LoadMessage("client_incoming", []byte("ON lock 123 mynonce soon")); err == nil {
+		t.Error("Accepted a wait that isn't a number")
+	}
+}
+
 func TestClientIncomingOff(t *testing.T) {
 	incoming := []byte("OFF lock mynonce")
 	_, msg, err := LoadMessage("client_incoming", incoming)
@@ -106,3 +169,439 @@ func TestClientIncomingOff(t *testing.T) {
 		t.Error("Failed to convert back to bytes:", string(outgoing))
 	}
 }
+
+func TestClientIncomingOffFence(t *testing.T) {
+	incoming := []byte("OFF lock myfence mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingOff")
+		return
+	}
+
+	cih, ok := msg.(*ClientIncomingOff)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingOff")
+		return
+	}
+
+	if cih.Lock != "lock" {
+		t.Error("Failed to parse lock")
+		return
+	}
+
+	if cih.Fence != "myfence" {
+		t.Error("Failed to parse fence")
+		return
+	}
+
+	if cih.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	outgoing := cih.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingTry(t *testing.T) {
+	incoming := []byte("TRY lock 123 mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingTry")
+		return
+	}
+
+	cit, ok := msg.(*ClientIncomingTry)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingTry")
+		return
+	}
+
+	if cit.Lock != "lock" {
+		t.Error("Failed to parse lock")
+		return
+	}
+
+	if cit.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+		return
+	}
+
+	if cit.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	outgoing := cit.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingSharedOn(t *testing.T) {
+	incoming := []byte("SON lock 123 mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingSharedOn")
+		return
+	}
+
+	cit, ok := msg.(*ClientIncomingSharedOn)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingSharedOn")
+		return
+	}
+
+	if cit.Lock != "lock" {
+		t.Error("Failed to parse lock")
+		return
+	}
+
+	if cit.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+		return
+	}
+
+	if cit.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	outgoing := cit.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingSharedTry(t *testing.T) {
+	incoming := []byte("STRY lock 123 mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingSharedTry")
+		return
+	}
+
+	cit, ok := msg.(*ClientIncomingSharedTry)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingSharedTry")
+		return
+	}
+
+	if cit.Lock != "lock" {
+		t.Error("Failed to parse lock")
+		return
+	}
+
+	if cit.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+		return
+	}
+
+	if cit.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	outgoing := cit.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingPermitOn(t *testing.T) {
+	incoming := []byte("PON lock 123 mynonce 5")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingPermitOn")
+		return
+	}
+
+	cit, ok := msg.(*ClientIncomingPermitOn)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingPermitOn")
+		return
+	}
+
+	if cit.Lock != "lock" {
+		t.Error("Failed to parse lock")
+		return
+	}
+
+	if cit.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+		return
+	}
+
+	if cit.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	if cit.Permits != 5 {
+		t.Error("Failed to parse permits")
+		return
+	}
+
+	outgoing := cit.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	_, _, err = LoadMessage("client_incoming", []byte("PON lock 123 mynonce 0"))
+	if err == nil {
+		t.Error("Accepted a semaphore without permits")
+	}
+}
+
+func TestClientIncomingPermitTry(t *testing.T) {
+	incoming := []byte("PTRY lock 123 mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingPermitTry")
+		return
+	}
+
+	cit, ok := msg.(*ClientIncomingPermitTry)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingPermitTry")
+		return
+	}
+
+	if cit.Lock != "lock" || cit.Nonce != "mynonce" {
+		t.Error("Failed to parse lock and nonce")
+		return
+	}
+
+	if cit.Permits != 0 {
+		t.Error("Permits should be left for the server to decide")
+		return
+	}
+
+	outgoing := cit.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingMultiOn(t *testing.T) {
+	incoming := []byte("MON 123 mynonce stock customer coupon")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingMultiOn")
+		return
+	}
+
+	cit, ok := msg.(*ClientIncomingMultiOn)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingMultiOn")
+		return
+	}
+
+	if cit.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+		return
+	}
+
+	if cit.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	if len(cit.Locks) != 3 || cit.Locks[0] != "stock" || cit.Locks[2] != "coupon" {
+		t.Error("Failed to parse locks:", cit.Locks)
+		return
+	}
+
+	outgoing := cit.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	for _, invalid := range []string{"MON 123 mynonce", "MON 123 mynonce stock stock", "MON soon mynonce stock"} {
+		_, _, err = LoadMessage("client_incoming", []byte(invalid))
+		if err == nil {
+			t.Error("Accepted invalid message", invalid)
+		}
+	}
+}
+
+func TestClientIncomingRefresh(t *testing.T) {
+	incoming := []byte("REFRESH lock fence 123 mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingRefresh")
+		return
+	}
+
+	cir, ok := msg.(*ClientIncomingRefresh)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingRefresh")
+		return
+	}
+
+	if cir.Lock != "lock" {
+		t.Error("Failed to parse lock")
+		return
+	}
+
+	if cir.Fence != "fence" {
+		t.Error("Failed to parse fence")
+		return
+	}
+
+	if cir.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+		return
+	}
+
+	if cir.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	outgoing := cir.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingIs(t *testing.T) {
+	incoming := []byte("IS lock mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingIs")
+		return
+	}
+
+	cii, ok := msg.(*ClientIncomingIs)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingIs")
+		return
+	}
+
+	if cii.Lock != "lock" {
+		t.Error("Failed to parse lock")
+		return
+	}
+
+	if cii.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	if cii.Cluster {
+		t.Error("Local query parsed as cluster query")
+		return
+	}
+
+	outgoing := cii.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingIsCluster(t *testing.T) {
+	incoming := []byte("IS lock mynonce cluster")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingIs")
+		return
+	}
+
+	cii, ok := msg.(*ClientIncomingIs)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingIs")
+		return
+	}
+
+	if !cii.Cluster {
+		t.Error("Failed to parse cluster scope")
+		return
+	}
+
+	outgoing := cii.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	_, _, err = LoadMessage("client_incoming", []byte("IS lock mynonce everywhere"))
+	if err == nil {
+		t.Error("Accepted unknown scope")
+	}
+}
+
+func TestClientIncomingPosition(t *testing.T) {
+	incoming := []byte("POS lock-1 mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingPosition")
+		return
+	}
+
+	cip, ok := msg.(*ClientIncomingPosition)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingPosition")
+		return
+	}
+
+	if cip.Lock != "lock-1" || cip.Nonce != "mynonce" {
+		t.Error("Failed to parse POS")
+		return
+	}
+
+	outgoing := cip.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientIncomingStats(t *testing.T) {
+	incoming := []byte("STATS mynonce")
+	_, msg, err := LoadMessage("client_incoming", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse ClientIncomingStats")
+		return
+	}
+
+	cis, ok := msg.(*ClientIncomingStats)
+
+	if !ok {
+		t.Error("Failed to receive ClientIncomingStats")
+		return
+	}
+
+	if cis.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+		return
+	}
+
+	outgoing := cis.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
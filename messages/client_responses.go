@@ -1,17 +1,27 @@
 package messages
 
-// `HELLO <nonce> <id> <version>` -> Hi, I'm <id> running <version>
+import (
+	"strconv"
+	"strings"
+)
+
+// `HELLO <nonce> <id> <version> <session>` -> Hi, I'm <id> running <version>, your locks belong to <session>
 // `GIVE <nonce> <fence>` -> Here you go, you now have the lock
+// `MGIVE <nonce> <fence1> <fence2> ...` -> You now have all the locks, with fences in the order you asked for them
 // `LOCK <nonce> <fence>` -> Yes, lock <lock> is locked, this is the <fence> token
-// `NO <nonce>` -> Lock <lock> is not locked
+// `NO <nonce>` -> Lock <lock> is not locked, or TRY could not get it, or OFF found nothing to release
+// `CONF <nonce>` -> Released the lock OFF asked for
+// `QUEUED <nonce> <position>` -> You're in line for the lock, <position> being 1 when you're next
 // `STATS <nonce> <name> <value>` -> Stats response
 // `STATSEND <nonce>` -> All stats responses have been sent
+// `FAIL <nonce> <reason>` -> Can't do that right now, e.g. because the server is draining, the connection stays open
 // `ERR <msg>` -> System error, you will be disconnected, maybe try another server
 
 type ClientHelloResponse struct {
 	Nonce   string
 	Id      string
 	Version string
+	Session string
 }
 
 type ClientOutgoingGive struct {
@@ -19,6 +29,44 @@ type ClientOutgoingGive struct {
 	Fence string
 }
 
+type ClientOutgoingMultiGive struct {
+	Nonce  string
+	Fences []string
+}
+
+type ClientOutgoingLock struct {
+	Nonce string
+	Fence string
+}
+
+type ClientOutgoingNo struct {
+	Nonce string
+}
+
+type ClientOutgoingConf struct {
+	Nonce string
+}
+
+type ClientOutgoingQueued struct {
+	Nonce    string
+	Position int
+}
+
+type ClientOutgoingStats struct {
+	Nonce string
+	Name  string
+	Value string
+}
+
+type ClientOutgoingStatsEnd struct {
+	Nonce string
+}
+
+type ClientOutgoingFail struct {
+	Nonce  string
+	Reason string
+}
+
 type ClientErrResponse struct {
 	Message string
 }
@@ -28,6 +76,7 @@ func (msg *ClientHelloResponse) ToBytes() []byte {
 		msg.Nonce,
 		msg.Id,
 		msg.Version,
+		msg.Session,
 	}
 
 	return ToBytes("HELLO", args)
@@ -42,6 +91,75 @@ func (msg *ClientOutgoingGive) ToBytes() []byte {
 	return ToBytes("GIVE", args)
 }
 
+func (msg *ClientOutgoingMultiGive) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("MGIVE", append(args, msg.Fences...))
+}
+
+func (msg *ClientOutgoingLock) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+		msg.Fence,
+	}
+
+	return ToBytes("LOCK", args)
+}
+
+func (msg *ClientOutgoingNo) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("NO", args)
+}
+
+func (msg *ClientOutgoingConf) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("CONF", args)
+}
+
+func (msg *ClientOutgoingQueued) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+		strconv.Itoa(msg.Position),
+	}
+
+	return ToBytes("QUEUED", args)
+}
+
+func (msg *ClientOutgoingStats) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+		msg.Name,
+		msg.Value,
+	}
+
+	return ToBytes("STATS", args)
+}
+
+func (msg *ClientOutgoingStatsEnd) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("STATSEND", args)
+}
+
+func (msg *ClientOutgoingFail) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+		msg.Reason,
+	}
+
+	return ToBytes("FAIL", args)
+}
+
 func (msg *ClientErrResponse) ToBytes() []byte {
 	args := []string{
 		msg.Message,
@@ -50,11 +168,12 @@ func (msg *ClientErrResponse) ToBytes() []byte {
 	return ToBytes("ERR", args)
 }
 
-func NewClientOutgoingHello(nonce string, id string, version string) Message {
+func NewClientOutgoingHello(nonce string, id string, version string, session string) Message {
 	m := ClientHelloResponse{}
 	m.Nonce = nonce
 	m.Id = id
 	m.Version = version
+	m.Session = session
 
 	return &m
 }
@@ -67,6 +186,68 @@ func NewClientOutgoingGive(nonce string, fence string) Message {
 	return &m
 }
 
+func NewClientOutgoingMultiGive(nonce string, fences []string) Message {
+	m := ClientOutgoingMultiGive{}
+	m.Nonce = nonce
+	m.Fences = fences
+
+	return &m
+}
+
+func NewClientOutgoingLock(nonce string, fence string) Message {
+	m := ClientOutgoingLock{}
+	m.Nonce = nonce
+	m.Fence = fence
+
+	return &m
+}
+
+func NewClientOutgoingNo(nonce string) Message {
+	m := ClientOutgoingNo{}
+	m.Nonce = nonce
+
+	return &m
+}
+
+func NewClientOutgoingConf(nonce string) Message {
+	m := ClientOutgoingConf{}
+	m.Nonce = nonce
+
+	return &m
+}
+
+func NewClientOutgoingQueued(nonce string, position int) Message {
+	m := ClientOutgoingQueued{}
+	m.Nonce = nonce
+	m.Position = position
+
+	return &m
+}
+
+func NewClientOutgoingStats(nonce string, name string, value string) Message {
+	m := ClientOutgoingStats{}
+	m.Nonce = nonce
+	m.Name = name
+	m.Value = value
+
+	return &m
+}
+
+func NewClientOutgoingStatsEnd(nonce string) Message {
+	m := ClientOutgoingStatsEnd{}
+	m.Nonce = nonce
+
+	return &m
+}
+
+func NewClientOutgoingFail(nonce string, reason string) Message {
+	m := ClientOutgoingFail{}
+	m.Nonce = nonce
+	m.Reason = reason
+
+	return &m
+}
+
 func NewClientErrResponse(reason string) (msg Message, err error) {
 	err = nil
 
@@ -77,3 +258,141 @@ func NewClientErrResponse(reason string) (msg Message, err error) {
 
 	return
 }
+
+// Parsers for the responses, for clients reading what the server sent
+
+func parseClientOutgoingHello(args []string) (msg Message, err error) {
+	if len(args) != 4 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingHello(args[0], args[1], args[2], args[3])
+
+	return
+}
+
+func parseClientOutgoingGive(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingGive(args[0], args[1])
+
+	return
+}
+
+func parseClientOutgoingMultiGive(args []string) (msg Message, err error) {
+	if len(args) < 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingMultiGive(args[0], args[1:])
+
+	return
+}
+
+func parseClientOutgoingLock(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingLock(args[0], args[1])
+
+	return
+}
+
+func parseClientOutgoingNo(args []string) (msg Message, err error) {
+	if len(args) != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingNo(args[0])
+
+	return
+}
+
+func parseClientOutgoingConf(args []string) (msg Message, err error) {
+	if len(args) != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingConf(args[0])
+
+	return
+}
+
+func parseClientOutgoingQueued(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	position, err := strconv.Atoi(args[1])
+
+	if err != nil || position < 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingQueued(args[0], position)
+
+	return
+}
+
+func parseClientOutgoingStats(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingStats(args[0], args[1], args[2])
+
+	return
+}
+
+func parseClientOutgoingStatsEnd(args []string) (msg Message, err error) {
+	if len(args) != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingStatsEnd(args[0])
+
+	return
+}
+
+func parseClientOutgoingFail(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = NewClientOutgoingFail(args[0], args[1])
+
+	return
+}
+
+func parseClientErrResponse(args []string) (msg Message, err error) {
+	// The reason is free text
+	return NewClientErrResponse(strings.Join(args, " "))
+}
+
+func init() {
+	RegisterMessageType("client_outgoing", "HELLO", parseClientOutgoingHello)
+	RegisterMessageType("client_outgoing", "GIVE", parseClientOutgoingGive)
+	RegisterMessageType("client_outgoing", "MGIVE", parseClientOutgoingMultiGive)
+	RegisterMessageType("client_outgoing", "LOCK", parseClientOutgoingLock)
+	RegisterMessageType("client_outgoing", "NO", parseClientOutgoingNo)
+	RegisterMessageType("client_outgoing", "CONF", parseClientOutgoingConf)
+	RegisterMessageType("client_outgoing", "QUEUED", parseClientOutgoingQueued)
+	RegisterMessageType("client_outgoing", "STATS", parseClientOutgoingStats)
+	RegisterMessageType("client_outgoing", "STATSEND", parseClientOutgoingStatsEnd)
+	RegisterMessageType("client_outgoing", "FAIL", parseClientOutgoingFail)
+	RegisterMessageType("client_outgoing", "ERR", parseClientErrResponse)
+}
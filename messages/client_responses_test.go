@@ -14,3 +14,123 @@ func TestClientOutgoingGive(t *testing.T) {
 		t.Error("Failed to convert back to bytes:", string(outgoing))
 	}
 }
+
+func TestClientOutgoingMultiGive(t *testing.T) {
+	expected := []byte("MGIVE nonce fence-1 fence-2")
+
+	msg := NewClientOutgoingMultiGive("nonce", []string{"fence-1", "fence-2"})
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, expected) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientOutgoingNo(t *testing.T) {
+	expected := []byte("NO nonce")
+
+	msg := NewClientOutgoingNo("nonce")
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, expected) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientOutgoingLock(t *testing.T) {
+	expected := []byte("LOCK nonce fence")
+
+	msg := NewClientOutgoingLock("nonce", "fence")
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, expected) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientOutgoingQueued(t *testing.T) {
+	expected := []byte("QUEUED nonce 3")
+
+	msg := NewClientOutgoingQueued("nonce", 3)
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, expected) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientOutgoingStats(t *testing.T) {
+	expected := []byte("STATS nonce locks_held 12")
+
+	msg := NewClientOutgoingStats("nonce", "locks_held", "12")
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, expected) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	expected = []byte("STATSEND nonce")
+
+	msg = NewClientOutgoingStatsEnd("nonce")
+	outgoing = msg.ToBytes()
+	if !bytes.Equal(outgoing, expected) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientOutgoingFail(t *testing.T) {
+	expected := []byte("FAIL nonce draining")
+
+	msg := NewClientOutgoingFail("nonce", "draining")
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, expected) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestClientOutgoingLoad(t *testing.T) {
+	responses := []string{
+		"HELLO nonce server-1 1.0.0 session",
+		"GIVE nonce fence",
+		"MGIVE nonce fence-1 fence-2",
+		"LOCK nonce fence",
+		"NO nonce",
+		"CONF nonce",
+		"QUEUED nonce 3",
+		"STATS nonce locks_held 12",
+		"STATSEND nonce",
+		"FAIL nonce draining",
+		"ERR Invalid keyword",
+	}
+
+	for _, response := range responses {
+		incoming := []byte(response)
+		_, msg, err := LoadMessage("client_outgoing", incoming)
+
+		if err != nil {
+			t.Error("Failed to load", response)
+			continue
+		}
+
+		outgoing := msg.ToBytes()
+		if !bytes.Equal(outgoing, incoming) {
+			t.Error("Failed to convert back to bytes:", string(outgoing))
+		}
+	}
+
+	_, genmsg, _ := LoadMessage("client_outgoing", []byte("GIVE nonce fence"))
+	msg, ok := genmsg.(*ClientOutgoingGive)
+
+	if !ok || msg.Nonce != "nonce" || msg.Fence != "fence" {
+		t.Error("Failed to parse GIVE")
+	}
+
+	invalid := []string{
+		"GIVE nonce",
+		"MGIVE nonce",
+		"QUEUED nonce first",
+		"FAIL nonce",
+		"CONF",
+	}
+
+	for _, response := range invalid {
+		if _, _, err := LoadMessage("client_outgoing", []byte(response)); err == nil {
+			t.Error("Loaded invalid response", response)
+		}
+	}
+}
@@ -42,6 +42,22 @@ func StringToDuration(src string) (duration time.Duration, err error) {
 	return
 }
 
+// Lock names for requests covering several locks at once, each of them
+// only once
+func parseLocks(args []string) ([]string, error) {
+	seen := map[string]bool{}
+
+	for _, lock := range args {
+		if lock == "" || seen[lock] {
+			return nil, ErrInvalidMessage
+		}
+
+		seen[lock] = true
+	}
+
+	return args, nil
+}
+
 func RegisterMessageType(category string, keyword string, constructor MessageConstructor) {
 	if _, ok := messageTypes[category]; !ok {
 		messageTypes[category] = map[string]MessageConstructor{}
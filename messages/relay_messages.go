@@ -2,16 +2,20 @@ package messages
 
 import (
 	"time"
+	"fmt"
+	"strconv"
 )
 
 //
-// `HELLO <id> <version> <nonce>` -> I'm server <id> running <version>
+// `HELLO <id> <version> <nonce> [<challenge>]` -> I'm server <id> running <version>, prove you have the cluster key by signing <challenge>
 // 
 
 type RelayIncomingHello struct {
-	Id      string
-	Version string
-	Nonce   string
+	Id        string
+	Version   string
+	Nonce     string
+	// Empty without a cluster key
+	Challenge string
 }
 
 func (msg *RelayIncomingHello) ToBytes() []byte {
@@ -21,6 +25,10 @@ func (msg *RelayIncomingHello) ToBytes() []byte {
 		msg.Nonce,
 	}
 
+	if msg.Challenge != "" {
+		args = append(args, msg.Challenge)
+	}
+
 	return ToBytes("HELLO", args)
 }
 
@@ -33,7 +41,7 @@ func (msg *RelayIncomingHello) GetNonce() string {
 }
 
 func NewRelayIncomingHello(args []string) (msg Message, err error) {
-	if len(args) != 3 {
+	if len(args) != 3 && len(args) != 4 {
 		err = ErrInvalidMessage
 		return
 	}
@@ -43,6 +51,52 @@ func NewRelayIncomingHello(args []string) (msg Message, err error) {
 	m.Version = args[1]
 	m.Nonce = args[2]
 
+	if len(args) == 4 {
+		m.Challenge = args[3]
+	}
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `AUTH <proof> <nonce>` -> Here's your challenge signed with the cluster key
+//
+
+type RelayIncomingAuth struct {
+	Proof string
+	Nonce string
+}
+
+func (msg *RelayIncomingAuth) ToBytes() []byte {
+	args := []string{
+		msg.Proof,
+		msg.Nonce,
+	}
+
+	return ToBytes("AUTH", args)
+}
+
+func (msg *RelayIncomingAuth) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingAuth) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingAuth(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingAuth{}
+	m.Proof = args[0]
+	m.Nonce = args[1]
+
 	msg = &m
 
 	return
@@ -50,12 +104,13 @@ func NewRelayIncomingHello(args []string) (msg Message, err error) {
 
 
 //
-// `PROP <lock> <nonce>` -> I propose locking, please give me your lock status
+// `PROP <lock> <nonce> [<mode>]` -> I propose locking, please give me your lock status
 // 
 
 type RelayIncomingProp struct {
-	Lock  string
-	Nonce string
+	Lock   string
+	Nonce  string
+	LockMode
 }
 
 func (msg *RelayIncomingProp) ToBytes() []byte {
@@ -64,7 +119,7 @@ func (msg *RelayIncomingProp) ToBytes() []byte {
 		msg.Nonce,
 	}
 
-	return ToBytes("PROP", args)
+	return ToBytes("PROP", appendMode(args, msg.LockMode))
 }
 
 func (msg *RelayIncomingProp) SetNonce(nonce string) {
@@ -76,12 +131,13 @@ func (msg *RelayIncomingProp) GetNonce() string {
 }
 
 func NewRelayIncomingProp(args []string) (msg Message, err error) {
-	if len(args) != 2 {
-		err = ErrInvalidMessage
+	m := RelayIncomingProp{}
+	m.LockMode, err = parseMode(args, 2)
+
+	if err != nil {
 		return
 	}
 
-	m := RelayIncomingProp{}
 	m.Lock = args[0]
 	m.Nonce = args[1]
 
@@ -92,12 +148,13 @@ func NewRelayIncomingProp(args []string) (msg Message, err error) {
 
 
 //
-// `SCHED <lock> <nonce>` -> We have quorum, nobody is locked, prep to lock
+// `SCHED <lock> <nonce> [<mode>]` -> We have quorum, nobody is locked, prep to lock
 // 
 
 type RelayIncomingSched struct {
-	Lock  string
-	Nonce string
+	Lock   string
+	Nonce  string
+	LockMode
 }
 
 func (msg *RelayIncomingSched) ToBytes() []byte {
@@ -106,7 +163,7 @@ func (msg *RelayIncomingSched) ToBytes() []byte {
 		msg.Nonce,
 	}
 
-	return ToBytes("SCHED", args)
+	return ToBytes("SCHED", appendMode(args, msg.LockMode))
 }
 
 func (msg *RelayIncomingSched) SetNonce(nonce string) {
@@ -118,12 +175,13 @@ func (msg *RelayIncomingSched) GetNonce() string {
 }
 
 func NewRelayIncomingSched(args []string) (msg Message, err error) {
-	if len(args) != 2 {
-		err = ErrInvalidMessage
+	m := RelayIncomingSched{}
+	m.LockMode, err = parseMode(args, 2)
+
+	if err != nil {
 		return
 	}
 
-	m := RelayIncomingSched{}
 	m.Lock = args[0]
 	m.Nonce = args[1]
 
@@ -134,23 +192,28 @@ func NewRelayIncomingSched(args []string) (msg Message, err error) {
 
 
 //
-// `COMM <lock> <timeout> <nonce>` -> Commit lock with X timeout
+// `COMM <lock> <timeout> <fence> <session> <nonce> [<mode>]` -> Commit lock with X timeout and <fence> for the client <session>
 // 
 
 type RelayIncomingComm struct {
 	Lock    string
 	Timeout time.Duration
+	Fence   string
+	Session string
 	Nonce   string
+	LockMode
 }
 
 func (msg *RelayIncomingComm) ToBytes() []byte {
 	args := []string{
 		msg.Lock,
 		DurationToString(msg.Timeout),
+		msg.Fence,
+		msg.Session,
 		msg.Nonce,
 	}
 
-	return ToBytes("COMM", args)
+	return ToBytes("COMM", appendMode(args, msg.LockMode))
 }
 
 func (msg *RelayIncomingComm) SetNonce(nonce string) {
@@ -162,15 +225,18 @@ func (msg *RelayIncomingComm) GetNonce() string {
 }
 
 func NewRelayIncomingComm(args []string) (msg Message, err error) {
-	if len(args) != 3 {
-		err = ErrInvalidMessage
+	m := RelayIncomingComm{}
+	m.LockMode, err = parseMode(args, 5)
+
+	if err != nil {
 		return
 	}
 
-	m := RelayIncomingComm{}
 	m.Lock = args[0]
 	m.Timeout, err = StringToDuration(args[1])
-	m.Nonce = args[2]
+	m.Fence = args[2]
+	m.Session = args[3]
+	m.Nonce = args[4]
 
 	if err != nil {
 		err = ErrInvalidMessage
@@ -184,17 +250,179 @@ func NewRelayIncomingComm(args []string) (msg Message, err error) {
 
 
 //
-// `OFF <lock> <nonce>` -> Release lock if it was held by the source relay
+// `MPROP <nonce> <lock1> <lock2> ...` -> I propose locking all of these at once, please give me your lock status
+//
+
+type RelayIncomingMultiProp struct {
+	Nonce string
+	Locks []string
+}
+
+func (msg *RelayIncomingMultiProp) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("MPROP", append(args, msg.Locks...))
+}
+
+func (msg *RelayIncomingMultiProp) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingMultiProp) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingMultiProp(args []string) (msg Message, err error) {
+	if len(args) < 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingMultiProp{}
+	m.Nonce = args[0]
+	m.Locks, err = parseLocks(args[1:])
+
+	if err != nil {
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `MSCHED <nonce> <lock1> <lock2> ...` -> We have quorum for all of these, prep to lock them
+//
+
+type RelayIncomingMultiSched struct {
+	Nonce string
+	Locks []string
+}
+
+func (msg *RelayIncomingMultiSched) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("MSCHED", append(args, msg.Locks...))
+}
+
+func (msg *RelayIncomingMultiSched) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingMultiSched) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingMultiSched(args []string) (msg Message, err error) {
+	if len(args) < 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingMultiSched{}
+	m.Nonce = args[0]
+	m.Locks, err = parseLocks(args[1:])
+
+	if err != nil {
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `MCOMM <timeout> <session> <nonce> <lock1> <fence1> <lock2> <fence2> ...` -> Commit all of the locks with X timeout for the client <session>, each with its own fence
+//
+
+type RelayIncomingMultiComm struct {
+	Timeout time.Duration
+	Session string
+	Nonce   string
+	Locks   []string
+	Fences  []string
+}
+
+func (msg *RelayIncomingMultiComm) ToBytes() []byte {
+	args := []string{
+		DurationToString(msg.Timeout),
+		msg.Session,
+		msg.Nonce,
+	}
+
+	for i, lock := range msg.Locks {
+		args = append(args, lock, msg.Fences[i])
+	}
+
+	return ToBytes("MCOMM", args)
+}
+
+func (msg *RelayIncomingMultiComm) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingMultiComm) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingMultiComm(args []string) (msg Message, err error) {
+	if len(args) < 5 || len(args) % 2 != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingMultiComm{}
+	m.Timeout, err = StringToDuration(args[0])
+
+	if err != nil {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m.Session = args[1]
+	m.Nonce = args[2]
+
+	locks := []string{}
+	for i := 3; i < len(args); i += 2 {
+		locks = append(locks, args[i])
+		m.Fences = append(m.Fences, args[i + 1])
+	}
+
+	m.Locks, err = parseLocks(locks)
+
+	if err != nil {
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+//
+// `OFF <lock> <fence> <session> <nonce>` -> Release the hold with <fence> if it was held by the source relay for <session>
 //
 
 type RelayIncomingOff struct {
 	Lock    string
+	Fence   string
+	Session string
 	Nonce   string
 }
 
 func (msg *RelayIncomingOff) ToBytes() []byte {
 	args := []string{
 		msg.Lock,
+		msg.Fence,
+		msg.Session,
 		msg.Nonce,
 	}
 
@@ -210,13 +438,258 @@ func (msg *RelayIncomingOff) GetNonce() string {
 }
 
 func NewRelayIncomingOff(args []string) (msg Message, err error) {
-	if len(args) != 2 {
+	if len(args) != 4 {
 		err = ErrInvalidMessage
 		return
 	}
 
 	m := RelayIncomingOff{}
 	m.Lock = args[0]
+	m.Fence = args[1]
+	m.Session = args[2]
+	m.Nonce = args[3]
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `ABORT <lock> <fence> <nonce>` -> Drop the hold the source relay took for a failed proposal
+//
+
+type RelayIncomingAbort struct {
+	Lock    string
+	Fence   string
+	Nonce   string
+}
+
+func (msg *RelayIncomingAbort) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		msg.Fence,
+		msg.Nonce,
+	}
+
+	return ToBytes("ABORT", args)
+}
+
+func (msg *RelayIncomingAbort) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingAbort) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingAbort(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingAbort{}
+	m.Lock = args[0]
+	m.Fence = args[1]
+	m.Nonce = args[2]
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `QUEUE <lock> <ticket> <nonce>` -> A client of the source relay is in line for <lock> with <ticket>
+//
+
+type RelayIncomingQueue struct {
+	Lock   string
+	Ticket uint64
+	Nonce  string
+}
+
+func (msg *RelayIncomingQueue) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		strconv.FormatUint(msg.Ticket, 10),
+		msg.Nonce,
+	}
+
+	return ToBytes("QUEUE", args)
+}
+
+func (msg *RelayIncomingQueue) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingQueue) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingQueue(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingQueue{}
+	m.Lock = args[0]
+	m.Nonce = args[2]
+	m.Ticket, err = strconv.ParseUint(args[1], 10, 64)
+
+	if err != nil {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `DEQUEUE <lock> <ticket> <nonce>` -> The client of the source relay with <ticket> got <lock> or gave up on it
+//
+
+type RelayIncomingDequeue struct {
+	Lock   string
+	Ticket uint64
+	Nonce  string
+}
+
+func (msg *RelayIncomingDequeue) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		strconv.FormatUint(msg.Ticket, 10),
+		msg.Nonce,
+	}
+
+	return ToBytes("DEQUEUE", args)
+}
+
+func (msg *RelayIncomingDequeue) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingDequeue) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingDequeue(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingDequeue{}
+	m.Lock = args[0]
+	m.Nonce = args[2]
+	m.Ticket, err = strconv.ParseUint(args[1], 10, 64)
+
+	if err != nil {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `REFRESH <lock> <fence> <session> <timeout> <nonce>` -> Extend the lock with <fence> to X timeout if it was given to <session>, it's now held through the source relay
+//
+
+type RelayIncomingRefresh struct {
+	Lock    string
+	Fence   string
+	Session string
+	Timeout time.Duration
+	Nonce   string
+}
+
+func (msg *RelayIncomingRefresh) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		msg.Fence,
+		msg.Session,
+		DurationToString(msg.Timeout),
+		msg.Nonce,
+	}
+
+	return ToBytes("REFRESH", args)
+}
+
+func (msg *RelayIncomingRefresh) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingRefresh) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingRefresh(args []string) (msg Message, err error) {
+	if len(args) != 5 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingRefresh{}
+	m.Lock = args[0]
+	m.Fence = args[1]
+	m.Session = args[2]
+	m.Timeout, err = StringToDuration(args[3])
+	m.Nonce = args[4]
+
+	if err != nil {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `IS <lock> <nonce>` -> Is the lock engaged on your end
+//
+
+type RelayIncomingIs struct {
+	Lock  string
+	Nonce string
+}
+
+func (msg *RelayIncomingIs) ToBytes() []byte {
+	args := []string{
+		msg.Lock,
+		msg.Nonce,
+	}
+
+	return ToBytes("IS", args)
+}
+
+func (msg *RelayIncomingIs) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingIs) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingIs(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingIs{}
+	m.Lock = args[0]
 	m.Nonce = args[1]
 
 	msg = &m
@@ -225,12 +698,224 @@ func NewRelayIncomingOff(args []string) (msg Message, err error) {
 }
 
 
+//
+// `BYE <nonce>` -> I'm shutting down, don't count on me for quorum anymore
+//
+
+type RelayIncomingBye struct {
+	Nonce string
+}
+
+func (msg *RelayIncomingBye) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("BYE", args)
+}
+
+func (msg *RelayIncomingBye) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingBye) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingBye(args []string) (msg Message, err error) {
+	if len(args) != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingBye{}
+	m.Nonce = args[0]
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `SYNC <nonce>` -> Send me all the locks you know of
+//
+
+type RelayIncomingSync struct {
+	Nonce string
+}
+
+func (msg *RelayIncomingSync) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("SYNC", args)
+}
+
+func (msg *RelayIncomingSync) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayIncomingSync) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayIncomingSync(args []string) (msg Message, err error) {
+	if len(args) != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayIncomingSync{}
+	m.Nonce = args[0]
+
+	msg = &m
+
+	return
+}
+
+
+//
+// `SNAP <nonce> <lock> <owner> <session> <fence> <remaining> [<mode>]` -> Response to SYNC, one per lock, reader of a shared lock or permit of a semaphore: <lock> is held through server <owner> by the client <session> for <remaining> more
+//
+
+type RelaySnap struct {
+	Nonce     string
+	Lock      string
+	Owner     string
+	Session   string
+	Fence     string
+	Remaining time.Duration
+	LockMode
+}
+
+func (msg *RelaySnap) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+		msg.Lock,
+		msg.Owner,
+		msg.Session,
+		msg.Fence,
+		DurationToString(msg.Remaining),
+	}
+
+	return ToBytes("SNAP", appendMode(args, msg.LockMode))
+}
+
+func (msg *RelaySnap) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelaySnap) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelaySnap(args []string) (msg Message, err error) {
+	m := RelaySnap{}
+	m.LockMode, err = parseMode(args, 6)
+
+	if err != nil {
+		return
+	}
+
+	m.Nonce = args[0]
+	m.Lock = args[1]
+	m.Owner = args[2]
+	m.Session = args[3]
+	m.Fence = args[4]
+	m.Remaining, err = StringToDuration(args[5])
+
+	if err != nil {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
+
 // -----
 
+// How a lock request wants the lock, given as the optional last argument:
+// nothing for exclusive locks, `shared` for a reader of a shared lock, or
+// `permit:<slot>/<permits>` for permit <slot> of a semaphore with <permits>
+type LockMode struct {
+	Shared  bool
+	Slot    int
+	Permits int
+}
+
+func (mode LockMode) String() string {
+	if mode.Permits > 0 {
+		return fmt.Sprintf("permit:%d/%d", mode.Slot, mode.Permits)
+	}
+
+	if mode.Shared {
+		return "shared"
+	}
+
+	return ""
+}
+
+func ParseLockMode(src string) (mode LockMode, err error) {
+	if src == "shared" {
+		mode.Shared = true
+		return
+	}
+
+	_, err = fmt.Sscanf(src, "permit:%d/%d", &mode.Slot, &mode.Permits)
+
+	if err != nil || mode.Permits < 1 || mode.Slot < 0 || mode.Slot >= mode.Permits || mode.String() != src {
+		err = ErrInvalidMessage
+		return
+	}
+
+	// Semaphores are shared by up to <permits> holders
+	mode.Shared = true
+
+	return
+}
+
+// Check there are count arguments before the optional lock mode
+func parseMode(args []string, count int) (mode LockMode, err error) {
+	if len(args) == count + 1 {
+		return ParseLockMode(args[count])
+	}
+
+	if len(args) != count {
+		err = ErrInvalidMessage
+	}
+
+	return
+}
+
+func appendMode(args []string, mode LockMode) []string {
+	if mode.Shared {
+		return append(args, mode.String())
+	}
+
+	return args
+}
+
 func init() {
 	RegisterMessageType("relay", "HELLO", NewRelayIncomingHello)
+	RegisterMessageType("relay", "AUTH", NewRelayIncomingAuth)
 	RegisterMessageType("relay", "PROP", NewRelayIncomingProp)
 	RegisterMessageType("relay", "SCHED", NewRelayIncomingSched)
 	RegisterMessageType("relay", "COMM", NewRelayIncomingComm)
+	RegisterMessageType("relay", "MPROP", NewRelayIncomingMultiProp)
+	RegisterMessageType("relay", "MSCHED", NewRelayIncomingMultiSched)
+	RegisterMessageType("relay", "MCOMM", NewRelayIncomingMultiComm)
 	RegisterMessageType("relay", "OFF", NewRelayIncomingOff)
+	RegisterMessageType("relay", "ABORT", NewRelayIncomingAbort)
+	RegisterMessageType("relay", "QUEUE", NewRelayIncomingQueue)
+	RegisterMessageType("relay", "DEQUEUE", NewRelayIncomingDequeue)
+	RegisterMessageType("relay", "REFRESH", NewRelayIncomingRefresh)
+	RegisterMessageType("relay", "IS", NewRelayIncomingIs)
+	RegisterMessageType("relay", "BYE", NewRelayIncomingBye)
+	RegisterMessageType("relay", "SYNC", NewRelayIncomingSync)
+	RegisterMessageType("relay", "SNAP", NewRelaySnap)
 }
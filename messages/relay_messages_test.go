@@ -40,6 +40,58 @@ func TestRelayIncomingHello(t *testing.T) {
 	}
 }
 
+func TestRelayIncomingHelloChallenge(t *testing.T) {
+	incoming := []byte("HELLO server-1 1.0.0 mynonce mychallenge")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingHello")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingHello)
+
+	if !ok || msg.Nonce != "mynonce" || msg.Challenge != "mychallenge" {
+		t.Error("Failed to parse challenge")
+		return
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestRelayIncomingAuth(t *testing.T) {
+	incoming := []byte("AUTH myproof mynonce")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingAuth")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingAuth)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingAuth")
+		return
+	}
+
+	if msg.Proof != "myproof" {
+		t.Error("Failed to parse proof")
+	}
+
+	if msg.Nonce != "mynonce" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
 func TestRelayIncomingProp(t *testing.T) {
 	incoming := []byte("PROP lock-1 nonce-1")
 	_, genmsg, err := LoadMessage("relay", incoming)
@@ -70,6 +122,74 @@ func TestRelayIncomingProp(t *testing.T) {
 	}
 }
 
+func TestRelayIncomingPropShared(t *testing.T) {
+	incoming := []byte("PROP lock-1 nonce-1 shared")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingProp")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingProp)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingProp")
+		return
+	}
+
+	if msg.Lock != "lock-1" {
+		t.Error("Failed to parse lock")
+	}
+
+	if !msg.Shared {
+		t.Error("Failed to parse shared")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	_, _, err = LoadMessage("relay", []byte("PROP lock-1 nonce-1 exclusive"))
+	if err == nil {
+		t.Error("Accepted an unknown mode")
+	}
+}
+
+func TestRelayIncomingPropPermit(t *testing.T) {
+	incoming := []byte("PROP lock-1 nonce-1 permit:1/3")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingProp")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingProp)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingProp")
+		return
+	}
+
+	if !msg.Shared || msg.Slot != 1 || msg.Permits != 3 {
+		t.Errorf("Failed to parse permit %+v", msg.LockMode)
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	for _, mode := range []string{"permit:3/3", "permit:-1/3", "permit:0/0", "permit:1"} {
+		_, _, err = LoadMessage("relay", []byte("PROP lock-1 nonce-1 " + mode))
+		if err == nil {
+			t.Error("Accepted invalid mode", mode)
+		}
+	}
+}
+
 func TestRelayIncomingSched(t *testing.T) {
 	incoming := []byte("SCHED lock-1 nonce-1")
 	_, genmsg, err := LoadMessage("relay", incoming)
@@ -102,7 +222,7 @@ func TestRelayIncomingSched(t *testing.T) {
 
 
 func TestRelayIncomingComm(t *testing.T) {
-	incoming := []byte("COMM lock-1 123 nonce-1")
+	incoming := []byte("COMM lock-1 123 fence-1 session-1 nonce-1")
 	_, genmsg, err := LoadMessage("relay", incoming)
 
 	if err != nil {
@@ -125,6 +245,14 @@ func TestRelayIncomingComm(t *testing.T) {
 		t.Error("Failed to parse timeout")
 	}
 
+	if msg.Fence != "fence-1" {
+		t.Error("Failed to parse fence")
+	}
+
+	if msg.Session != "session-1" {
+		t.Error("Failed to parse session")
+	}
+
 	if msg.Nonce != "nonce-1" {
 		t.Error("Failed to parse nonce")
 	}
@@ -136,8 +264,108 @@ func TestRelayIncomingComm(t *testing.T) {
 }
 
 
+func TestRelayIncomingMultiProp(t *testing.T) {
+	incoming := []byte("MPROP nonce-1 lock-1 lock-2")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingMultiProp")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingMultiProp)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingMultiProp")
+		return
+	}
+
+	if msg.Nonce != "nonce-1" || len(msg.Locks) != 2 || msg.Locks[1] != "lock-2" {
+		t.Error("Failed to parse nonce and locks")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	_, _, err = LoadMessage("relay", []byte("MPROP nonce-1 lock-1 lock-1"))
+	if err == nil {
+		t.Error("Accepted the same lock twice")
+	}
+}
+
+func TestRelayIncomingMultiSched(t *testing.T) {
+	incoming := []byte("MSCHED nonce-1 lock-1 lock-2")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingMultiSched")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingMultiSched)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingMultiSched")
+		return
+	}
+
+	if msg.Nonce != "nonce-1" || len(msg.Locks) != 2 || msg.Locks[0] != "lock-1" {
+		t.Error("Failed to parse nonce and locks")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestRelayIncomingMultiComm(t *testing.T) {
+	incoming := []byte("MCOMM 123 session-1 nonce-1 lock-1 10 lock-2 11")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingMultiComm")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingMultiComm)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingMultiComm")
+		return
+	}
+
+	if msg.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+	}
+
+	if msg.Session != "session-1" {
+		t.Error("Failed to parse session")
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	if len(msg.Locks) != 2 || msg.Locks[1] != "lock-2" || msg.Fences[1] != "11" {
+		t.Error("Failed to parse locks and fences")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	_, _, err = LoadMessage("relay", []byte("MCOMM 123 session-1 nonce-1 lock-1 10 lock-2"))
+	if err == nil {
+		t.Error("Accepted a lock without a fence")
+	}
+}
+
 func TestRelayIncomingOff(t *testing.T) {
-	incoming := []byte("OFF lock-1 nonce-1")
+	incoming := []byte("OFF lock-1 fence-1 session-1 nonce-1")
 	_, genmsg, err := LoadMessage("relay", incoming)
 
 	if err != nil {
@@ -156,6 +384,14 @@ func TestRelayIncomingOff(t *testing.T) {
 		t.Error("Failed to parse lock")
 	}
 
+	if msg.Fence != "fence-1" {
+		t.Error("Failed to parse fence")
+	}
+
+	if msg.Session != "session-1" {
+		t.Error("Failed to parse session")
+	}
+
 	if msg.Nonce != "nonce-1" {
 		t.Error("Failed to parse nonce")
 	}
@@ -165,3 +401,278 @@ func TestRelayIncomingOff(t *testing.T) {
 		t.Error("Failed to convert back to bytes:", string(outgoing))
 	}
 }
+
+
+func TestRelayIncomingAbort(t *testing.T) {
+	incoming := []byte("ABORT lock-1 fence-1 nonce-1")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingAbort")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingAbort)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingAbort")
+		return
+	}
+
+	if msg.Lock != "lock-1" {
+		t.Error("Failed to parse lock")
+	}
+
+	if msg.Fence != "fence-1" {
+		t.Error("Failed to parse fence")
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+
+func TestRelayIncomingQueue(t *testing.T) {
+	incoming := []byte("QUEUE lock-1 42 nonce-1")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingQueue")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingQueue)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingQueue")
+		return
+	}
+
+	if msg.Lock != "lock-1" {
+		t.Error("Failed to parse lock")
+	}
+
+	if msg.Ticket != 42 {
+		t.Error("Failed to parse ticket")
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	if _, _, err := LoadMessage("relay", []byte("QUEUE lock-1 ticket nonce-1")); err == nil {
+		t.Error("Accepted a ticket that isn't a number")
+	}
+}
+
+func TestRelayIncomingDequeue(t *testing.T) {
+	incoming := []byte("DEQUEUE lock-1 42 nonce-1")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingDequeue")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingDequeue)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingDequeue")
+		return
+	}
+
+	if msg.Lock != "lock-1" || msg.Ticket != 42 || msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse DEQUEUE")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+
+func TestRelayIncomingRefresh(t *testing.T) {
+	incoming := []byte("REFRESH lock-1 fence-1 session-1 123 nonce-1")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingRefresh")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingRefresh)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingRefresh")
+		return
+	}
+
+	if msg.Lock != "lock-1" {
+		t.Error("Failed to parse lock")
+	}
+
+	if msg.Timeout != time.Millisecond * 123 {
+		t.Error("Failed to parse timeout")
+	}
+
+	if msg.Fence != "fence-1" {
+		t.Error("Failed to parse fence")
+	}
+
+	if msg.Session != "session-1" {
+		t.Error("Failed to parse session")
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+
+func TestRelayIncomingIs(t *testing.T) {
+	incoming := []byte("IS lock-1 nonce-1")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingIs")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingIs)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingIs")
+		return
+	}
+
+	if msg.Lock != "lock-1" {
+		t.Error("Failed to parse lock")
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+
+func TestRelayIncomingBye(t *testing.T) {
+	incoming := []byte("BYE nonce-1")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingBye")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingBye)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingBye")
+		return
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+
+func TestRelayIncomingSync(t *testing.T) {
+	incoming := []byte("SYNC nonce-1")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelayIncomingSync")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayIncomingSync)
+
+	if !ok {
+		t.Error("Failed to receive RelayIncomingSync")
+		return
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+
+func TestRelaySnap(t *testing.T) {
+	incoming := []byte("SNAP nonce-1 lock-1 server-1 session-1 fence-1 123")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to parse RelaySnap")
+		return
+	}
+
+	msg, ok := genmsg.(*RelaySnap)
+
+	if !ok {
+		t.Error("Failed to receive RelaySnap")
+		return
+	}
+
+	if msg.Nonce != "nonce-1" {
+		t.Error("Failed to parse nonce")
+	}
+
+	if msg.Lock != "lock-1" {
+		t.Error("Failed to parse lock")
+	}
+
+	if msg.Owner != "server-1" {
+		t.Error("Failed to parse owner")
+	}
+
+	if msg.Session != "session-1" {
+		t.Error("Failed to parse session")
+	}
+
+	if msg.Fence != "fence-1" {
+		t.Error("Failed to parse fence")
+	}
+
+	if msg.Remaining != time.Millisecond * 123 {
+		t.Error("Failed to parse remaining time")
+	}
+
+	outgoing := msg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
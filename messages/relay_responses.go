@@ -9,16 +9,22 @@ var responseTypes = []string{
 	"STAT",
 	"ACK",
 	"CONF",
+	"LOCK",
+	"NO",
+	"SNAPEND",
 }
 
 //
-// `HOWDY <nonce> <id> <version>` -> Hi, I'm <id> running <version>//
+// `HOWDY <nonce> <id> <version> [<challenge> <proof>]` -> Hi, I'm <id> running <version>, here's your challenge signed, sign <challenge> too with AUTH
 //
 
 type RelayHowdy struct {
-	Nonce   string
-	Id      string
-	Version string
+	Nonce     string
+	Id        string
+	Version   string
+	// Both empty without a cluster key
+	Challenge string
+	Proof     string
 }
 
 func (msg *RelayHowdy) ToBytes() []byte {
@@ -28,6 +34,10 @@ func (msg *RelayHowdy) ToBytes() []byte {
 		msg.Version,
 	}
 
+	if msg.Challenge != "" {
+		args = append(args, msg.Challenge, msg.Proof)
+	}
+
 	return ToBytes("HOWDY", args)
 }
 
@@ -40,7 +50,7 @@ func (msg *RelayHowdy) GetNonce() string {
 }
 
 func NewRelayHowdy(args []string) (msg Message, err error) {
-	if len(args) != 3 {
+	if len(args) != 3 && len(args) != 5 {
 		err = ErrInvalidMessage
 		return
 	}
@@ -50,24 +60,31 @@ func NewRelayHowdy(args []string) (msg Message, err error) {
 	m.Id = args[1]
 	m.Version = args[2]
 
+	if len(args) == 5 {
+		m.Challenge = args[3]
+		m.Proof = args[4]
+	}
+
 	msg = &m
 
 	return
 }
 
 //
-// `STAT <nonce> <status>` -> Response to PROP: status 0 = ok, 1 = held by this server, 2 = held by another relay
+// `STAT <nonce> <status> <fence>` -> Response to PROP: status 0 = ok, 1 = held by this server, 2 = held by another relay, <fence> is the highest fence seen
 //
 
 type RelayStat struct {
 	Nonce   string
 	Status  int
+	Fence   uint64
 }
 
 func (msg *RelayStat) ToBytes() []byte {
 	args := []string{
 		msg.Nonce,
 		strconv.Itoa(msg.Status),
+		strconv.FormatUint(msg.Fence, 10),
 	}
 
 	return ToBytes("STAT", args)
@@ -82,7 +99,7 @@ func (msg *RelayStat) GetNonce() string {
 }
 
 func NewRelayStat(args []string) (msg Message, err error) {
-	if len(args) != 2 {
+	if len(args) != 3 {
 		err = ErrInvalidMessage
 		return
 	}
@@ -91,6 +108,10 @@ func NewRelayStat(args []string) (msg Message, err error) {
 	m.Nonce = args[0]
 	m.Status, err = strconv.Atoi(args[1])
 
+	if err == nil {
+		m.Fence, err = strconv.ParseUint(args[2], 10, 64)
+	}
+
 	if err != nil {
 		err = ErrInvalidMessage
 		return
@@ -102,7 +123,7 @@ func NewRelayStat(args []string) (msg Message, err error) {
 }
 
 //
-// `ACK <nonce> <status>` -> Acknowledging SCHED: status 1 = ok, 0 = err
+// `ACK <nonce> <status>` -> Acknowledging AUTH, SCHED, ABORT, QUEUE, DEQUEUE or BYE: status 0 = ok, 1 = err
 //
 
 type RelayAck struct {
@@ -148,7 +169,7 @@ func NewRelayAck(args []string) (msg Message, err error) {
 }
 
 //
-// `CONF <nonce> <status>` -> Confirming commit 1/0 = ok/err
+// `CONF <nonce> <status>` -> Confirming commit or refresh 0/1 = ok/err
 //
 
 type RelayConf struct {
@@ -193,6 +214,137 @@ func NewRelayConf(args []string) (msg Message, err error) {
 	return
 }
 
+//
+// `LOCK <nonce> <fence>` -> Response to IS: the lock is engaged with <fence>
+//
+
+type RelayLock struct {
+	Nonce string
+	Fence string
+}
+
+func (msg *RelayLock) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+		msg.Fence,
+	}
+
+	return ToBytes("LOCK", args)
+}
+
+func (msg *RelayLock) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayLock) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayLock(args []string) (msg Message, err error) {
+	if len(args) != 2 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayLock{}
+	m.Nonce = args[0]
+	m.Fence = args[1]
+
+	msg = &m
+
+	return
+}
+
+//
+// `NO <nonce>` -> Response to IS: the lock is not engaged
+//
+
+type RelayNo struct {
+	Nonce string
+}
+
+func (msg *RelayNo) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+	}
+
+	return ToBytes("NO", args)
+}
+
+func (msg *RelayNo) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelayNo) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelayNo(args []string) (msg Message, err error) {
+	if len(args) != 1 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelayNo{}
+	m.Nonce = args[0]
+
+	msg = &m
+
+	return
+}
+
+//
+// `SNAPEND <nonce> <count> <fence>` -> All <count> SNAP responses to SYNC have been sent, <fence> is the highest fence seen
+//
+
+type RelaySnapEnd struct {
+	Nonce string
+	Count int
+	Fence uint64
+}
+
+func (msg *RelaySnapEnd) ToBytes() []byte {
+	args := []string{
+		msg.Nonce,
+		strconv.Itoa(msg.Count),
+		strconv.FormatUint(msg.Fence, 10),
+	}
+
+	return ToBytes("SNAPEND", args)
+}
+
+func (msg *RelaySnapEnd) SetNonce(nonce string) {
+	msg.Nonce = nonce
+}
+
+func (msg *RelaySnapEnd) GetNonce() string {
+	return msg.Nonce
+}
+
+func NewRelaySnapEnd(args []string) (msg Message, err error) {
+	if len(args) != 3 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	m := RelaySnapEnd{}
+	m.Nonce = args[0]
+	m.Count, err = strconv.Atoi(args[1])
+
+	if err == nil {
+		m.Fence, err = strconv.ParseUint(args[2], 10, 64)
+	}
+
+	if err != nil {
+		err = ErrInvalidMessage
+		return
+	}
+
+	msg = &m
+
+	return
+}
+
 //
 // `ERR <nonce> <message>` -> System error, you will be disconnected
 //
@@ -251,5 +403,8 @@ func init() {
 	RegisterMessageType("relay", "STAT", NewRelayStat)
 	RegisterMessageType("relay", "ACK", NewRelayAck)
 	RegisterMessageType("relay", "CONF", NewRelayConf)
+	RegisterMessageType("relay", "LOCK", NewRelayLock)
+	RegisterMessageType("relay", "NO", NewRelayNo)
+	RegisterMessageType("relay", "SNAPEND", NewRelaySnapEnd)
 	RegisterMessageType("relay", "ERR", NewRelayErr)
 }
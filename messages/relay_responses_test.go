@@ -39,8 +39,34 @@ func TestRelayHowdy(t *testing.T) {
 	}
 }
 
+func TestRelayHowdyChallenge(t *testing.T) {
+	incoming := []byte("HOWDY nonce server-1 1.0.0 challenge proof")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to create RelayHowdy")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayHowdy)
+
+	if !ok || msg.Challenge != "challenge" || msg.Proof != "proof" {
+		t.Error("Failed to parse challenge and proof")
+		return
+	}
+
+	outgoing := genmsg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+
+	if _, _, err := LoadMessage("relay", []byte("HOWDY nonce server-1 1.0.0 challenge")); err == nil {
+		t.Error("Accepted a challenge without a proof")
+	}
+}
+
 func TestRelayStat(t *testing.T) {
-	incoming := []byte("STAT nonce 0")
+	incoming := []byte("STAT nonce 0 42")
 	_, genmsg, err := LoadMessage("relay", incoming)
 
 	if err != nil {
@@ -63,6 +89,10 @@ func TestRelayStat(t *testing.T) {
 		t.Error("Failed to parse status")
 	}
 
+	if msg.Fence != 42 {
+		t.Error("Failed to parse fence")
+	}
+
 	outgoing := genmsg.ToBytes()
 	if !bytes.Equal(outgoing, incoming) {
 		t.Error("Failed to convert back to bytes:", string(outgoing))
@@ -129,3 +159,93 @@ func TestRelayConf(t *testing.T) {
 		t.Error("Failed to convert back to bytes:", string(outgoing))
 	}
 }
+
+func TestRelayLock(t *testing.T) {
+	incoming := []byte("LOCK nonce fence")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to create RelayLock")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayLock)
+
+	if !ok {
+		t.Error("Failed to receive RelayLock")
+		return
+	}
+
+	if msg.Nonce != "nonce" {
+		t.Error("Failed to parse nonce")
+	}
+
+	if msg.Fence != "fence" {
+		t.Error("Failed to parse fence")
+	}
+
+	outgoing := genmsg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestRelayNo(t *testing.T) {
+	incoming := []byte("NO nonce")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to create RelayNo")
+		return
+	}
+
+	msg, ok := genmsg.(*RelayNo)
+
+	if !ok {
+		t.Error("Failed to receive RelayNo")
+		return
+	}
+
+	if msg.Nonce != "nonce" {
+		t.Error("Failed to parse nonce")
+	}
+
+	outgoing := genmsg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
+
+func TestRelaySnapEnd(t *testing.T) {
+	incoming := []byte("SNAPEND nonce 12 42")
+	_, genmsg, err := LoadMessage("relay", incoming)
+
+	if err != nil {
+		t.Error("Failed to create RelaySnapEnd")
+		return
+	}
+
+	msg, ok := genmsg.(*RelaySnapEnd)
+
+	if !ok {
+		t.Error("Failed to receive RelaySnapEnd")
+		return
+	}
+
+	if msg.Nonce != "nonce" {
+		t.Error("Failed to parse nonce")
+	}
+
+	if msg.Count != 12 {
+		t.Error("Failed to parse count")
+	}
+
+	if msg.Fence != 42 {
+		t.Error("Failed to parse fence")
+	}
+
+	outgoing := genmsg.ToBytes()
+	if !bytes.Equal(outgoing, incoming) {
+		t.Error("Failed to convert back to bytes:", string(outgoing))
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+)
+
+// With cluster_key set servers have to prove they know it before they're let
+// into the cluster. Both ends of a relay connection send a random challenge,
+// and the other signs it with HMAC-SHA256 along with its ID and the step of
+// the handshake, so a proof can't be replayed on another connection or
+// reflected back to the server that asked for it:
+//
+//   HELLO <id> <version> <nonce> <challenge1>
+//   HOWDY <nonce> <id> <version> <challenge2> <proof of challenge1 and challenge2>
+//   AUTH <proof of challenge1 and challenge2> <nonce>
+//   ACK <nonce> 0
+
+const CHALLENGE_BYTES = 16
+
+func NewChallenge() string {
+	data := make([]byte, CHALLENGE_BYTES)
+
+	if _, err := rand.Read(data); err != nil {
+		log.Fatalln(err)
+	}
+
+	return hex.EncodeToString(data)
+}
+
+// Sign the challenges for step of the handshake, as server id
+func RelayProof(key string, step string, id string, challenges ...string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(step + " " + id + " " + strings.Join(challenges, " ")))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func ValidRelayProof(key string, proof string, step string, id string, challenges ...string) bool {
+	expected := RelayProof(key, step, id, challenges...)
+
+	return hmac.Equal([]byte(proof), []byte(expected))
+}
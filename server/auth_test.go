@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKeyedServer(id string, key string) *Server {
+	config := NewConfig()
+	config.Id = id
+	config.ClusterKey = key
+	// They start listening for clients once they're in a cluster
+	config.ClientAddress = "127.0.0.1:0"
+
+	return NewServer(config)
+}
+
+// Two ends of a loopback TCP connection, which unlike net.Pipe has buffers
+// so both servers can talk at once
+func tcpPipe() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+
+	a, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		panic(err)
+	}
+
+	b, err := listener.Accept()
+
+	if err != nil {
+		panic(err)
+	}
+
+	return a, b
+}
+
+// Connect from the first server to the second like relays do, returns
+// whether the second one let it in
+func relayAuthHandshake(dialing *Server, listening *Server) bool {
+	a, b := tcpPipe()
+
+	incoming := NewRelay(listening, b)
+	go incoming.Run()
+
+	outgoing := NewRelay(dialing, a)
+	go outgoing.Run()
+
+	done := make(chan bool, 1)
+	outgoing.DoHello(func(ok bool) {
+		// Like RelayManager.connect
+		if ok {
+			dialing.RelayManager.SetRelay(outgoing)
+		}
+
+		done <- ok
+	})
+
+	select {
+	case ok := <-done:
+		return ok
+	case <-time.After(time.Second * 2):
+		outgoing.Close()
+		return false
+	}
+}
+
+// Read lines until one starts with prefix, "" if the connection closes first
+func readUntil(reader *bufio.Reader, prefix string) string {
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			return ""
+		}
+
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+func hasRelay(s *Server, id string) bool {
+	s.RelayManager.serverMutex.Lock()
+	defer s.RelayManager.serverMutex.Unlock()
+
+	_, ok := s.RelayManager.relayConnections[RELAY_ID_PREFIX + id]
+	return ok
+}
+
+func TestRelayProof(t *testing.T) {
+	proof := RelayProof("secret", "AUTH", "server-1", "a", "b")
+
+	if !ValidRelayProof("secret", proof, "AUTH", "server-1", "a", "b") {
+		t.Error("Valid proof was refused")
+	}
+
+	if ValidRelayProof("other", proof, "AUTH", "server-1", "a", "b") {
+		t.Error("Proof accepted with another key")
+	}
+
+	if ValidRelayProof("secret", proof, "HOWDY", "server-1", "a", "b") {
+		t.Error("Proof accepted for another step of the handshake")
+	}
+
+	if ValidRelayProof("secret", proof, "AUTH", "server-2", "a", "b") {
+		t.Error("Proof accepted for another server")
+	}
+
+	if NewChallenge() == NewChallenge() {
+		t.Error("Challenges should not repeat")
+	}
+}
+
+func TestRelayAuthentication(t *testing.T) {
+	server1 := newKeyedServer("server-1", "secret")
+	server2 := newKeyedServer("server-2", "secret")
+
+	if !relayAuthHandshake(server1, server2) {
+		t.Fatal("Servers with the same key couldn't connect")
+	}
+
+	if !hasRelay(server2, "server-1") {
+		t.Error("Authenticated relay wasn't set")
+	}
+
+	intruder := newKeyedServer("server-3", "guess")
+
+	if relayAuthHandshake(intruder, server2) {
+		t.Error("Relay with the wrong key got in")
+	}
+
+	if relayAuthHandshake(server2, intruder) {
+		t.Error("Connected to a relay with the wrong key")
+	}
+
+	if relayAuthHandshake(newKeyedServer("server-4", ""), server2) {
+		t.Error("Relay without a key got in")
+	}
+
+	if relayAuthHandshake(server2, newKeyedServer("server-5", "")) {
+		t.Error("Connected to a relay without a key")
+	}
+
+	for _, id := range []string{"server-3", "server-4"} {
+		if hasRelay(server2, id) {
+			t.Error("Unauthenticated relay was set:", id)
+		}
+	}
+}
+
+func TestRelayRequestsBeforeHello(t *testing.T) {
+	server := newKeyedServer("server-1", "secret")
+
+	a, b := net.Pipe()
+	defer a.Close()
+
+	relay := NewRelay(server, b)
+	go relay.Run()
+
+	go a.Write([]byte("PROP foo nonce\n"))
+
+	line, _ := bufio.NewReader(a).ReadString('\n')
+
+	if !strings.HasPrefix(line, "ERR") {
+		t.Error("Expected PROP to be refused, got", line)
+	}
+
+	if server.LockManager.WhoHas("foo") != "" {
+		t.Error("Unauthenticated relay got a lock")
+	}
+}
+
+func TestRelayHelloAfterAuthentication(t *testing.T) {
+	server := newKeyedServer("server-1", "secret")
+
+	a, b := net.Pipe()
+	defer a.Close()
+
+	go NewRelay(server, b).Run()
+	reader := bufio.NewReader(a)
+
+	go a.Write([]byte("HELLO server-2 1.0.0 nonce-1 challenge\n"))
+	howdy := strings.Fields(readUntil(reader, "HOWDY"))
+
+	if len(howdy) != 6 {
+		t.Fatal("Unexpected HOWDY", howdy)
+	}
+
+	proof := RelayProof("secret", "AUTH", "server-2", "challenge", howdy[4])
+	go a.Write([]byte("AUTH " + proof + " nonce-2\n"))
+
+	if readUntil(reader, "ACK nonce-2") != "ACK nonce-2 0\n" {
+		t.Fatal("Wasn't let in")
+	}
+
+	// Trying to start over
+	go a.Write([]byte("HELLO server-2 1.0.0 nonce-3 challenge\n"))
+
+	if readUntil(reader, "ERR") == "" {
+		t.Error("HELLO was accepted again")
+	}
+}
+
+func TestRelayHandshakeDeadline(t *testing.T) {
+	server := newKeyedServer("server-1", "secret")
+	server.Config.RelayTimeout = Duration{time.Millisecond * 50}
+
+	a, b := net.Pipe()
+	defer a.Close()
+
+	go NewRelay(server, b).Run()
+
+	a.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := a.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Connection that never said HELLO wasn't closed, got", err)
+	}
+}
+
+func TestRelayUnexpectedHowdy(t *testing.T) {
+	server := newKeyedServer("server-1", "secret")
+
+	a, b := net.Pipe()
+	defer b.Close()
+
+	relay := NewRelay(server, a)
+	go relay.Run()
+
+	done := make(chan bool, 1)
+	go relay.DoHello(func(ok bool) {
+		done <- ok
+	})
+
+	hello := strings.Fields(readUntil(bufio.NewReader(b), "HELLO"))
+
+	if len(hello) != 5 {
+		t.Fatal("Unexpected HELLO", hello)
+	}
+
+	// Answered with something else than HOWDY
+	go b.Write([]byte("ACK " + hello[3] + " 0\n"))
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Relay was let in without HOWDY")
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("Handshake never finished")
+	}
+}
@@ -14,8 +14,23 @@ type Client struct {
 	Connection net.Conn
 	alive      bool
 	outgoing   chan *OutMsg
+	// Closed once the client is closed, so nothing waits on the connection
+	done       chan bool
+	// Guards alive and the held locks
 	closeMutex *sync.Mutex
 	heldLocks  map[string]bool
+	// The ones of heldLocks that are held as readers of shared locks, or as
+	// permits of semaphores with their permit counts
+	sharedLocks map[string]int
+	// Requests are handled concurrently, a slot is taken from inFlight for
+	// each one being handled. Requests that can wait for their locks take
+	// theirs from waiting instead, so they can't hold up the others.
+	inFlight   chan bool
+	waiting    chan bool
+	// Requests for the same lock are handled in the order they came in, the
+	// channel of a lock is closed when the latest request for it is done
+	ordering   map[string]chan bool
+	orderMutex *sync.Mutex
 }
 
 type OutMsg struct {
@@ -24,10 +39,52 @@ type OutMsg struct {
 }
 
 func (c *Client) addLock(name string) {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+
+	if !c.alive {
+		// Disconnected while waiting for it
+		c.Server.DoRelease(c.ClientId, name, "")
+		return
+	}
+
 	c.heldLocks[name] = true
 }
 
+func (c *Client) addSharedLock(name string, permits int) {
+	c.addLock(name)
+
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+
+	if c.heldLocks[name] {
+		c.sharedLocks[name] = permits
+	}
+}
+
+func (c *Client) holds(name string) bool {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+
+	return c.heldLocks[name]
+}
+
+// Switching between exclusive, shared and semaphores would need the lock
+// released first
+func (c *Client) holdsInOtherMode(name string, mode messages.LockMode) bool {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+
+	permits, shared := c.sharedLocks[name]
+	return c.heldLocks[name] && (shared != mode.Shared || permits != mode.Permits)
+}
+
 func (c *Client) removeLock(name string) {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+
+	delete(c.sharedLocks, name)
+
 	heldLocks := map[string]bool{}
 
 	for n := range c.heldLocks {
@@ -35,7 +92,7 @@ func (c *Client) removeLock(name string) {
 			continue
 		}
 
-		heldLocks[name] = true
+		heldLocks[n] = true
 	}
 
 	c.heldLocks = heldLocks
@@ -54,12 +111,13 @@ func (c *Client) Close() {
 	if c.alive {
 		c.alive = false
 		c.Connection.Close()
-		close(c.outgoing)
+		close(c.done)
 
 		for lock := range c.heldLocks {
-			c.Server.LockManager.Release(c.ClientId, lock)
+			c.Server.DoRelease(c.ClientId, lock, "")
 		}
 		c.heldLocks = map[string]bool{}
+		c.sharedLocks = map[string]int{}
 	}
 }
 
@@ -69,16 +127,31 @@ func (c *Client) Error(message string) {
 	c.Close()
 }
 
+// Refuse a single request without disconnecting
+func (c *Client) Fail(nonce string, reason string) {
+	out := messages.NewClientOutgoingFail(nonce, reason)
+	c.Outgoing(out.ToBytes())
+}
+
 func (c *Client) Outgoing(data []byte) {
 	log.Printf("%s -> %s", c.ClientId, string(data))
 
 	om := OutMsg{
 		data,
-		make(chan bool),
+		make(chan bool, 1),
+	}
+
+	// Requests still being handled may finish after the client is gone
+	select {
+	case c.outgoing <- &om:
+	case <-c.done:
+		return
 	}
 
-	c.outgoing <- &om
-	<-om.Done
+	select {
+	case <-om.Done:
+	case <-c.done:
+	}
 }
 
 func (c *Client) HandleHello(msg *messages.ClientIncomingHello) {
@@ -86,36 +159,356 @@ func (c *Client) HandleHello(msg *messages.ClientIncomingHello) {
 
 	// TODO: Check client version is supported
 
-	out := messages.NewClientOutgoingHello(msg.Nonce, c.Server.Id, c.Server.Version)
+	if msg.Session != "" && msg.Session != c.ClientId {
+		// Sessions are only ever given out by the servers, and relays hold
+		// their locks with ids of their own
+		if isRelayId(msg.Session) || !isUUID(msg.Session) {
+			c.Error("Invalid session")
+			return
+		}
+
+		c.closeMutex.Lock()
+		holding := len(c.heldLocks) > 0
+		c.closeMutex.Unlock()
+
+		if holding {
+			c.Error("Can't change session while holding locks")
+			return
+		}
+
+		log.Printf("%s continuing session %s", c.ClientId, msg.Session)
+		c.ClientId = msg.Session
+	}
+
+	out := messages.NewClientOutgoingHello(msg.Nonce, c.Server.Id, c.Server.Version, c.ClientId)
 	c.Outgoing(out.ToBytes())
 }
 
 func (c *Client) HandleOn(msg *messages.ClientIncomingOn) {
 	log.Printf("%s requesting lock %s", c.ClientId, msg.Lock)
 
-	lock := c.Server.DoLock(c.ClientId, msg.Lock, msg.Timeout)
+	if c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	if c.holdsInOtherMode(msg.Lock, messages.LockMode{}) {
+		c.Fail(msg.Nonce, "mode")
+		return
+	}
+
+	lock := c.Server.DoLock(c.ClientId, msg.Lock, msg.Timeout, true, msg.Wait, messages.LockMode{})
+
+	if lock == nil && c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	if lock == nil {
+		// Waited as long as the client wanted to
+		out := messages.NewClientOutgoingNo(msg.Nonce)
+		c.Outgoing(out.ToBytes())
+		return
+	}
+
 	out := messages.NewClientOutgoingGive(msg.Nonce, lock.Fence)
 	c.Outgoing(out.ToBytes())
 
 	c.addLock(msg.Lock)
 }
 
+func (c *Client) HandleTry(msg *messages.ClientIncomingTry) {
+	log.Printf("%s trying to get lock %s", c.ClientId, msg.Lock)
+
+	if c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	if c.holdsInOtherMode(msg.Lock, messages.LockMode{}) {
+		c.Fail(msg.Nonce, "mode")
+		return
+	}
+
+	lock := c.Server.DoLock(c.ClientId, msg.Lock, msg.Timeout, false, 0, messages.LockMode{})
+
+	if lock == nil {
+		out := messages.NewClientOutgoingNo(msg.Nonce)
+		c.Outgoing(out.ToBytes())
+		return
+	}
+
+	out := messages.NewClientOutgoingGive(msg.Nonce, lock.Fence)
+	c.Outgoing(out.ToBytes())
+
+	c.addLock(msg.Lock)
+}
+
+func (c *Client) HandleSharedOn(msg *messages.ClientIncomingSharedOn) {
+	log.Printf("%s requesting shared lock %s", c.ClientId, msg.Lock)
+
+	if c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	if c.holdsInOtherMode(msg.Lock, messages.LockMode{Shared: true}) {
+		c.Fail(msg.Nonce, "mode")
+		return
+	}
+
+	lock := c.Server.DoLock(c.ClientId, msg.Lock, msg.Timeout, true, 0, messages.LockMode{Shared: true})
+
+	if lock == nil {
+		// Waiting only stops if we started draining
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	out := messages.NewClientOutgoingGive(msg.Nonce, lock.Fence)
+	c.Outgoing(out.ToBytes())
+
+	c.addSharedLock(msg.Lock, 0)
+}
+
+func (c *Client) HandleSharedTry(msg *messages.ClientIncomingSharedTry) {
+	log.Printf("%s trying to get shared lock %s", c.ClientId, msg.Lock)
+
+	if c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	if c.holdsInOtherMode(msg.Lock, messages.LockMode{Shared: true}) {
+		c.Fail(msg.Nonce, "mode")
+		return
+	}
+
+	lock := c.Server.DoLock(c.ClientId, msg.Lock, msg.Timeout, false, 0, messages.LockMode{Shared: true})
+
+	if lock == nil {
+		out := messages.NewClientOutgoingNo(msg.Nonce)
+		c.Outgoing(out.ToBytes())
+		return
+	}
+
+	out := messages.NewClientOutgoingGive(msg.Nonce, lock.Fence)
+	c.Outgoing(out.ToBytes())
+
+	c.addSharedLock(msg.Lock, 0)
+}
+
+func (c *Client) HandlePermitOn(msg *messages.ClientIncomingPermitOn) {
+	log.Printf("%s requesting permit of semaphore %s", c.ClientId, msg.Lock)
+
+	if c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	permits := c.Server.Permits(msg.Lock, msg.Permits)
+
+	if permits == 0 {
+		c.Fail(msg.Nonce, "permits")
+		return
+	}
+
+	mode := messages.LockMode{Shared: true, Permits: permits}
+
+	if c.holdsInOtherMode(msg.Lock, mode) {
+		c.Fail(msg.Nonce, "mode")
+		return
+	}
+
+	lock := c.Server.DoLock(c.ClientId, msg.Lock, msg.Timeout, true, 0, mode)
+
+	if lock == nil {
+		// Waiting only stops if we started draining
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	out := messages.NewClientOutgoingGive(msg.Nonce, lock.Fence)
+	c.Outgoing(out.ToBytes())
+
+	c.addSharedLock(msg.Lock, permits)
+}
+
+func (c *Client) HandlePermitTry(msg *messages.ClientIncomingPermitTry) {
+	log.Printf("%s trying to get permit of semaphore %s", c.ClientId, msg.Lock)
+
+	if c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	permits := c.Server.Permits(msg.Lock, msg.Permits)
+
+	if permits == 0 {
+		c.Fail(msg.Nonce, "permits")
+		return
+	}
+
+	mode := messages.LockMode{Shared: true, Permits: permits}
+
+	if c.holdsInOtherMode(msg.Lock, mode) {
+		c.Fail(msg.Nonce, "mode")
+		return
+	}
+
+	lock := c.Server.DoLock(c.ClientId, msg.Lock, msg.Timeout, false, 0, mode)
+
+	if lock == nil {
+		out := messages.NewClientOutgoingNo(msg.Nonce)
+		c.Outgoing(out.ToBytes())
+		return
+	}
+
+	out := messages.NewClientOutgoingGive(msg.Nonce, lock.Fence)
+	c.Outgoing(out.ToBytes())
+
+	c.addSharedLock(msg.Lock, permits)
+}
+
+func (c *Client) HandleMultiOn(msg *messages.ClientIncomingMultiOn) {
+	log.Printf("%s requesting locks %v", c.ClientId, msg.Locks)
+
+	if c.Server.IsDraining() {
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	for _, name := range msg.Locks {
+		if c.holdsInOtherMode(name, messages.LockMode{}) {
+			c.Fail(msg.Nonce, "mode")
+			return
+		}
+	}
+
+	locks := c.Server.DoLocks(c.ClientId, msg.Locks, msg.Timeout)
+
+	if locks == nil {
+		// Waiting only stops if we started draining
+		c.Fail(msg.Nonce, "draining")
+		return
+	}
+
+	fences := []string{}
+	for _, lock := range locks {
+		fences = append(fences, lock.Fence)
+	}
+
+	out := messages.NewClientOutgoingMultiGive(msg.Nonce, fences)
+	c.Outgoing(out.ToBytes())
+
+	for _, name := range msg.Locks {
+		c.addLock(name)
+	}
+}
+
+func (c *Client) HandleRefresh(msg *messages.ClientIncomingRefresh) {
+	log.Printf("%s refreshing lock %s", c.ClientId, msg.Lock)
+
+	// Would let the lock expire right away, here and on the other servers
+	if msg.Timeout <= 0 {
+		c.Fail(msg.Nonce, "timeout")
+		return
+	}
+
+	lock := c.Server.DoRefresh(c.ClientId, msg.Lock, msg.Fence, msg.Timeout)
+
+	if lock == nil {
+		out := messages.NewClientOutgoingNo(msg.Nonce)
+		c.Outgoing(out.ToBytes())
+		return
+	}
+
+	out := messages.NewClientOutgoingGive(msg.Nonce, lock.Fence)
+	c.Outgoing(out.ToBytes())
+
+	// Might've been taken through another server
+	if lock.Shared {
+		c.addSharedLock(msg.Lock, lock.Permits)
+	} else {
+		c.addLock(msg.Lock)
+	}
+}
+
+func (c *Client) HandleIs(msg *messages.ClientIncomingIs) {
+	fence := c.Server.DoIs(msg.Lock, msg.Cluster)
+
+	if fence == "" {
+		out := messages.NewClientOutgoingNo(msg.Nonce)
+		c.Outgoing(out.ToBytes())
+		return
+	}
+
+	out := messages.NewClientOutgoingLock(msg.Nonce, fence)
+	c.Outgoing(out.ToBytes())
+}
+
+func (c *Client) HandleStats(msg *messages.ClientIncomingStats) {
+	for _, stat := range c.Server.GetStats() {
+		out := messages.NewClientOutgoingStats(msg.Nonce, stat.Name, stat.Value)
+		c.Outgoing(out.ToBytes())
+	}
+
+	out := messages.NewClientOutgoingStatsEnd(msg.Nonce)
+	c.Outgoing(out.ToBytes())
+}
+
+// Where the client is in line for a lock it's waiting for with ON, e.g.
+// through another connection of the same session
+func (c *Client) HandlePosition(msg *messages.ClientIncomingPosition) {
+	var out messages.Message
+	position := c.Server.LockManager.Position(c.ClientId, msg.Lock)
+
+	if position == 0 {
+		out = messages.NewClientOutgoingNo(msg.Nonce)
+	} else {
+		out = messages.NewClientOutgoingQueued(msg.Nonce, position)
+	}
+
+	c.Outgoing(out.ToBytes())
+}
+
 func (c *Client) HandleOff(msg *messages.ClientIncomingOff) {
 	log.Printf("%s releasing lock %s", c.ClientId, msg.Lock)
 
-	c.Server.LockManager.Release(c.ClientId, msg.Lock)
+	if msg.Fence != "" && !c.holds(msg.Lock) {
+		// Taken through another server, have it held through us first so
+		// we're allowed to release it
+		timeout := c.Server.Config.PrepareTimeout.Duration
+		c.Server.DoRefresh(c.ClientId, msg.Lock, msg.Fence, timeout)
+	}
+
+	released := c.Server.DoRelease(c.ClientId, msg.Lock, msg.Fence)
 
 	c.removeLock(msg.Lock)
+
+	if !released {
+		out := messages.NewClientOutgoingNo(msg.Nonce)
+		c.Outgoing(out.ToBytes())
+		return
+	}
+
+	out := messages.NewClientOutgoingConf(msg.Nonce)
+	c.Outgoing(out.ToBytes())
 }
 
 func (c *Client) HandleOutgoing() {
-	// Read until channel is closed
-	for outgoing := range c.outgoing {
-		c.Connection.Write(outgoing.Data)
-		c.Connection.Write([]byte("\n"))
-		outgoing.Done <- true
+	// Write until the client is closed
+	for {
+		select {
+		case outgoing := <-c.outgoing:
+			c.Connection.Write(outgoing.Data)
+			c.Connection.Write([]byte("\n"))
+			outgoing.Done <- true
+		case <-c.done:
+			log.Printf("%s outgoing queue closed", c.ClientId)
+			return
+		}
 	}
-	log.Printf("%s outgoing queue closed", c.ClientId)
 }
 
 func (c *Client) Incoming(src []byte) {
@@ -126,13 +519,156 @@ func (c *Client) Incoming(src []byte) {
 		return
 	}
 
-	switch msg := msg.(type) {
-	case *messages.ClientIncomingHello:
+	if msg, ok := msg.(*messages.ClientIncomingHello); ok {
+		// Might change the session, which the requests being handled were
+		// made with. Only this reads the connection, so nothing gets in
+		// after checking.
+		if len(c.inFlight) > 0 || len(c.waiting) > 0 {
+			c.Fail(msg.Nonce, "late")
+			return
+		}
+
 		c.HandleHello(msg)
+		return
+	}
+
+	slots := c.inFlight
+
+	if nonce, ok := waits(msg); ok {
+		// Waiting for a lock can take forever, not reading the OFF of a lock
+		// held already in the meanwhile would be no good
+		slots = c.waiting
+
+		select {
+		case slots <- true:
+		default:
+			c.Fail(nonce, "busy")
+			return
+		}
+	} else {
+		// Stop reading more requests while too many are being handled
+		slots <- true
+	}
+
+	earlier, done := c.lineUp(orderedLocks(msg))
+
+	go func() {
+		defer func() {
+			done()
+			<-slots
+		}()
+
+		for _, wait := range earlier {
+			<-wait
+		}
+
+		c.handle(msg)
+	}()
+}
+
+// The locks a request changes, which the requests for them before it need
+// to be done with first
+func orderedLocks(msg messages.Message) []string {
+	switch msg := msg.(type) {
+	case *messages.ClientIncomingOn:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingOff:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingTry:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingSharedOn:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingSharedTry:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingPermitOn:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingPermitTry:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingRefresh:
+		return []string{msg.Lock}
+	case *messages.ClientIncomingMultiOn:
+		return msg.Locks
+	}
+
+	// Just looking
+	return nil
+}
+
+// The nonce of a request that can wait for its locks for as long as it
+// likes
+func waits(msg messages.Message) (string, bool) {
+	switch msg := msg.(type) {
+	case *messages.ClientIncomingOn:
+		return msg.Nonce, true
+	case *messages.ClientIncomingSharedOn:
+		return msg.Nonce, true
+	case *messages.ClientIncomingPermitOn:
+		return msg.Nonce, true
+	case *messages.ClientIncomingMultiOn:
+		return msg.Nonce, true
+	}
+
+	return "", false
+}
+
+// Get in line behind the earlier requests for locks names, returns what to
+// wait for before handling the request and what to call once it's done
+func (c *Client) lineUp(names []string) (earlier []chan bool, done func()) {
+	c.orderMutex.Lock()
+	defer c.orderMutex.Unlock()
+
+	finished := make(chan bool)
+
+	for _, name := range names {
+		if wait, ok := c.ordering[name]; ok {
+			earlier = append(earlier, wait)
+		}
+
+		c.ordering[name] = finished
+	}
+
+	done = func() {
+		c.orderMutex.Lock()
+		defer c.orderMutex.Unlock()
+
+		close(finished)
+
+		for _, name := range names {
+			if c.ordering[name] == finished {
+				delete(c.ordering, name)
+			}
+		}
+	}
+
+	return
+}
+
+func (c *Client) handle(msg messages.Message) {
+	switch msg := msg.(type) {
 	case *messages.ClientIncomingOn:
 		c.HandleOn(msg)
 	case *messages.ClientIncomingOff:
 		c.HandleOff(msg)
+	case *messages.ClientIncomingTry:
+		c.HandleTry(msg)
+	case *messages.ClientIncomingSharedOn:
+		c.HandleSharedOn(msg)
+	case *messages.ClientIncomingSharedTry:
+		c.HandleSharedTry(msg)
+	case *messages.ClientIncomingMultiOn:
+		c.HandleMultiOn(msg)
+	case *messages.ClientIncomingPermitOn:
+		c.HandlePermitOn(msg)
+	case *messages.ClientIncomingPermitTry:
+		c.HandlePermitTry(msg)
+	case *messages.ClientIncomingRefresh:
+		c.HandleRefresh(msg)
+	case *messages.ClientIncomingIs:
+		c.HandleIs(msg)
+	case *messages.ClientIncomingStats:
+		c.HandleStats(msg)
+	case *messages.ClientIncomingPosition:
+		c.HandlePosition(msg)
 	default:
 		c.Error("Invalid keyword")
 		c.Close()
@@ -140,19 +676,22 @@ func (c *Client) Incoming(src []byte) {
 }
 
 func (c *Client) Run() {
-	log.Printf("%s new connection", c.ClientId)
+	log.Printf("%s new connection from %s", c.ClientId, c.Connection.RemoteAddr())
 
 	go c.HandleOutgoing()
 
+	c.inFlight = make(chan bool, c.Server.Config.MaxInFlight)
+	c.waiting = make(chan bool, c.Server.Config.MaxInFlight)
+
 	scanner := bufio.NewScanner(c.Connection)
 	for scanner.Scan() {
-		// If this data is ever used for longer than a single iteration it
-		// must be copied.
-		line := scanner.Bytes()
+		// Copied, the request may be handled after the next one is read
+		line := append([]byte{}, scanner.Bytes()...)
 		c.Incoming(line)
 	}
 
-	// Nothing more to read from the connection, so I guess it was closed
+	// Nothing more to read from the connection, so I guess it was closed.
+	// Whatever the requests still being handled get is let go of.
 	c.Close()
 
 	log.Printf("%s connection closed", c.ClientId)
@@ -164,14 +703,16 @@ func NewClient(server *Server, connection net.Conn) *Client {
 	c.Connection = connection
 	c.alive = true
 	c.outgoing = make(chan *OutMsg)
+	c.done = make(chan bool)
 	c.closeMutex = &sync.Mutex{}
 	c.heldLocks = map[string]bool{}
+	c.sharedLocks = map[string]int{}
+	c.ordering = map[string]chan bool{}
+	c.orderMutex = &sync.Mutex{}
 
-	if connection != nil {
-		c.ClientId = connection.RemoteAddr().String()
-	} else {
-		c.ClientId = NewUUID()
-	}
+	// Locks are held by the session, so the client can pick them up again
+	// through another connection
+	c.ClientId = NewUUID()
 
 	return &c
 }
\ No newline at end of file
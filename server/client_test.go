@@ -1,6 +1,10 @@
 package server
 
 import (
+	"bufio"
+	"github.com/lietu/godistlockd/messages"
+	"net"
+	"strings"
 	"testing"
 )
 
@@ -12,4 +16,153 @@ func TestHeldLockCleanup(t *testing.T) {
 	if len(c.GetHeldLocks()) != 0 {
 		t.Error("Held locks left lingering")
 	}
-}
\ No newline at end of file
+}
+
+func TestHeldLockRemoveKeepsOthers(t *testing.T) {
+	c := NewClient(nil, nil)
+	c.addLock("foo")
+	c.addLock("bar")
+	c.removeLock("foo")
+
+	held := c.GetHeldLocks()
+	if len(held) != 1 || !held["bar"] {
+		t.Error("Removing a lock dropped other held locks")
+	}
+}
+
+func TestRequestOrdering(t *testing.T) {
+	c := NewClient(nil, nil)
+
+	first, firstDone := c.lineUp([]string{"foo"})
+	second, secondDone := c.lineUp(orderedLocks(&messages.ClientIncomingOff{Lock: "foo"}))
+	other, otherDone := c.lineUp(orderedLocks(&messages.ClientIncomingOn{Lock: "bar"}))
+	look, _ := c.lineUp(orderedLocks(&messages.ClientIncomingIs{Lock: "foo"}))
+
+	if len(first) != 0 || len(other) != 0 || len(look) != 0 {
+		t.Error("Request waiting for no reason")
+	}
+
+	if len(second) != 1 {
+		t.Fatal("Request not waiting for the one before it")
+	}
+
+	select {
+	case <-second[0]:
+		t.Error("Request let through before the one before it was done")
+	default:
+	}
+
+	firstDone()
+
+	select {
+	case <-second[0]:
+	default:
+		t.Error("Request not let through after the one before it was done")
+	}
+
+	multi, _ := c.lineUp(orderedLocks(&messages.ClientIncomingMultiOn{Locks: []string{"foo", "bar"}}))
+
+	if len(multi) != 2 {
+		t.Error("Multiple locks request not waiting for all of its locks")
+	}
+
+	secondDone()
+	otherDone()
+
+	if len(c.ordering) != 2 {
+		t.Error("Unexpected requests left in line")
+	}
+}
+
+func TestOutgoingAfterClose(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	c := NewClient(nil, conn)
+	go c.HandleOutgoing()
+	c.Close()
+
+	// Requests still being handled finishing up
+	out := messages.NewClientOutgoingNo("nonce")
+	c.Outgoing(out.ToBytes())
+}
+
+func TestWaitingRequestsFull(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	c := NewClient(nil, conn)
+	c.inFlight = make(chan bool, 1)
+	c.waiting = make(chan bool, 1)
+	c.waiting <- true
+	go c.HandleOutgoing()
+	defer c.Close()
+
+	// Has to be answered without taking a slot, or waiting for one
+	go c.Incoming([]byte("ON foo 10000 nonce"))
+
+	reply, err := bufio.NewReader(other).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply != "FAIL nonce busy\n" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+
+	if len(c.inFlight) != 0 {
+		t.Error("Waiting request took a slot of the others")
+	}
+}
+
+func TestHelloSession(t *testing.T) {
+	server := newKeyedServer("server-1", "")
+	session := NewUUID()
+
+	for _, invalid := range []string{"session", RELAY_ID_PREFIX + "server-2", RELAY_ID_PREFIX + session} {
+		conn, other := net.Pipe()
+
+		c := NewClient(server, conn)
+		go c.HandleOutgoing()
+
+		go c.Incoming([]byte("HELLO 1.0.0 nonce " + invalid))
+
+		reply, _ := bufio.NewReader(other).ReadString('\n')
+		if !strings.HasPrefix(reply, "ERR") {
+			t.Errorf("Session %s was accepted", invalid)
+		}
+
+		other.Close()
+	}
+
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	c := NewClient(server, conn)
+	go c.HandleOutgoing()
+	defer c.Close()
+
+	go c.Incoming([]byte("HELLO 1.0.0 nonce " + session))
+
+	reply, _ := bufio.NewReader(other).ReadString('\n')
+	if reply != "HELLO nonce server-1 " + server.Version + " " + session + "\n" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestRefreshWithoutTimeout(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	// Refused before the server is asked about the lock
+	c := NewClient(nil, conn)
+	go c.HandleOutgoing()
+	defer c.Close()
+
+	go c.HandleRefresh(&messages.ClientIncomingRefresh{Lock: "foo", Fence: "1", Timeout: 0, Nonce: "nonce"})
+
+	reply, _ := bufio.NewReader(other).ReadString('\n')
+	if reply != "FAIL nonce timeout\n" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
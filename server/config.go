@@ -0,0 +1,245 @@
+package server
+
+import (
+	"github.com/BurntSushi/toml"
+	"os"
+	"net"
+	"strings"
+	"time"
+	"strconv"
+	"fmt"
+)
+
+const ENV_PREFIX = "GODISTLOCKD_"
+
+// Durations are written like "1s" or "250ms" in the config file and
+// environment variables
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+type Config struct {
+	// The ID other servers and clients know this server by, e.g. FQDN
+	Id string `toml:"id"`
+	// Version reported in HELLO and HOWDY
+	Version string `toml:"version"`
+	// Address to listen on for client connections, e.g. ":10000"
+	ClientAddress string `toml:"client_address"`
+	// Address to listen on for relay connections, e.g. ":20000"
+	RelayAddress string `toml:"relay_address"`
+	// Relay addresses of all the servers in the cluster, may include this one
+	Peers []string `toml:"peers"`
+	// How long to wait for other servers to respond
+	RelayTimeout Duration `toml:"relay_timeout"`
+	// How long the preliminary locks are held while agreeing on a lock
+	PrepareTimeout Duration `toml:"prepare_timeout"`
+	// How long to wait for clients to release their locks when shutting down
+	DrainTimeout Duration `toml:"drain_timeout"`
+	// Where to keep state that has to survive restarts, nothing is kept if empty
+	DataDir string `toml:"data_dir"`
+	// When to fsync the lock log: "always", "interval" or "never"
+	WalSync string `toml:"wal_sync"`
+	// How often to compact the lock log into a snapshot
+	SnapshotInterval Duration `toml:"snapshot_interval"`
+	// Permit counts of semaphores, so clients don't have to give them
+	Semaphores map[string]int `toml:"semaphores"`
+	// How many requests of a client connection are handled at once
+	MaxInFlight int `toml:"max_in_flight"`
+	// Certificate and key to speak TLS with on both ports, plain TCP if empty
+	TLSCert string `toml:"tls_cert"`
+	TLSKey string `toml:"tls_key"`
+	// CA the certificates of other servers, and clients if asked to, are
+	// checked against
+	TLSCA string `toml:"tls_ca"`
+	// Require clients to show a certificate signed by the CA as well
+	TLSClientAuth bool `toml:"tls_client_auth"`
+	// Secret shared by the servers of the cluster, other servers have to
+	// prove they know it before they're let in
+	ClusterKey string `toml:"cluster_key"`
+	// Enable testing stuff
+	Testing bool `toml:"testing"`
+}
+
+func NewConfig() *Config {
+	c := Config{}
+	c.Version = "1.0.0"
+	c.ClientAddress = ":10000"
+	c.RelayAddress = ":20000"
+	c.Peers = []string{}
+	c.RelayTimeout = Duration{time.Second}
+	c.PrepareTimeout = Duration{time.Second}
+	c.DrainTimeout = Duration{time.Second * 30}
+	c.WalSync = WAL_SYNC_ALWAYS
+	c.SnapshotInterval = Duration{time.Minute}
+	c.Semaphores = map[string]int{}
+	c.MaxInFlight = 64
+	c.TLSClientAuth = false
+	c.Testing = false
+
+	return &c
+}
+
+// Read settings from a TOML file on top of the current ones
+func (c *Config) LoadFile(path string) error {
+	_, err := toml.DecodeFile(path, c)
+	return err
+}
+
+// Read settings from GODISTLOCKD_* environment variables on top of the
+// current ones
+func (c *Config) LoadEnv() error {
+	strs := map[string]*string{
+		"ID":             &c.Id,
+		"VERSION":        &c.Version,
+		"CLIENT_ADDRESS": &c.ClientAddress,
+		"RELAY_ADDRESS":  &c.RelayAddress,
+		"DATA_DIR":       &c.DataDir,
+		"WAL_SYNC":       &c.WalSync,
+		"TLS_CERT":       &c.TLSCert,
+		"TLS_KEY":        &c.TLSKey,
+		"TLS_CA":         &c.TLSCA,
+		"CLUSTER_KEY":    &c.ClusterKey,
+	}
+
+	for name, target := range strs {
+		if value, ok := os.LookupEnv(ENV_PREFIX + name); ok {
+			*target = value
+		}
+	}
+
+	durations := map[string]*Duration{
+		"RELAY_TIMEOUT":     &c.RelayTimeout,
+		"PREPARE_TIMEOUT":   &c.PrepareTimeout,
+		"DRAIN_TIMEOUT":     &c.DrainTimeout,
+		"SNAPSHOT_INTERVAL": &c.SnapshotInterval,
+	}
+
+	for name, target := range durations {
+		if value, ok := os.LookupEnv(ENV_PREFIX + name); ok {
+			if err := target.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("Invalid %s%s: %s", ENV_PREFIX, name, err)
+			}
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_PREFIX + "PEERS"); ok {
+		c.Peers = SplitList(value)
+	}
+
+	if value, ok := os.LookupEnv(ENV_PREFIX + "SEMAPHORES"); ok {
+		semaphores, err := ParseSemaphores(value)
+
+		if err != nil {
+			return fmt.Errorf("Invalid %sSEMAPHORES: %s", ENV_PREFIX, err)
+		}
+
+		c.Semaphores = semaphores
+	}
+
+	if value, ok := os.LookupEnv(ENV_PREFIX + "MAX_IN_FLIGHT"); ok {
+		max, err := strconv.Atoi(value)
+
+		if err != nil {
+			return fmt.Errorf("Invalid %sMAX_IN_FLIGHT: %s", ENV_PREFIX, value)
+		}
+
+		c.MaxInFlight = max
+	}
+
+	if value, ok := os.LookupEnv(ENV_PREFIX + "TLS_CLIENT_AUTH"); ok {
+		clientAuth, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return fmt.Errorf("Invalid %sTLS_CLIENT_AUTH: %s", ENV_PREFIX, err)
+		}
+
+		c.TLSClientAuth = clientAuth
+	}
+
+	if value, ok := os.LookupEnv(ENV_PREFIX + "TESTING"); ok {
+		testing, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return fmt.Errorf("Invalid %sTESTING: %s", ENV_PREFIX, err)
+		}
+
+		c.Testing = testing
+	}
+
+	return nil
+}
+
+// Fill in whatever can be derived from other settings
+func (c *Config) Finalize() {
+	c.ClientAddress = ListenAddress(c.ClientAddress)
+	c.RelayAddress = ListenAddress(c.RelayAddress)
+
+	if c.Id == "" {
+		_, port, _ := net.SplitHostPort(c.RelayAddress)
+		c.Id = fmt.Sprintf("server-on-port-%s", port)
+	}
+}
+
+// Check the settings that can't be used as they are, from wherever they came
+func (c *Config) Validate() error {
+	if c.MaxInFlight < 1 {
+		return fmt.Errorf("Invalid max_in_flight: %d, has to be at least 1", c.MaxInFlight)
+	}
+
+	return nil
+}
+
+// Split a comma separated list, ignoring empty items
+func SplitList(src string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(src, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Parse semaphores given like "vendor-api=5,reports=2"
+func ParseSemaphores(src string) (map[string]int, error) {
+	semaphores := map[string]int{}
+
+	for _, item := range SplitList(src) {
+		parts := strings.SplitN(item, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s is not like <name>=<permits>", item)
+		}
+
+		permits, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+
+		if err != nil || permits < 1 {
+			return nil, fmt.Errorf("Invalid permits for %s", parts[0])
+		}
+
+		semaphores[strings.TrimSpace(parts[0])] = permits
+	}
+
+	return semaphores, nil
+}
+
+// Allow giving just the port number to listen on, like we used to
+func ListenAddress(addr string) string {
+	if _, err := strconv.Atoi(addr); err == nil {
+		return ":" + addr
+	}
+
+	return addr
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"testing"
+	"time"
+	"io/ioutil"
+	"os"
+)
+
+func TestConfigLoadFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "godistlockd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`
+id = "server-1"
+client_address = "127.0.0.1:10001"
+peers = ["a:20000", "b:20000"]
+relay_timeout = "250ms"
+
+[semaphores]
+vendor-api = 5
+`)
+	file.Close()
+
+	config := NewConfig()
+	if err := config.LoadFile(file.Name()); err != nil {
+		t.Error("Failed to load config file:", err)
+		return
+	}
+
+	if config.Id != "server-1" {
+		t.Error("Failed to read id")
+	}
+
+	if config.ClientAddress != "127.0.0.1:10001" {
+		t.Error("Failed to read client address")
+	}
+
+	if config.RelayAddress != ":20000" {
+		t.Error("Lost default relay address")
+	}
+
+	if len(config.Peers) != 2 || config.Peers[1] != "b:20000" {
+		t.Error("Failed to read peers")
+	}
+
+	if config.RelayTimeout.Duration != time.Millisecond * 250 {
+		t.Error("Failed to read relay timeout")
+	}
+
+	if config.Semaphores["vendor-api"] != 5 {
+		t.Error("Failed to read semaphores")
+	}
+}
+
+func TestConfigLoadEnv(t *testing.T) {
+	os.Setenv("GODISTLOCKD_RELAY_ADDRESS", "20005")
+	os.Setenv("GODISTLOCKD_PEERS", "a:20000, b:20000,")
+	os.Setenv("GODISTLOCKD_PREPARE_TIMEOUT", "2s")
+	os.Setenv("GODISTLOCKD_SEMAPHORES", "vendor-api=5, reports=2")
+	os.Setenv("GODISTLOCKD_MAX_IN_FLIGHT", "8")
+	os.Setenv("GODISTLOCKD_TLS_CA", "ca.pem")
+	os.Setenv("GODISTLOCKD_TLS_CLIENT_AUTH", "true")
+	os.Setenv("GODISTLOCKD_CLUSTER_KEY", "secret")
+	defer os.Unsetenv("GODISTLOCKD_RELAY_ADDRESS")
+	defer os.Unsetenv("GODISTLOCKD_PEERS")
+	defer os.Unsetenv("GODISTLOCKD_PREPARE_TIMEOUT")
+	defer os.Unsetenv("GODISTLOCKD_SEMAPHORES")
+	defer os.Unsetenv("GODISTLOCKD_MAX_IN_FLIGHT")
+	defer os.Unsetenv("GODISTLOCKD_TLS_CA")
+	defer os.Unsetenv("GODISTLOCKD_TLS_CLIENT_AUTH")
+	defer os.Unsetenv("GODISTLOCKD_CLUSTER_KEY")
+
+	config := NewConfig()
+	if err := config.LoadEnv(); err != nil {
+		t.Error("Failed to load environment:", err)
+		return
+	}
+	config.Finalize()
+
+	if config.RelayAddress != ":20005" {
+		t.Error("Failed to read relay address:", config.RelayAddress)
+	}
+
+	if config.Id != "server-on-port-20005" {
+		t.Error("Failed to derive id:", config.Id)
+	}
+
+	if len(config.Peers) != 2 || config.Peers[1] != "b:20000" {
+		t.Error("Failed to read peers:", config.Peers)
+	}
+
+	if config.PrepareTimeout.Duration != time.Second * 2 {
+		t.Error("Failed to read prepare timeout")
+	}
+
+	if len(config.Semaphores) != 2 || config.Semaphores["reports"] != 2 {
+		t.Error("Failed to read semaphores:", config.Semaphores)
+	}
+
+	if config.MaxInFlight != 8 {
+		t.Error("Failed to read max in flight")
+	}
+
+	if config.TLSCA != "ca.pem" || !config.TLSClientAuth {
+		t.Error("Failed to read TLS settings")
+	}
+
+	if config.ClusterKey != "secret" {
+		t.Error("Failed to read cluster key")
+	}
+
+	os.Setenv("GODISTLOCKD_PREPARE_TIMEOUT", "soon")
+	if NewConfig().LoadEnv() == nil {
+		t.Error("Accepted invalid duration")
+	}
+	os.Unsetenv("GODISTLOCKD_PREPARE_TIMEOUT")
+
+	os.Setenv("GODISTLOCKD_SEMAPHORES", "vendor-api=0")
+	if NewConfig().LoadEnv() == nil {
+		t.Error("Accepted semaphore without permits")
+	}
+	os.Unsetenv("GODISTLOCKD_SEMAPHORES")
+
+	os.Setenv("GODISTLOCKD_MAX_IN_FLIGHT", "many")
+	if NewConfig().LoadEnv() == nil {
+		t.Error("Accepted invalid max in flight")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := NewConfig().Validate(); err != nil {
+		t.Error("Defaults didn't validate:", err)
+	}
+
+	file, err := ioutil.TempFile("", "godistlockd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("max_in_flight = 0\n")
+	file.Close()
+
+	config := NewConfig()
+	if err := config.LoadFile(file.Name()); err != nil {
+		t.Fatal("Failed to load config file:", err)
+	}
+
+	if config.Validate() == nil {
+		t.Error("Accepted max_in_flight 0 from the config file")
+	}
+
+	config.MaxInFlight = -1
+	if config.Validate() == nil {
+		t.Error("Accepted negative max_in_flight")
+	}
+}
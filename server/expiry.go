@@ -0,0 +1,218 @@
+package server
+
+import (
+	"container/heap"
+	"github.com/aristanetworks/goarista/monotime"
+	"log"
+	"time"
+)
+
+// Instead of polling, each shard of the LockManager keeps a min-heap of when
+// something about its locks next changes on its own: a hold expires, a writer
+// stops holding back new readers, a ticket runs out or a request gives up
+// waiting. The timer for
+// the earliest one is all that can wake the shard up besides requests.
+//
+// Entries are not removed when locks are refreshed or released, they're
+// checked when they come up and rescheduled if the lock still has time left.
+// To keep the heap from growing with every refresh, a lock only gets a new
+// entry if it's due before the one it already has.
+
+type expiryEntry struct {
+	name string
+	at   uint64
+}
+
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].at < h[j].at
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old) - 1]
+	*h = old[:len(old) - 1]
+
+	return entry
+}
+
+// When the lock name next needs to be looked at, false if never
+func (sh *lockShard) nextCheck(name string) (uint64, bool) {
+	var at uint64
+	found := false
+
+	if lock, ok := sh.locks[name]; ok {
+		for _, hold := range lock.holds() {
+			if !found || hold.Expires < at {
+				at = hold.Expires
+				found = true
+			}
+		}
+	}
+
+	if until, ok := sh.writersWaiting[name]; ok && (!found || until < at) {
+		at = until
+		found = true
+	}
+
+	for _, entry := range sh.tickets[name] {
+		if !found || entry.expires < at {
+			at = entry.expires
+			found = true
+		}
+	}
+
+	for _, request := range sh.waiters[name] {
+		if request.Deadline > 0 && (!found || request.Deadline < at) {
+			at = request.Deadline
+			found = true
+		}
+	}
+
+	return at, found
+}
+
+// Make sure the lock name is looked at when it next changes on its own
+func (sh *lockShard) schedule(name string) {
+	at, ok := sh.nextCheck(name)
+
+	if !ok {
+		return
+	}
+
+	if scheduled, ok := sh.scheduled[name]; ok && scheduled <= at {
+		return
+	}
+
+	sh.scheduled[name] = at
+	heap.Push(&sh.expiries, expiryEntry{name, at})
+}
+
+// Forget the holds that have timed out and hand their locks to whoever is
+// waiting for them
+func (sh *lockShard) expireDue() {
+	now := monotime.Now()
+
+	for len(sh.expiries) > 0 && sh.expiries[0].at <= now {
+		entry := heap.Pop(&sh.expiries).(expiryEntry)
+
+		if sh.scheduled[entry.name] != entry.at {
+			// Superseded by an earlier entry that already came up
+			continue
+		}
+
+		delete(sh.scheduled, entry.name)
+
+		sh.expireLock(entry.name, now)
+		sh.expireTickets(entry.name, now)
+		sh.dropLate(entry.name, now)
+		sh.wake(entry.name)
+		sh.schedule(entry.name)
+	}
+}
+
+func (sh *lockShard) expireLock(name string, now uint64) {
+	if until, ok := sh.writersWaiting[name]; ok && until <= now {
+		delete(sh.writersWaiting, name)
+	}
+
+	lock, ok := sh.locks[name]
+
+	if !ok {
+		return
+	}
+
+	if lock.Shared {
+		sh.expireReaders(name, lock, now)
+	} else if lock.Expires <= now {
+		if DEBUG {
+			log.Printf("Lock %s expired.", name)
+		}
+		delete(sh.locks, name)
+		sh.expired += 1
+	}
+}
+
+// Give up on the requests waiting for lock name that have waited as long as
+// they wanted to
+func (sh *lockShard) dropLate(name string, now uint64) {
+	for _, request := range sh.waiters[name] {
+		if request.Deadline == 0 || request.Deadline > now {
+			continue
+		}
+
+		if DEBUG {
+			log.Printf("%s gave up waiting for lock %s.", request.ClientId, name)
+		}
+
+		for _, other := range requestNames(request) {
+			sh.removeWaiter(other, request)
+		}
+		sh.queued -= 1
+
+		if request.Holds != nil {
+			request.Holds <- nil
+		} else {
+			request.Done <- nil
+		}
+	}
+}
+
+// Set the timer to go off when the earliest entry is due, returns what to
+// wait for it on. With nothing scheduled the timer is stopped and nil is
+// returned, so an idle shard doesn't wake up at all.
+func (sh *lockShard) resetTimer(timer *time.Timer) <-chan time.Time {
+	if len(sh.expiries) == 0 {
+		sh.stopTimer(timer)
+		return nil
+	}
+
+	at := sh.expiries[0].at
+
+	if at == sh.timerAt {
+		// Already set for it
+		return timer.C
+	}
+
+	sh.stopTimer(timer)
+
+	now := monotime.Now()
+	wait := time.Duration(0)
+
+	if at > now {
+		wait = time.Duration(at - now)
+	}
+
+	sh.timerAt = at
+	timer.Reset(wait)
+
+	return timer.C
+}
+
+func (sh *lockShard) stopTimer(timer *time.Timer) {
+	if sh.timerAt == 0 {
+		return
+	}
+
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	sh.timerAt = 0
+}
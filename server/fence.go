@@ -0,0 +1,147 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How many fences to reserve with each write to the fence file
+const FENCE_BLOCK = 10000
+
+// Hands out fences and keeps track of the highest one seen in the cluster.
+// Fences are reserved in blocks that are saved to the fence file before any
+// of them are used, so they keep increasing across restarts.
+//
+// Shared by all the shards of the LockManager, so it's safe for concurrent
+// use.
+type FenceCounter struct {
+	mutex    sync.Mutex
+	last     uint64
+	reserved uint64
+	path     string
+}
+
+// A counter that only lives in memory, after a restart the other servers
+// are the only ones who remember which fences were used
+func NewFenceCounter() *FenceCounter {
+	return &FenceCounter{}
+}
+
+// A counter that continues after the fences reserved in the file at path
+func LoadFenceCounter(path string) (*FenceCounter, error) {
+	fc := FenceCounter{}
+	fc.path = path
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		fc.reserved, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Whatever was used from the last block is lost, skip past all of it
+		fc.last = fc.reserved
+	}
+
+	return &fc, nil
+}
+
+// Get a fence higher than any we've given out or seen so far, including
+// seen that was just reported by the other servers
+func (fc *FenceCounter) Next(seen uint64) uint64 {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.observe(seen)
+	fc.last += 1
+	fc.reserve(fc.last)
+
+	return fc.last
+}
+
+// Remember a fence given out by somebody else, so we never go below it
+func (fc *FenceCounter) Observe(fence uint64) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.observe(fence)
+}
+
+func (fc *FenceCounter) observe(fence uint64) {
+	if fence > fc.last {
+		fc.last = fence
+		fc.reserve(fence)
+	}
+}
+
+// The highest fence seen so far
+func (fc *FenceCounter) Last() uint64 {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	return fc.last
+}
+
+func (fc *FenceCounter) reserve(fence uint64) {
+	if fc.path == "" || fence <= fc.reserved {
+		return
+	}
+
+	reserved := fence + FENCE_BLOCK
+
+	// Write the new reservation next to the old one and swap them, so a
+	// crash never leaves us with a half written file
+	tmp := fc.path + ".tmp"
+	file, err := os.Create(tmp)
+
+	if err == nil {
+		_, err = file.WriteString(strconv.FormatUint(reserved, 10) + "\n")
+
+		if err == nil {
+			err = file.Sync()
+		}
+
+		file.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, fc.path)
+	}
+
+	if err == nil {
+		err = syncDir(filepath.Dir(fc.path))
+	}
+
+	if err != nil {
+		// Giving out fences we can't promise to stay above would be worse
+		log.Fatalf("Failed to reserve fences in %s: %s", fc.path, err)
+	}
+
+	fc.reserved = reserved
+}
+
+func FormatFence(fence uint64) string {
+	return strconv.FormatUint(fence, 10)
+}
+
+// Returns 0 for anything that isn't a valid fence
+func ParseFence(fence string) uint64 {
+	value, err := strconv.ParseUint(fence, 10, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestFenceCounterNext(t *testing.T) {
+	fc := NewFenceCounter()
+
+	if fc.Next(0) != 1 || fc.Next(0) != 2 {
+		t.Error("Fences don't start from 1 and increase")
+	}
+
+	if fc.Next(10) != 11 {
+		t.Error("Next fence isn't above the one seen")
+	}
+
+	fc.Observe(5)
+
+	if fc.Last() != 11 {
+		t.Error("Observing a lower fence moved the counter back")
+	}
+}
+
+func TestFenceCounterPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godistlockd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fence")
+
+	fc, err := LoadFenceCounter(path)
+	if err != nil {
+		t.Error("Failed to load missing fence file:", err)
+		return
+	}
+
+	last := fc.Next(0)
+	fc.Observe(FENCE_BLOCK * 3)
+
+	fc, err = LoadFenceCounter(path)
+	if err != nil {
+		t.Error("Failed to load fence file:", err)
+		return
+	}
+
+	if fc.Next(0) <= FENCE_BLOCK * 3 || fc.Last() <= last {
+		t.Errorf("Fences went backwards after reloading, got %d", fc.Last())
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/aristanetworks/goarista/monotime"
 	"time"
 	"log"
-	"strconv"
 )
 
 var DEBUG = true
@@ -14,8 +13,25 @@ const (
 	TYPE_TRY
 	TYPE_CHECK
 	TYPE_RELEASE
+	TYPE_REFRESH
+	TYPE_STATS
+	TYPE_SNAPSHOT
+	TYPE_MERGE
+	TYPE_COMMIT
+	TYPE_ADOPT
+	TYPE_ABORT
+	TYPE_FIND
+	TYPE_WATCH
+	TYPE_COPY
+	TYPE_ENQUEUE
+	TYPE_DEQUEUE
+	TYPE_LINE
 )
 
+// How many shards the locks are spread over, each of them served by its own
+// goroutine so requests for different locks don't have to wait in line
+const LOCK_SHARDS = 64
+
 type LockQueue map[string][]*LockRequest
 type Locks map[string]*Lock
 
@@ -23,6 +39,19 @@ type Lock struct {
 	Fence    string
 	Expires  uint64
 	ClientId string
+	// The client session the lock was given to, the same as ClientId unless
+	// it's held through another server
+	Session  string
+	// Held for a proposal that hasn't been committed yet
+	Prelim   bool
+	// A shared lock, or a reader of one
+	Shared   bool
+	// Who holds a shared lock, see shared.go
+	Readers  []*Lock
+	// For semaphores, how many may hold it at once, see semaphore.go
+	Permits  int
+	// Which of the permits of a semaphore this is
+	Slot     int
 }
 
 func (l *Lock) MakeValidFor(timeout time.Duration) {
@@ -32,19 +61,101 @@ func (l *Lock) MakeValidFor(timeout time.Duration) {
 type LockRequest struct {
 	Name     string
 	ClientId string
+	// The session to hold the lock for, if not ClientId
+	Session  string
+	Fence    string
 	Timeout  time.Duration
 	Type     int
+	Shared   bool
+	Permits  int
+	// The permit asked for, -1 for any free one
+	Slot     int
+	// Place in line for the lock, see tickets.go
+	Ticket   uint64
+	// When to stop waiting for the lock, 0 for never
+	Deadline uint64
+	// For requests covering several locks at once, see multilock.go
+	Names       []string
+	// The fences to commit each of Names with
+	MultiFences []string
+	// Which of Names were free before, instead of held by ClientId already
+	Taken       []bool
 	Done     chan *Lock
+	Holds    chan []*Lock
+	Stats    chan LockStats
+	Snapshot chan []LockSnapshot
+	Locks    chan Locks
+	Line     chan waitLine
+}
+
+type LockSnapshot struct {
+	Name      string
+	ClientId  string
+	Session   string
+	Fence     string
+	Remaining time.Duration
+	Shared    bool
+	Permits   int
+	Slot      int
 }
 
+type LockStats struct {
+	Held     int
+	// Held by our own clients instead of through other relays
+	HeldLocal int
+	Queued   int
+	Granted  uint64
+	Expired  uint64
+	Released uint64
+}
+
+// Keeps track of the locks on this server. The locks are spread over
+// LOCK_SHARDS shards by their names, see shard.go, while the fences and the
+// lock log are shared by all of them.
 type LockManager struct {
-	requestChan chan *LockRequest
-	quitChan    chan bool
-	locks       Locks
+	shards   []*lockShard
+	fences   *FenceCounter
+	wal      *LockLog
+	quitChan chan bool
+	// How long tickets last without being queued again, see tickets.go
+	TicketTimeout time.Duration
 }
 
 func (lm *LockManager) Stop() {
-	lm.quitChan <- true
+	if lm.wal != nil {
+		lm.quitChan <- true
+	}
+
+	for _, shard := range lm.shards {
+		shard.quitChan <- true
+	}
+
+	if DEBUG {
+		log.Println("LockManager quitting")
+	}
+
+	lm.wal.Close()
+}
+
+func (lm *LockManager) shardFor(name string) *lockShard {
+	return lm.shards[shardIndex(name)]
+}
+
+// Which shard the lock name belongs to
+func shardIndex(name string) int {
+	// FNV-1a, without the allocations of hash/fnv
+	hash := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		hash ^= uint32(name[i])
+		hash *= 16777619
+	}
+
+	return int(hash % LOCK_SHARDS)
+}
+
+// Hand the request to the shard of the lock it's about
+func (lm *LockManager) send(receiver *LockRequest) {
+	lm.shardFor(receiver.Name).requestChan <- receiver
 }
 
 func (lm *LockManager) GetLock(clientId string, name string, timeout time.Duration) *Lock {
@@ -54,7 +165,21 @@ func (lm *LockManager) GetLock(clientId string, name string, timeout time.Durati
 	receiver.Timeout = timeout
 	receiver.Type = TYPE_GET
 
-	lm.requestChan <- receiver
+	lm.send(receiver)
+
+	return <-receiver.Done
+}
+
+// Like GetLock, but gives up after waiting for maxWait and returns nil
+func (lm *LockManager) GetLockWithin(clientId string, name string, timeout time.Duration, maxWait time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Name = name
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_GET
+	receiver.Deadline = monotime.Now() + uint64(maxWait)
+
+	lm.send(receiver)
 
 	return <-receiver.Done
 }
@@ -66,219 +191,382 @@ func (lm *LockManager) TryGet(clientId string, name string, timeout time.Duratio
 	receiver.Timeout = timeout
 	receiver.Type = TYPE_TRY
 
-	lm.requestChan <- receiver
+	lm.send(receiver)
 
 	return <-receiver.Done
 }
 
-func (lm *LockManager) WhoHas(name string) string {
+// Like GetLock, but for a reader of a shared lock
+func (lm *LockManager) GetShared(clientId string, name string, timeout time.Duration) *Lock {
 	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
 	receiver.Name = name
-	receiver.Type = TYPE_CHECK
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_GET
+	receiver.Shared = true
 
-	lm.requestChan <- receiver
+	lm.send(receiver)
 
-	result := <-receiver.Done
+	return <-receiver.Done
+}
 
-	if result == nil {
-		return ""
-	} else {
-		return result.ClientId
-	}
+// Like TryGet, but for a reader of a shared lock
+func (lm *LockManager) TryShared(clientId string, name string, timeout time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Name = name
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_TRY
+	receiver.Shared = true
+
+	lm.send(receiver)
+
+	return <-receiver.Done
 }
 
-func (lm *LockManager) IsLocked(name string) string {
+// Extend a lock or a reader held by clientId, if fence is given it must match
+// the hold's current fence. Returns nil if the lock has been lost.
+func (lm *LockManager) Refresh(clientId string, name string, fence string, timeout time.Duration) *Lock {
 	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
 	receiver.Name = name
-	receiver.Type = TYPE_CHECK
+	receiver.Fence = fence
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_REFRESH
 
-	lm.requestChan <- receiver
+	lm.send(receiver)
 
-	result := <-receiver.Done
+	return <-receiver.Done
+}
 
-	if result == nil {
-		return ""
-	} else {
-		return result.Fence
-	}
+// Get a new fence for a lock, higher than any we know to be used in the
+// cluster, seen being the highest one the other servers reported
+func (lm *LockManager) NextFence(seen uint64) uint64 {
+	return lm.fences.Next(seen)
+}
+
+// The highest fence we've given out or seen
+func (lm *LockManager) LastFence() uint64 {
+	return lm.fences.Last()
+}
+
+// Make sure we never give out a fence lower than one somebody else used
+func (lm *LockManager) ObserveFence(fence uint64) {
+	lm.fences.Observe(fence)
 }
 
-func (lm *LockManager) Release(clientId string, name string) {
+// Drop a hold clientId got for a proposal that failed. Committed locks are
+// only dropped if the fence matches.
+func (lm *LockManager) Abort(clientId string, name string, fence string) bool {
 	receiver := NewLockReceiver()
 	receiver.Name = name
 	receiver.ClientId = clientId
-	receiver.Type = TYPE_RELEASE
+	receiver.Fence = fence
+	receiver.Type = TYPE_ABORT
 
-	lm.requestChan <- receiver
-	<-receiver.Done
+	lm.send(receiver)
+	return <-receiver.Done != nil
 }
 
-func (lm *LockManager) giveLock(receiver *LockRequest) {
-	lock := Lock{}
+// Take or re-establish the lock with the given fence for session, without
+// waiting for it if somebody else has it
+func (lm *LockManager) Commit(clientId string, session string, name string, fence string, timeout time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_COMMIT
 
-	// Use monotonic clocks, time.Now() can jump around
-	lock.Fence = NewFence()
-	lock.ClientId = receiver.ClientId
-	lock.MakeValidFor(receiver.Timeout)
+	lm.send(receiver)
 
-	lm.locks[receiver.Name] = &lock
+	return <-receiver.Done
+}
 
-	if DEBUG {
-		log.Printf("Giving lock %s away until %d", receiver.Name, lock.Expires)
-	}
+// Like Commit, but for a reader of a shared lock
+func (lm *LockManager) CommitShared(clientId string, session string, name string, fence string, timeout time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_COMMIT
+	receiver.Shared = true
 
-	receiver.Done <- &lock
-}
+	lm.send(receiver)
 
-func (lm *LockManager) isLocked(name string) (clientId string) {
-	clientId = ""
-	lock, ok := lm.locks[name]
-	if ok && lock.Expires > monotime.Now() {
-		clientId = lock.ClientId
-	}
-	return
+	return <-receiver.Done
 }
 
-func (lm *LockManager) release(clientId string, name string) {
-	_, ok := lm.locks[name]
+// Hand a held lock or reader over to clientId, whoever holds it now. The
+// fence picks the hold, and it has to have been given to session.
+func (lm *LockManager) Adopt(clientId string, session string, name string, fence string, timeout time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_ADOPT
 
-	if ok {
-		newLocks := Locks{}
+	lm.send(receiver)
 
-		for n, lock := range lm.locks {
-			if n == name && lock.ClientId == clientId {
-				if DEBUG {
-					log.Printf("Lock %s was released.", n)
-				}
-				continue
-			}
+	return <-receiver.Done
+}
 
-			newLocks[n] = lock
-		}
+func (lm *LockManager) Check(name string) *Lock {
+	receiver := NewLockReceiver()
+	receiver.Name = name
+	receiver.Type = TYPE_CHECK
 
-		lm.locks = newLocks
-	}
+	lm.send(receiver)
+
+	return <-receiver.Done
 }
 
-func appendToQueue(queue *LockQueue, receiver *LockRequest) {
-	if _, ok := (*queue)[receiver.Name]; !ok {
-		(*queue)[receiver.Name] = []*LockRequest{}
-	}
-	(*queue)[receiver.Name] = append((*queue)[receiver.Name], receiver)
+// Find the lock or reader with the given fence, nil if it's not held
+func (lm *LockManager) FindHold(name string, fence string) *Lock {
+	receiver := NewLockReceiver()
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Type = TYPE_FIND
+
+	lm.send(receiver)
+
+	return <-receiver.Done
 }
 
-func (lm *LockManager) handleGet(clientId string, request *LockRequest) (result bool) {
-	result = false
-	if clientId == "" {
-		if DEBUG {
-			log.Printf("Lock %s was free, so giving it as requested.", request.Name)
-		}
+func (lm *LockManager) GetStats() LockStats {
+	stats := LockStats{}
 
-		lm.giveLock(request)
-		result = true
-	} else if clientId == request.ClientId {
-		if DEBUG {
-			log.Printf("Client %s asked to re-establish lock %s", clientId, request.Name)
-		}
+	for _, shard := range lm.shards {
+		receiver := NewLockReceiver()
+		receiver.Type = TYPE_STATS
+		receiver.Stats = make(chan LockStats)
+
+		shard.requestChan <- receiver
+		shardStats := <-receiver.Stats
 
-		lock := lm.locks[request.Name]
-		lock.MakeValidFor(request.Timeout)
-		request.Done <- lock
-		result = true
+		stats.Held += shardStats.Held
+		stats.HeldLocal += shardStats.HeldLocal
+		stats.Queued += shardStats.Queued
+		stats.Granted += shardStats.Granted
+		stats.Expired += shardStats.Expired
+		stats.Released += shardStats.Released
 	}
 
-	return
+	return stats
 }
 
-func (lm *LockManager) handleTry(clientId string, request *LockRequest) {
-	if clientId == "" {
-		if DEBUG {
-			log.Printf("Lock %s was free, so giving it as requested.", request.Name)
-		}
+// All currently held locks, and readers of shared locks, and how long they
+// have left
+func (lm *LockManager) GetSnapshot() []LockSnapshot {
+	snapshot := []LockSnapshot{}
 
-		lm.giveLock(request)
-	} else if clientId == request.ClientId {
-		if DEBUG {
-			log.Printf("Client %s asked to re-establish lock %s", clientId, request.Name)
-		}
+	for _, shard := range lm.shards {
+		receiver := NewLockReceiver()
+		receiver.Type = TYPE_SNAPSHOT
+		receiver.Snapshot = make(chan []LockSnapshot)
 
-		lock := lm.locks[request.Name]
-		lock.MakeValidFor(request.Timeout)
-		request.Done <- lock
-	} else {
-		if DEBUG {
-			log.Printf("Lock %s was taken, and request did not want to wait for it.", request.Name)
-		}
-		request.Done <- nil
+		shard.requestChan <- receiver
+		snapshot = append(snapshot, <-receiver.Snapshot...)
 	}
+
+	return snapshot
 }
 
-func (lm *LockManager) checkQueue(queue LockQueue) LockQueue {
-	newQueue := LockQueue{}
-	for _, requests := range queue {
-		for _, request := range requests {
-			locked := lm.isLocked(request.Name)
-
-			if locked == "" {
-				if DEBUG {
-					log.Printf("Lock %s has expired, giving it to the next one in queue.", request.Name)
-				}
-				lm.giveLock(request)
-			} else {
-				appendToQueue(&newQueue, request)
-			}
+// A copy of all the locks, for writing them to the lock log
+func (lm *LockManager) copyLocks() Locks {
+	locks := Locks{}
+
+	for _, shard := range lm.shards {
+		receiver := NewLockReceiver()
+		receiver.Type = TYPE_COPY
+		receiver.Locks = make(chan Locks)
+
+		shard.requestChan <- receiver
+		for name, lock := range <-receiver.Locks {
+			locks[name] = lock
 		}
 	}
 
-	return newQueue
+	return locks
 }
 
-func (lm *LockManager) Run() {
-	queueCheckInterval := time.Millisecond * 10
-	queue := LockQueue{}
+// Sync and compact the lock log as the policies say
+func (lm *LockManager) maintain() {
+	ticker := time.NewTicker(WAL_SYNC_INTERVAL_DURATION)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case request := <-lm.requestChan:
-			clientId := lm.isLocked(request.Name)
-
-			if request.Type == TYPE_GET {
-				if !lm.handleGet(clientId, request) {
-					if DEBUG {
-						log.Printf("Lock %s was taken, and request wants to wait for it.", request.Name)
-					}
-					appendToQueue(&queue, request)
-				}
-			} else if request.Type == TYPE_TRY {
-				lm.handleTry(clientId, request)
-			} else if request.Type == TYPE_CHECK {
-				if clientId == "" {
-					request.Done <- nil
-				} else {
-					request.Done <- lm.locks[request.Name]
-				}
-			} else if request.Type == TYPE_RELEASE {
-				if clientId != "" {
-					lm.release(request.ClientId, request.Name)
-					request.Done <- nil
-				}
-			}
-
-		case <-time.After(queueCheckInterval):
-			queue = lm.checkQueue(queue)
-
+		case <-ticker.C:
+			lm.wal.Maintain(lm.copyLocks)
 		case <-lm.quitChan:
-			if DEBUG {
-				log.Println("LockManager quitting")
-			}
 			return
 		}
 	}
 }
 
-func NewFence() string {
-	// TODO: This should figure out the correct fence to use in relay network
-	return strconv.FormatUint(monotime.Now(), 10)
+// Take in a lock we learned about from elsewhere. Locks we hold ourselves
+// win, but the same holder's lock is extended if it has more time left.
+func (lm *LockManager) Merge(clientId string, session string, name string, fence string, remaining time.Duration) {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Timeout = remaining
+	receiver.Type = TYPE_MERGE
+
+	lm.send(receiver)
+	<-receiver.Done
+}
+
+// Like Merge, but for a reader of a shared lock. Readers we don't know of
+// are added unless we hold the lock exclusively.
+func (lm *LockManager) MergeShared(clientId string, session string, name string, fence string, remaining time.Duration) {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Timeout = remaining
+	receiver.Type = TYPE_MERGE
+	receiver.Shared = true
+
+	lm.send(receiver)
+	<-receiver.Done
+}
+
+// Like GetLock, but for one of the permits of a semaphore
+func (lm *LockManager) GetPermit(clientId string, name string, permits int, timeout time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Name = name
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_GET
+	receiver.Shared = true
+	receiver.Permits = permits
+	receiver.Slot = -1
+
+	lm.send(receiver)
+
+	return <-receiver.Done
+}
+
+// Like TryGet, but for permit slot of a semaphore, or any free one if -1
+func (lm *LockManager) TryPermit(clientId string, name string, slot int, permits int, timeout time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Name = name
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_TRY
+	receiver.Shared = true
+	receiver.Permits = permits
+	receiver.Slot = slot
+
+	lm.send(receiver)
+
+	return <-receiver.Done
+}
+
+// Like Commit, but for permit slot of a semaphore
+func (lm *LockManager) CommitPermit(clientId string, session string, name string, slot int, permits int, fence string, timeout time.Duration) *Lock {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Timeout = timeout
+	receiver.Type = TYPE_COMMIT
+	receiver.Shared = true
+	receiver.Permits = permits
+	receiver.Slot = slot
+
+	lm.send(receiver)
+
+	return <-receiver.Done
+}
+
+// Like Merge, but for permit slot of a semaphore
+func (lm *LockManager) MergePermit(clientId string, session string, name string, slot int, permits int, fence string, remaining time.Duration) {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Name = name
+	receiver.Fence = fence
+	receiver.Timeout = remaining
+	receiver.Type = TYPE_MERGE
+	receiver.Shared = true
+	receiver.Permits = permits
+	receiver.Slot = slot
+
+	lm.send(receiver)
+	<-receiver.Done
+}
+
+func (lm *LockManager) WhoHas(name string) string {
+	receiver := NewLockReceiver()
+	receiver.Name = name
+	receiver.Type = TYPE_CHECK
+
+	lm.send(receiver)
+
+	result := <-receiver.Done
+
+	if result == nil {
+		return ""
+	} else {
+		return result.ClientId
+	}
+}
+
+func (lm *LockManager) IsLocked(name string) string {
+	receiver := NewLockReceiver()
+	receiver.Name = name
+	receiver.Type = TYPE_CHECK
+
+	lm.send(receiver)
+
+	result := <-receiver.Done
+
+	if result == nil {
+		return ""
+	} else {
+		return result.Fence
+	}
+}
+
+// Release the lock if clientId holds it, returns false if it didn't
+func (lm *LockManager) Release(clientId string, name string) bool {
+	return lm.ReleaseHold(clientId, clientId, name, "") != nil
+}
+
+// Release the lock or reader clientId holds for session with fence, or with
+// any fence if it's "". Returns what was released, nil if clientId didn't
+// hold it.
+func (lm *LockManager) ReleaseHold(clientId string, session string, name string, fence string) *Lock {
+	receiver := NewLockReceiver()
+	receiver.Name = name
+	receiver.ClientId = clientId
+	receiver.Session = session
+	receiver.Fence = fence
+	receiver.Type = TYPE_RELEASE
+
+	lm.send(receiver)
+	return <-receiver.Done
+}
+
+// The locks the request is about
+func requestNames(request *LockRequest) []string {
+	if len(request.Names) > 0 {
+		return request.Names
+	}
+
+	return []string{request.Name}
 }
 
 func NewLockReceiver() *LockRequest {
@@ -288,14 +576,38 @@ func NewLockReceiver() *LockRequest {
 }
 
 func NewLockManager() *LockManager {
-	lm := LockManager{}
+	return NewDurableLockManager(NewFenceCounter(), nil, Locks{})
+}
 
-	lm.locks = map[string]*Lock{}
+// A LockManager that continues from the given state, e.g. replayed from
+// disk, and keeps writing it to wal
+func NewDurableLockManager(fences *FenceCounter, wal *LockLog, locks Locks) *LockManager {
+	lm := LockManager{}
 
-	lm.requestChan = make(chan *LockRequest)
+	lm.fences = fences
+	lm.wal = wal
 	lm.quitChan = make(chan bool)
+	lm.TicketTimeout = TICKET_TIMEOUT
 
-	go lm.Run()
+	shardLocks := make([]Locks, LOCK_SHARDS)
+	for i := range shardLocks {
+		shardLocks[i] = Locks{}
+	}
+
+	for name, lock := range locks {
+		fences.Observe(ParseFence(lock.Fence))
+		shardLocks[shardIndex(name)][name] = lock
+	}
+
+	for _, locks := range shardLocks {
+		shard := newLockShard(fences, wal, locks)
+		lm.shards = append(lm.shards, shard)
+		go shard.Run()
+	}
+
+	if wal != nil {
+		go lm.maintain()
+	}
 
 	return &lm
 }
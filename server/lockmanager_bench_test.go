@@ -0,0 +1,168 @@
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// How long it takes for a released lock to reach the client waiting for it
+func BenchmarkLockManagerHandoff(b *testing.B) {
+	defer quiet()()
+
+	lm := NewLockManager()
+	defer lm.Stop()
+
+	lm.GetLock("a", "foo", time.Minute)
+
+	got := make(chan bool)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		waiter, holder := "b", "a"
+		if i % 2 == 1 {
+			waiter, holder = "a", "b"
+		}
+
+		go func() {
+			lm.GetLock(waiter, "foo", time.Minute)
+			got <- true
+		}()
+
+		// Only the handoff counts, not how long it takes to see it queued
+		b.StopTimer()
+		waitForQueue(lm, 1)
+		b.StartTimer()
+
+		lm.Release(holder, "foo")
+		<-got
+	}
+}
+
+// How long after a lock expires the client waiting for it gets it
+func BenchmarkLockManagerExpiryHandoff(b *testing.B) {
+	defer quiet()()
+
+	lm := NewLockManager()
+	defer lm.Stop()
+
+	timeout := time.Millisecond
+	var late time.Duration
+
+	lm.GetLock("a", "foo", timeout)
+	expires := time.Now().Add(timeout)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		waiter := "b"
+		if i % 2 == 1 {
+			waiter = "a"
+		}
+
+		lm.GetLock(waiter, "foo", timeout)
+		now := time.Now()
+
+		late += now.Sub(expires)
+		expires = now.Add(timeout)
+	}
+
+	b.ReportMetric(float64(late) / float64(b.N), "late-ns/op")
+}
+
+// CPU time the LockManager burns per millisecond while nothing happens, with
+// locks held and clients waiting for them
+func BenchmarkLockManagerIdle(b *testing.B) {
+	defer quiet()()
+
+	lm := NewLockManager()
+	defer lm.Stop()
+
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("lock-%d", i)
+		lm.GetLock("holder", name, time.Hour)
+
+		if i < 100 {
+			go lm.GetLock("waiter", name, time.Hour)
+		}
+	}
+
+	waitForQueue(lm, 100)
+
+	before := cpuTime()
+	b.ResetTimer()
+
+	time.Sleep(time.Millisecond * time.Duration(b.N))
+
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime() - before) / float64(b.N), "cpu-ns/op")
+}
+
+// Many clients taking and releasing locks of their own at the same time
+func BenchmarkLockManagerParallel(b *testing.B) {
+	defer quiet()()
+
+	lm := NewLockManager()
+	defer lm.Stop()
+
+	var clients int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		client := fmt.Sprintf("client-%d", atomic.AddInt64(&clients, 1))
+
+		for i := 0; pb.Next(); i++ {
+			name := fmt.Sprintf("%s-%d", client, i % 10)
+			lm.GetLock(client, name, time.Minute)
+			lm.Release(client, name)
+		}
+	})
+}
+
+// Releasing a lock while lots of others are held
+func BenchmarkLockManagerRelease(b *testing.B) {
+	defer quiet()()
+
+	lm := NewLockManager()
+	defer lm.Stop()
+
+	for i := 0; i < 100000; i++ {
+		lm.GetLock("holder", fmt.Sprintf("lock-%d", i), time.Hour)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		lm.GetLock("client", "foo", time.Minute)
+		lm.Release("client", "foo")
+	}
+}
+
+// Turn off debug logging, returns a func to turn it back on
+func quiet() func() {
+	debug := DEBUG
+	DEBUG = false
+
+	return func() {
+		DEBUG = debug
+	}
+}
+
+func waitForQueue(lm *LockManager, queued int) {
+	for lm.GetStats().Queued < queued {
+		// Let the waiters run, with a single CPU we'd keep it to ourselves
+		runtime.Gosched()
+	}
+}
+
+func cpuTime() time.Duration {
+	usage := syscall.Rusage{}
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
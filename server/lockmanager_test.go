@@ -110,3 +110,699 @@ func TestLockManagerRelock(t *testing.T) {
 
 	lm.Stop()
 }
+
+func TestLockManagerRefresh(t *testing.T) {
+	lm := NewLockManager()
+
+	lock := lm.GetLock("id", "foo", time.Millisecond * 50)
+	fence := lock.Fence
+
+	if lm.Refresh("id2", "foo", fence, time.Millisecond * 100) != nil {
+		t.Error("Refreshed lock held by another client")
+	}
+
+	if lm.Refresh("id", "foo", "wrong", time.Millisecond * 100) != nil {
+		t.Error("Refreshed lock with wrong fence")
+	}
+
+	if lm.Refresh("id", "foo", fence, time.Millisecond * 100) == nil {
+		t.Error("Failed to refresh held lock")
+	}
+
+	time.Sleep(time.Millisecond * 75)
+
+	if lm.IsLocked("foo") != fence {
+		t.Error("Lock expired despite refresh")
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if lm.Refresh("id", "foo", fence, time.Millisecond * 100) != nil {
+		t.Error("Refreshed lock after it expired")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerStats(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.GetLock("id", "foo", time.Millisecond * 50)
+	lm.GetLock("id", "bar", time.Second)
+
+	go lm.GetLock("id2", "bar", time.Second)
+	time.Sleep(time.Millisecond * 25)
+
+	stats := lm.GetStats()
+
+	if stats.Held != 2 || stats.Granted != 2 {
+		t.Errorf("Expected 2 held and granted locks, got %+v", stats)
+	}
+
+	if stats.Queued != 1 {
+		t.Errorf("Expected 1 queued request, got %+v", stats)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	lm.Release("id", "bar")
+	time.Sleep(time.Millisecond * 25)
+
+	stats = lm.GetStats()
+
+	if stats.Expired != 1 || stats.Released != 1 {
+		t.Errorf("Expected 1 expired and released lock, got %+v", stats)
+	}
+
+	if stats.Held != 1 || stats.Granted != 3 || stats.Queued != 0 {
+		t.Errorf("Queued request did not get the released lock, got %+v", stats)
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerSnapshotMerge(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.GetLock("id", "foo", time.Second)
+	lm.GetLock("id", "bar", time.Millisecond * 10)
+	time.Sleep(time.Millisecond * 20)
+
+	snapshot := lm.GetSnapshot()
+
+	if len(snapshot) != 1 || snapshot[0].Name != "foo" || snapshot[0].ClientId != "id" {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+		return
+	}
+
+	if snapshot[0].Remaining <= 0 || snapshot[0].Remaining > time.Second {
+		t.Errorf("Unexpected remaining time %s", snapshot[0].Remaining)
+	}
+
+	other := NewLockManager()
+	other.GetLock("id2", "foo", time.Second)
+
+	for _, lock := range snapshot {
+		other.Merge("relay:one", lock.Session, lock.Name, lock.Fence, lock.Remaining)
+	}
+	other.Merge("relay:one", "id3", "baz", "fence", time.Second)
+
+	if other.WhoHas("foo") != "id2" {
+		t.Error("Merge replaced a lock that was already held")
+	}
+
+	if other.WhoHas("baz") != "relay:one" || other.IsLocked("baz") != "fence" || other.FindHold("baz", "fence").Session != "id3" {
+		t.Error("Merge did not take in a free lock")
+	}
+
+	lm.Stop()
+	other.Stop()
+}
+
+func TestLockManagerCommitAdopt(t *testing.T) {
+	lm := NewLockManager()
+
+	lock := lm.Commit("relay:one", "session", "foo", "fence-1", time.Second)
+
+	if lock == nil || lock.Fence != "fence-1" || lock.Session != "session" {
+		t.Error("Failed to commit free lock")
+		return
+	}
+
+	if lm.Commit("relay:two", "other", "foo", "fence-2", time.Second) != nil {
+		t.Error("Committed a lock held by somebody else")
+	}
+
+	if lm.Adopt("session", "session", "foo", "fence-2", time.Second) != nil {
+		t.Error("Adopted a lock with the wrong fence")
+	}
+
+	// Knowing the fence isn't enough
+	if lm.Adopt("other", "other", "foo", "fence-1", time.Second) != nil || lm.Adopt("relay:two", "other", "foo", "fence-1", time.Second) != nil {
+		t.Error("Adopted a lock given to another session")
+	}
+
+	if lm.ReleaseHold("relay:one", "other", "foo", "fence-1") != nil {
+		t.Error("Released a lock given to another session")
+	}
+
+	lock = lm.Adopt("session", "session", "foo", "fence-1", time.Second)
+
+	if lock == nil || lm.WhoHas("foo") != "session" {
+		t.Error("Failed to adopt lock with the right fence")
+	}
+
+	if lm.Adopt("session", "session", "bar", "fence-1", time.Second) != nil {
+		t.Error("Adopted a lock that isn't held")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerReleaseWakesWaiter(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.GetLock("id", "foo", time.Minute)
+
+	if lm.Release("id2", "foo") {
+		t.Error("Released a lock held by somebody else")
+	}
+
+	done := make(chan *Lock)
+	go func() {
+		done <- lm.GetLock("id2", "foo", time.Second)
+	}()
+
+	// Give the request time to get queued
+	time.Sleep(time.Millisecond * 20)
+
+	if !lm.Release("id", "foo") {
+		t.Error("Failed to release lock")
+	}
+
+	select {
+	case lock := <-done:
+		if lock == nil || lm.WhoHas("foo") != "id2" {
+			t.Error("Waiter did not get the released lock")
+		}
+	case <-time.After(time.Millisecond * 5):
+		t.Error("Waiter was not woken up by the release")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerAbort(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.TryGet("relay:one", "foo", time.Second)
+
+	if lm.Abort("relay:two", "foo", "") {
+		t.Error("Aborted a hold of another relay")
+	}
+
+	if !lm.Abort("relay:one", "foo", "") || lm.IsLocked("foo") != "" {
+		t.Error("Failed to abort preliminary hold")
+	}
+
+	lm.TryGet("relay:one", "foo", time.Second)
+	lm.Commit("relay:one", "relay:one", "foo", "fence-1", time.Second)
+
+	if lm.Abort("relay:one", "foo", "fence-2") {
+		t.Error("Aborted a lock committed with another fence")
+	}
+
+	if !lm.Abort("relay:one", "foo", "fence-1") {
+		t.Error("Failed to abort committed lock with the right fence")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerFences(t *testing.T) {
+	lm := NewLockManager()
+
+	prelimFence := lm.TryGet("id", "foo", time.Second).Fence
+	fence := lm.NextFence(100)
+
+	if fence != 101 {
+		t.Errorf("Expected fence 101, got %d", fence)
+	}
+
+	lock := lm.Commit("id", "id", "foo", FormatFence(fence), time.Second)
+
+	if lock == nil || lock.Fence == prelimFence || lock.Prelim {
+		t.Error("Commit did not replace the preliminary fence")
+	}
+
+	lm.Merge("relay:one", "relay:one", "bar", "200", time.Second)
+
+	if lm.LastFence() != 200 {
+		t.Error("Merged fence was not observed")
+	}
+
+	lm.Release("id", "foo")
+
+	if ParseFence(lm.TryGet("id", "foo", time.Second).Fence) <= 200 {
+		t.Error("Fence went backwards")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerShared(t *testing.T) {
+	lm := NewLockManager()
+
+	first := lm.TryShared("id", "foo", time.Second)
+	second := lm.TryShared("id2", "foo", time.Second)
+
+	if first == nil || second == nil || !first.Shared {
+		t.Error("Failed to share lock between readers")
+		return
+	}
+
+	if first.Fence == second.Fence {
+		t.Error("Readers got the same fence")
+	}
+
+	if lm.TryGet("id3", "foo", time.Second) != nil {
+		t.Error("Writer got a lock held by readers")
+	}
+
+	if lm.WhoHas("foo") != SHARED_HOLDER || lm.GetStats().Held != 1 || len(lm.GetSnapshot()) != 2 {
+		t.Error("Shared lock not reported right")
+	}
+
+	if lm.FindHold("foo", second.Fence) == nil {
+		t.Error("Failed to find reader by fence")
+	}
+
+	if !lm.Release("id", "foo") || lm.IsLocked("foo") == "" {
+		t.Error("Releasing one reader dropped the lock")
+	}
+
+	if lm.Release("id", "foo") {
+		t.Error("Released a reader twice")
+	}
+
+	if !lm.Release("id2", "foo") || lm.IsLocked("foo") != "" {
+		t.Error("Lock still engaged after all readers left")
+	}
+
+	lm.GetLock("id", "bar", time.Second)
+
+	if lm.TryShared("id2", "bar", time.Second) != nil {
+		t.Error("Reader got an exclusively held lock")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerSharedWriterPreference(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.GetShared("reader", "foo", time.Second)
+
+	done := make(chan *Lock)
+	go func() {
+		done <- lm.GetLock("writer", "foo", time.Second)
+	}()
+
+	// Give the writer time to get queued
+	time.Sleep(time.Millisecond * 20)
+
+	if lm.TryShared("reader2", "foo", time.Second) != nil {
+		t.Error("New reader got in while a writer is waiting")
+	}
+
+	// Readers that already hold the lock can keep it
+	if lm.TryShared("reader", "foo", time.Second) == nil {
+		t.Error("Failed to re-establish reader while a writer is waiting")
+	}
+
+	lm.Release("reader", "foo")
+
+	select {
+	case lock := <-done:
+		if lock == nil || lm.WhoHas("foo") != "writer" {
+			t.Error("Writer did not get the lock after the readers left")
+		}
+	case <-time.After(time.Millisecond * 5):
+		t.Error("Writer was not woken up by the release")
+	}
+
+	lm.Release("writer", "foo")
+
+	if lm.TryShared("reader2", "foo", time.Second) == nil {
+		t.Error("Readers still turned away after the writer was done")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerSharedRelays(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.TryShared("relay:one", "foo", time.Second)
+	lm.CommitShared("relay:one", "session", "foo", "10", time.Second)
+
+	// A second proposal through the same relay gets a reader of its own
+	lm.TryShared("relay:one", "foo", time.Second)
+	lm.CommitShared("relay:one", "session-2", "foo", "11", time.Second)
+
+	if len(lm.GetSnapshot()) != 2 {
+		t.Error("Committing the second reader replaced the first one")
+	}
+
+	if lm.Adopt("session", "session", "foo", "10", time.Second) == nil || lm.FindHold("foo", "10").ClientId != "session" {
+		t.Error("Failed to adopt reader")
+	}
+
+	if lm.ReleaseHold("relay:one", "session", "foo", "10") != nil {
+		t.Error("Relay released an adopted reader")
+	}
+
+	if lm.Adopt("relay:two", "session", "foo", "11", time.Second) != nil || lm.ReleaseHold("relay:one", "session", "foo", "11") != nil {
+		t.Error("Reader given to another session was taken over")
+	}
+
+	if lm.ReleaseHold("relay:one", "session-2", "foo", "11") == nil {
+		t.Error("Failed to release reader by fence")
+	}
+
+	lm.MergeShared("relay:two", "relay:two", "foo", "12", time.Second)
+
+	if lm.FindHold("foo", "12") == nil || lm.LastFence() != 12 {
+		t.Error("Failed to merge reader")
+	}
+
+	if !lm.Abort("relay:two", "foo", "12") || lm.FindHold("foo", "12") != nil {
+		t.Error("Failed to abort reader")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerSemaphore(t *testing.T) {
+	lm := NewLockManager()
+
+	first := lm.TryPermit("id", "foo", -1, 2, time.Second)
+	second := lm.TryPermit("id2", "foo", -1, 2, time.Second)
+
+	if first == nil || second == nil || first.Slot == second.Slot {
+		t.Error("Failed to give out both permits")
+		return
+	}
+
+	if first.Fence == second.Fence {
+		t.Error("Permits got the same fence")
+	}
+
+	if lm.TryPermit("id3", "foo", -1, 2, time.Second) != nil {
+		t.Error("Got more permits than the semaphore has")
+	}
+
+	if lm.TryPermit("id3", "foo", -1, 3, time.Second) != nil || lm.TryShared("id3", "foo", time.Second) != nil {
+		t.Error("Got a permit with the wrong permit count")
+	}
+
+	done := make(chan *Lock)
+	go func() {
+		done <- lm.GetPermit("id3", "foo", 2, time.Second)
+	}()
+
+	// Give the waiter time to get queued
+	time.Sleep(time.Millisecond * 20)
+
+	lm.Release("id", "foo")
+
+	select {
+	case lock := <-done:
+		if lock == nil || lock.Slot != first.Slot {
+			t.Error("Waiter did not get the released permit")
+		}
+	case <-time.After(time.Millisecond * 5):
+		t.Error("Waiter was not woken up by the release")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerSemaphoreRelays(t *testing.T) {
+	lm := NewLockManager()
+
+	if lock := lm.TryPermit("relay:one", "foo", 1, 2, time.Second); lock == nil || lock.Slot != 1 {
+		t.Error("Failed to get the proposed permit")
+		return
+	}
+
+	if lm.TryPermit("relay:two", "foo", 1, 2, time.Second) != nil {
+		t.Error("Got a permit that is already taken")
+	}
+
+	if lm.CommitPermit("relay:one", "relay:one", "foo", 1, 2, "10", time.Second) == nil {
+		t.Error("Failed to commit permit")
+	}
+
+	if lm.CommitPermit("relay:two", "relay:two", "foo", 1, 2, "11", time.Second) != nil {
+		t.Error("Committed a permit that is already taken")
+	}
+
+	if lm.CommitPermit("relay:two", "relay:two", "foo", 0, 2, "11", time.Second) == nil {
+		t.Error("Failed to commit free permit")
+	}
+
+	lm.MergePermit("relay:three", "relay:three", "foo", 0, 2, "12", time.Second)
+
+	if lm.FindHold("foo", "12") != nil || lm.LastFence() != 12 {
+		t.Error("Merged a permit that is already taken")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerMultiLock(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.GetLock("other", "coupon", time.Second)
+
+	if lm.TryLocks("id", []string{"stock", "customer", "coupon"}, time.Second) != nil {
+		t.Error("Got a set of locks with one of them taken")
+	}
+
+	if lm.IsLocked("stock") != "" || lm.IsLocked("customer") != "" {
+		t.Error("Failed attempt left some of the locks held")
+	}
+
+	done := make(chan []*Lock)
+	go func() {
+		done <- lm.GetLocks("id", []string{"stock", "customer", "coupon"}, time.Second)
+	}()
+
+	// Give the request time to get queued
+	time.Sleep(time.Millisecond * 20)
+
+	if lm.IsLocked("stock") != "" {
+		t.Error("Waiting request is holding some of the locks")
+	}
+
+	lm.Release("other", "coupon")
+
+	select {
+	case locks := <-done:
+		if len(locks) != 3 || locks[2].Fence == locks[0].Fence || lm.WhoHas("customer") != "id" {
+			t.Error("Failed to get all the locks after the release")
+		}
+	case <-time.After(time.Millisecond * 5):
+		t.Error("Waiting request was not woken up by the release")
+	}
+
+	locks := lm.CommitLocks("id", "id", []string{"stock", "customer"}, []string{"10", "11"}, time.Second)
+	if len(locks) != 2 || lm.IsLocked("customer") != "11" {
+		t.Error("Failed to commit the locks with their own fences")
+	}
+
+	if lm.CommitLocks("relay:one", "relay:one", []string{"basket", "stock"}, []string{"12", "13"}, time.Second) != nil || lm.IsLocked("basket") != "" {
+		t.Error("Committed some of the locks with one of them taken")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerShards(t *testing.T) {
+	if shardIndex("lock-0") != shardIndex("lock-73") || shardIndex("stock") == shardIndex("coupon") {
+		t.Fatal("Unexpected shards for the test locks")
+	}
+
+	lm := NewLockManager()
+
+	// Locks already held survive a failed attempt, in other shards too
+	lm.GetLock("id", "stock", time.Second)
+	lm.GetLock("other", "coupon", time.Second)
+
+	if lm.TryLocks("id", []string{"stock", "customer", "coupon"}, time.Second) != nil {
+		t.Error("Got a set of locks with one of them taken")
+	}
+
+	if lm.WhoHas("stock") != "id" || lm.IsLocked("customer") != "" {
+		t.Error("Failed attempt didn't leave the locks as they were")
+	}
+
+	locks := lm.TryLocks("id", []string{"lock-0", "lock-73"}, time.Second)
+	if len(locks) != 2 || lm.WhoHas("lock-73") != "id" {
+		t.Error("Failed to get locks from the same shard")
+	}
+
+	// The lock taken from the first shard was given back
+	stats := lm.GetStats()
+	if stats.Held != 4 || stats.Granted != 5 || stats.Released != 1 {
+		t.Errorf("Unexpected stats over all the shards %+v", stats)
+	}
+
+	if len(lm.GetSnapshot()) != 4 {
+		t.Error("Snapshot doesn't cover all the shards")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerTickets(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.GetLock("holder", "foo", time.Second)
+
+	// Somebody through another server got in line before us
+	lm.Enqueue("relay:one", "foo", 10)
+	lm.Enqueue("id", "foo", 12)
+
+	if lm.Position("id", "foo") != 2 || lm.Position("relay:one", "foo") != 1 || lm.Position("other", "foo") != 0 {
+		t.Error("Unexpected positions in line")
+	}
+
+	if lm.LastFence() < 12 {
+		t.Error("Tickets didn't move the fences along")
+	}
+
+	done := make(chan *Lock)
+	go func() {
+		done <- lm.GetLock("id", "foo", time.Second)
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+	lm.Release("holder", "foo")
+
+	if lm.TryGet("other", "foo", time.Second) != nil {
+		t.Error("Got a lock others are in line for")
+	}
+
+	select {
+	case <-done:
+		t.Error("Got the lock before the one in line first")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	if !lm.Ahead("id", "foo") || lm.Ahead("relay:one", "foo") {
+		t.Error("Unexpected order in line")
+	}
+
+	// The relay went away
+	lm.DropTickets("relay:one")
+
+	select {
+	case lock := <-done:
+		if lock == nil || lm.WhoHas("foo") != "id" {
+			t.Error("Didn't get the lock when first in line")
+		}
+	case <-time.After(time.Millisecond * 20):
+		t.Error("Waiting request was not woken up when it was first in line")
+	}
+
+	lm.Dequeue("id", "foo", 12)
+
+	if lm.Position("id", "foo") != 0 || lm.Ahead("other", "foo") {
+		t.Error("Ticket was not taken out of line")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerTicketTimeout(t *testing.T) {
+	lm := NewLockManager()
+	lm.TicketTimeout = time.Millisecond * 50
+
+	lm.Enqueue("relay:one", "foo", 10)
+
+	done := make(chan *Lock)
+	go func() {
+		done <- lm.GetLock("id", "foo", time.Second)
+	}()
+
+	// Queueing again keeps the ticket in line
+	time.Sleep(time.Millisecond * 30)
+	lm.Enqueue("relay:one", "foo", 10)
+	time.Sleep(time.Millisecond * 30)
+
+	if lm.Position("relay:one", "foo") != 1 {
+		t.Error("Ticket that was queued again ran out")
+	}
+
+	// It's never taken out of line
+	select {
+	case lock := <-done:
+		if lock == nil || lm.Position("relay:one", "foo") != 0 {
+			t.Error("Didn't get the lock when the ticket ran out")
+		}
+	case <-time.After(time.Millisecond * 200):
+		t.Error("Waiting request was not woken up when the ticket ran out")
+	}
+
+	lm.Stop()
+}
+
+func TestLockManagerGetLockWithin(t *testing.T) {
+	lm := NewLockManager()
+
+	lm.GetLock("holder", "foo", time.Second)
+
+	started := time.Now()
+	if lm.GetLockWithin("impatient", "foo", time.Second, time.Millisecond * 20) != nil {
+		t.Error("Got a lock that was held")
+	}
+
+	if time.Since(started) < time.Millisecond * 20 {
+		t.Error("Gave up before the wait was over")
+	}
+
+	if lm.GetStats().Queued != 0 {
+		t.Error("Request that gave up was left waiting")
+	}
+
+	done := make(chan *Lock)
+	go func() {
+		done <- lm.GetLockWithin("patient", "foo", time.Second, time.Second)
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+	lm.Release("holder", "foo")
+
+	select {
+	case lock := <-done:
+		if lock == nil || lm.WhoHas("foo") != "patient" {
+			t.Error("Didn't get the lock within the wait")
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Error("Waiting request was not woken up")
+	}
+
+	lm.Stop()
+}
+
+func TestLockShardIdleTimer(t *testing.T) {
+	sh := newLockShard(NewFenceCounter(), nil, Locks{})
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	if sh.resetTimer(timer) != nil {
+		t.Error("Timer set with nothing due")
+	}
+
+	sh.locks["foo"] = &Lock{ClientId: "client", Expires: 1}
+	sh.schedule("foo")
+
+	due := sh.resetTimer(timer)
+
+	if due == nil {
+		t.Fatal("Timer not set for the lock")
+	}
+
+	<-due
+	sh.timerAt = 0
+	sh.expireDue()
+
+	if len(sh.locks) != 0 {
+		t.Error("Lock didn't expire")
+	}
+
+	if sh.resetTimer(timer) != nil {
+		t.Error("Timer still set after everything expired")
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"time"
+	"log"
+)
+
+// Several exclusive locks can be requested at once, e.g. to avoid deadlocks
+// between clients that need the same locks but would take them one by one in
+// a different order. Such requests are given all of the locks or none of
+// them, so nobody ever holds some of the set while waiting for the rest.
+//
+// When the locks live in different shards, they're taken shard by shard and
+// given back if a later shard can't give its share. Waiting is done without
+// holding any of them.
+
+// Like GetLock, but waits until all the locks are free and takes them at once
+func (lm *LockManager) GetLocks(clientId string, names []string, timeout time.Duration) []*Lock {
+	if lm.sameShard(names) {
+		receiver := newMultiReceiver(clientId, clientId, names, timeout)
+		receiver.Type = TYPE_GET
+
+		lm.send(receiver)
+
+		return <-receiver.Holds
+	}
+
+	for {
+		holds, busy := lm.takeAcross(TYPE_TRY, clientId, clientId, names, nil, timeout)
+
+		if holds != nil {
+			return holds
+		}
+
+		// Nothing is held while we wait, so nobody can end up waiting for us
+		for _, name := range busy {
+			lm.watch(clientId, name)
+		}
+	}
+}
+
+// Like TryGet, but for all the locks at once. Returns nil if any of them is
+// held by somebody else.
+func (lm *LockManager) TryLocks(clientId string, names []string, timeout time.Duration) []*Lock {
+	if lm.sameShard(names) {
+		receiver := newMultiReceiver(clientId, clientId, names, timeout)
+		receiver.Type = TYPE_TRY
+
+		lm.send(receiver)
+
+		return <-receiver.Holds
+	}
+
+	holds, _ := lm.takeAcross(TYPE_TRY, clientId, clientId, names, nil, timeout)
+	return holds
+}
+
+// Like Commit, but for all the locks at once, each with its own fence.
+// Returns nil without committing any of them if one is held by somebody else.
+func (lm *LockManager) CommitLocks(clientId string, session string, names []string, fences []string, timeout time.Duration) []*Lock {
+	if lm.sameShard(names) {
+		receiver := newMultiReceiver(clientId, session, names, timeout)
+		receiver.MultiFences = fences
+		receiver.Type = TYPE_COMMIT
+
+		lm.send(receiver)
+
+		return <-receiver.Holds
+	}
+
+	holds, _ := lm.takeAcross(TYPE_COMMIT, clientId, session, names, fences, timeout)
+	return holds
+}
+
+func (lm *LockManager) sameShard(names []string) bool {
+	for _, name := range names {
+		if shardIndex(name) != shardIndex(names[0]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Take locks that live in different shards, shard by shard. If one of the
+// shards can't give its locks, the ones taken from the others are released
+// and the locks of that shard are returned instead of holds.
+func (lm *LockManager) takeAcross(requestType int, clientId string, session string, names []string, fences []string, timeout time.Duration) ([]*Lock, []string) {
+	byShard := map[int][]int{}
+	for i, name := range names {
+		index := shardIndex(name)
+		byShard[index] = append(byShard[index], i)
+	}
+
+	holds := make([]*Lock, len(names))
+	taken := []int{}
+
+	for index := 0; index < LOCK_SHARDS; index++ {
+		indexes, ok := byShard[index]
+
+		if !ok {
+			continue
+		}
+
+		subset := []string{}
+		subsetFences := []string{}
+
+		for _, i := range indexes {
+			subset = append(subset, names[i])
+			if fences != nil {
+				subsetFences = append(subsetFences, fences[i])
+			}
+		}
+
+		receiver := newMultiReceiver(clientId, session, subset, timeout)
+		receiver.MultiFences = subsetFences
+		receiver.Type = requestType
+
+		lm.shards[index].requestChan <- receiver
+		subsetHolds := <-receiver.Holds
+
+		if subsetHolds == nil {
+			for _, i := range taken {
+				lm.ReleaseHold(clientId, session, names[i], holds[i].Fence)
+			}
+
+			return nil, subset
+		}
+
+		for j, i := range indexes {
+			holds[i] = subsetHolds[j]
+
+			if receiver.Taken[j] {
+				taken = append(taken, i)
+			}
+		}
+	}
+
+	return holds, nil
+}
+
+// Wait until the lock name is free or held by clientId, without taking it
+func (lm *LockManager) watch(clientId string, name string) {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Name = name
+	receiver.Type = TYPE_WATCH
+
+	lm.send(receiver)
+	<-receiver.Done
+}
+
+func newMultiReceiver(clientId string, session string, names []string, timeout time.Duration) *LockRequest {
+	receiver := NewLockReceiver()
+	receiver.ClientId = clientId
+	receiver.Session = session
+	// Queued requests are kept under the first lock
+	receiver.Name = names[0]
+	receiver.Names = names
+	receiver.Timeout = timeout
+	receiver.Holds = make(chan []*Lock)
+
+	return receiver
+}
+
+// Give the request all of its locks if none of them is held by somebody
+// else, re-establishing the ones it holds already. Returns false if the
+// request didn't get them.
+func (sh *lockShard) takeAll(request *LockRequest) bool {
+	free := true
+
+	for _, name := range request.Names {
+		clientId := sh.isLocked(name)
+
+		if clientId != "" && clientId != request.ClientId {
+			// Readers should let the whole set through eventually
+			sh.turnedAwayWriter(name)
+			free = false
+		} else if clientId == "" && sh.ahead(name, request.ClientId) {
+			free = false
+		}
+	}
+
+	if !free {
+		if DEBUG {
+			log.Printf("Locks %v are not all free for %s.", request.Names, request.ClientId)
+		}
+		return false
+	}
+
+	holds := []*Lock{}
+	request.Taken = []bool{}
+
+	for i, name := range request.Names {
+		single := *request
+		single.Name = name
+		single.Names = nil
+
+		if request.Type == TYPE_COMMIT {
+			single.Fence = request.MultiFences[i]
+		}
+
+		fresh := sh.isLocked(name) == ""
+		request.Taken = append(request.Taken, fresh)
+
+		if fresh {
+			holds = append(holds, sh.putLock(&single))
+		} else if request.Type == TYPE_COMMIT {
+			holds = append(holds, sh.commitHeld(name, single.Fence, request.Session, request.Timeout))
+		} else {
+			holds = append(holds, sh.reestablish(name, request.Timeout))
+		}
+	}
+
+	request.Holds <- holds
+	return true
+}
@@ -15,14 +15,28 @@ const RELAY_ID_PREFIX = "relay:"
 
 type Relay struct {
 	Server        *Server
-	RelayId       string
+	// Changes once the other server has said who it is, guarded by closeMutex
+	relayId       string
 	Connection    net.Conn
 	outgoing      chan *OutMsg
+	// Closed once the relay is closed, so nothing waits on the connection
+	done          chan bool
 	Alive         bool
+	Leaving       bool
 	responseQueue map[string]chan messages.Message
+	snapshots     map[string][]*messages.RelaySnap
 	closeMutex    *sync.Mutex
 	responseMutex *sync.Mutex
 	Nonce         *NonceGenerator
+	// Whether the other server has proven it knows the cluster key
+	authenticated bool
+	// Challenges of the handshake and the ID the other server said HELLO
+	// with, until it proves it knows the cluster key
+	challenge     string
+	peerChallenge string
+	peerId        string
+	// Nonce of the HELLO we said, if we're the ones who connected
+	helloNonce    string
 }
 
 func (r *Relay) Close() {
@@ -33,9 +47,13 @@ func (r *Relay) Close() {
 	if r.Alive {
 		r.Alive = false
 		r.Connection.Close()
-		close(r.outgoing)
+		close(r.done)
 		r.Server.RelayManager.RelayDisconnected()
 
+		// Whoever was in line through it is gone, or gets back in line with
+		// the same ticket when it tries again
+		r.Server.LockManager.DropTickets(r.relayId)
+
 		//for lock := range r.heldLocks {
 		//	r.Server.LockManager.Release(r.ClientId, lock)
 		//}
@@ -53,59 +71,161 @@ func (r *Relay) Error(message string) {
 func (r *Relay) SendBytes(data []byte) {
 	om := OutMsg{
 		data,
-		make(chan bool),
+		make(chan bool, 1),
 	}
 
-	r.outgoing <- &om
-	<-om.Done
+	// Responses to requests still being handled may come after it's closed.
+	// Not holding closeMutex meanwhile, the connection might not be written
+	// to for a while.
+	select {
+	case r.outgoing <- &om:
+	case <-r.done:
+		return
+	}
+
+	select {
+	case <-om.Done:
+	case <-r.done:
+	}
 }
 
 func (r *Relay) HandleOutgoing() {
-	// Read until channel is closed
-	for outgoing := range r.outgoing {
-		//log.Printf("%s <- %s", r.RelayId, string(outgoing.Data[:]))
-		r.Connection.Write(outgoing.Data)
-		r.Connection.Write([]byte("\n"))
-		outgoing.Done <- true
+	// Write until the relay is closed
+	for {
+		select {
+		case outgoing := <-r.outgoing:
+			//log.Printf("%s <- %s", r.GetRelayId(), string(outgoing.Data[:]))
+			r.Connection.Write(outgoing.Data)
+			r.Connection.Write([]byte("\n"))
+			outgoing.Done <- true
+		case <-r.done:
+			log.Printf("%s outgoing queue closed", r.GetRelayId())
+			return
+		}
 	}
-	log.Printf("%s outgoing queue closed", r.RelayId)
 }
 
 func (r *Relay) OnHello(msg *messages.RelayIncomingHello) {
-	r.RelayId = RELAY_ID_PREFIX + msg.Id
-	// Not handling failures here so other server always gets a valid response
-	r.Server.RelayManager.SetRelay(r)
+	if !PeerCertificateMatches(r.Connection, msg.Id) {
+		r.Error(fmt.Sprintf("Certificate is not for %s", msg.Id))
+		return
+	}
 
-	out, err := messages.NewRelayHowdy([]string{msg.Nonce, r.Server.Id, r.Server.Version})
+	key := r.Server.Config.ClusterKey
 
-	if err != nil {
-		log.Fatalln(err)
+	if key == "" {
+		r.setAuthenticated(msg.Id)
+
+		out, err := messages.NewRelayHowdy([]string{msg.Nonce, r.Server.Id, r.Server.Version})
+
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		// It refuses our requests until it has heard HOWDY
+		r.SendBytes(out.ToBytes())
+
+		// Not handling failures here so other server always gets a valid response
+		r.Server.RelayManager.SetRelay(r)
+		return
 	}
 
+	if msg.Challenge == "" {
+		r.Error("Cluster key required")
+		return
+	}
+
+	// It's let in once it answers our challenge with AUTH
+	r.peerId = msg.Id
+	r.peerChallenge = msg.Challenge
+	r.challenge = NewChallenge()
+
+	proof := RelayProof(key, "HOWDY", r.Server.Id, r.peerChallenge, r.challenge)
+	out := messages.RelayHowdy{Nonce: msg.Nonce, Id: r.Server.Id, Version: r.Server.Version, Challenge: r.challenge, Proof: proof}
+
+	r.SendBytes(out.ToBytes())
+
+	// And it has as long again to answer
+	r.Connection.SetReadDeadline(time.Now().Add(r.Server.Config.RelayTimeout.Duration))
+}
+
+func (r *Relay) OnAuth(msg *messages.RelayIncomingAuth) {
+	key := r.Server.Config.ClusterKey
+
+	if r.challenge == "" || !ValidRelayProof(key, msg.Proof, "AUTH", r.peerId, r.peerChallenge, r.challenge) {
+		log.Printf("Relay %s failed to prove it knows the cluster key, disconnecting", r.GetRelayId())
+		out := messages.RelayAck{Nonce: msg.Nonce, Status: 1}
+		r.SendBytes(out.ToBytes())
+		r.Close()
+		return
+	}
+
+	r.setAuthenticated(r.peerId)
+	r.challenge = ""
+
+	out := messages.RelayAck{Nonce: msg.Nonce, Status: 0}
 	r.SendBytes(out.ToBytes())
+
+	// Not handling failures here so other server always gets a valid response
+	r.Server.RelayManager.SetRelay(r)
+}
+
+// The other server proved it's id, which it's known by from now on
+func (r *Relay) setAuthenticated(id string) {
+	r.closeMutex.Lock()
+	defer r.closeMutex.Unlock()
+
+	r.authenticated = true
+	r.relayId = RELAY_ID_PREFIX + id
+	// No more hurry, see Run
+	r.Connection.SetReadDeadline(time.Time{})
+}
+
+func (r *Relay) GetRelayId() string {
+	r.closeMutex.Lock()
+	defer r.closeMutex.Unlock()
+
+	return r.relayId
+}
+
+func (r *Relay) isAuthenticated() bool {
+	r.closeMutex.Lock()
+	defer r.closeMutex.Unlock()
+
+	return r.authenticated
 }
 
 func (r *Relay) OnPropose(msg *messages.RelayIncomingProp) {
-	// 0 = ok, 1 = held by this server, 2 = held by another relay, 3 = can't have quorum
+	// 0 = ok, 1 = held by this server, 2 = held by another relay, 3 = can't have quorum,
+	// 4 = a writer is waiting, 5 = others are in line for it first
 	status := 0
 
-	if !r.Server.RelayManager.CanHaveQuorum {
+	if !r.Server.RelayManager.CanHaveQuorum() {
 		status = 3
 	} else {
 		// Try to get a preliminary lock
-		lock := r.Server.LockManager.TryGet(r.RelayId, msg.Lock, time.Second)
+		lock := r.tryLock(msg.Lock, msg.LockMode)
 
 		if lock == nil {
 			clientId := r.Server.LockManager.WhoHas(msg.Lock)
-			if isRelayId(clientId) {
+			if clientId == "" && r.Server.LockManager.Ahead(r.GetRelayId(), msg.Lock) {
+				status = 5
+			} else if isRelayId(clientId) {
 				status = 2
+			} else if msg.Shared && msg.Permits == 0 && (clientId == "" || clientId == SHARED_HOLDER) {
+				// Readers are only turned away from free or shared locks
+				// when writers are waiting for them
+				status = 4
 			} else {
 				status = 1
 			}
 		}
 	}
 
-	out, err := messages.NewRelayStat([]string{msg.Nonce, strconv.Itoa(status)})
+	// The proposer needs to pick a fence above any we've seen
+	fence := FormatFence(r.Server.LockManager.LastFence())
+
+	out, err := messages.NewRelayStat([]string{msg.Nonce, strconv.Itoa(status), fence})
 
 	if err != nil {
 		log.Fatalln(err)
@@ -114,12 +234,25 @@ func (r *Relay) OnPropose(msg *messages.RelayIncomingProp) {
 	r.SendBytes(out.ToBytes())
 }
 
+// Get or re-establish a preliminary hold for the source relay in mode
+func (r *Relay) tryLock(name string, mode messages.LockMode) *Lock {
+	timeout := r.Server.Config.PrepareTimeout.Duration
+
+	if mode.Permits > 0 {
+		return r.Server.LockManager.TryPermit(r.GetRelayId(), name, mode.Slot, mode.Permits, timeout)
+	} else if mode.Shared {
+		return r.Server.LockManager.TryShared(r.GetRelayId(), name, timeout)
+	}
+
+	return r.Server.LockManager.TryGet(r.GetRelayId(), name, timeout)
+}
+
 func (r *Relay) OnSchedule(msg *messages.RelayIncomingSched) {
 	// status 0 = ok, 1 = err
 	status := 0
 
 	// Refresh preliminary lock
-	lock := r.Server.LockManager.TryGet(r.RelayId, msg.Lock, time.Second)
+	lock := r.tryLock(msg.Lock, msg.LockMode)
 
 	if lock == nil {
 		status = 1
@@ -138,8 +271,15 @@ func (r *Relay) OnCommit(msg *messages.RelayIncomingComm) {
 	// status 0 = ok, 1 = err
 	status := 0
 
-	// Establish a firm lock
-	lock := r.Server.LockManager.GetLock(r.RelayId, msg.Lock, msg.Timeout)
+	// Establish a firm lock, with the same fence the proposer gave out
+	var lock *Lock
+	if msg.Permits > 0 {
+		lock = r.Server.LockManager.CommitPermit(r.GetRelayId(), msg.Session, msg.Lock, msg.Slot, msg.Permits, msg.Fence, msg.Timeout)
+	} else if msg.Shared {
+		lock = r.Server.LockManager.CommitShared(r.GetRelayId(), msg.Session, msg.Lock, msg.Fence, msg.Timeout)
+	} else {
+		lock = r.Server.LockManager.Commit(r.GetRelayId(), msg.Session, msg.Lock, msg.Fence, msg.Timeout)
+	}
 
 	if lock == nil {
 		status = 1
@@ -154,6 +294,281 @@ func (r *Relay) OnCommit(msg *messages.RelayIncomingComm) {
 	r.SendBytes(out.ToBytes())
 }
 
+func (r *Relay) OnMultiPropose(msg *messages.RelayIncomingMultiProp) {
+	// Same statuses as for PROP, for the first of the locks we can't give
+	status := 0
+
+	if !r.Server.RelayManager.CanHaveQuorum() {
+		status = 3
+	} else {
+		timeout := r.Server.Config.PrepareTimeout.Duration
+		locks := r.Server.LockManager.TryLocks(r.GetRelayId(), msg.Locks, timeout)
+
+		if locks == nil {
+			status = 1
+			for _, name := range msg.Locks {
+				clientId := r.Server.LockManager.WhoHas(name)
+
+				if clientId == "" && r.Server.LockManager.Ahead(r.GetRelayId(), name) {
+					status = 5
+					break
+				} else if isRelayId(clientId) {
+					status = 2
+					break
+				}
+			}
+		}
+	}
+
+	fence := FormatFence(r.Server.LockManager.LastFence())
+
+	out, err := messages.NewRelayStat([]string{msg.Nonce, strconv.Itoa(status), fence})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnMultiSchedule(msg *messages.RelayIncomingMultiSched) {
+	// status 0 = ok, 1 = err
+	status := 0
+
+	// Refresh the preliminary locks
+	timeout := r.Server.Config.PrepareTimeout.Duration
+	if r.Server.LockManager.TryLocks(r.GetRelayId(), msg.Locks, timeout) == nil {
+		status = 1
+	}
+
+	out, err := messages.NewRelayAck([]string{msg.Nonce, strconv.Itoa(status)})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnMultiCommit(msg *messages.RelayIncomingMultiComm) {
+	// status 0 = ok, 1 = err
+	status := 0
+
+	if r.Server.LockManager.CommitLocks(r.GetRelayId(), msg.Session, msg.Locks, msg.Fences, msg.Timeout) == nil {
+		status = 1
+	}
+
+	out, err := messages.NewRelayConf([]string{msg.Nonce, strconv.Itoa(status)})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnOff(msg *messages.RelayIncomingOff) {
+	// status 0 = ok, 1 = err
+	status := 0
+
+	// Only release the lock if the source relay holds it for the session, it
+	// might've been taken through somebody else already
+	if r.Server.LockManager.ReleaseHold(r.GetRelayId(), msg.Session, msg.Lock, msg.Fence) == nil {
+		status = 1
+	}
+
+	out, err := messages.NewRelayConf([]string{msg.Nonce, strconv.Itoa(status)})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnAbort(msg *messages.RelayIncomingAbort) {
+	// status 0 = ok, 1 = err
+	status := 0
+
+	if !r.Server.LockManager.Abort(r.GetRelayId(), msg.Lock, msg.Fence) {
+		status = 1
+	}
+
+	out, err := messages.NewRelayAck([]string{msg.Nonce, strconv.Itoa(status)})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnQueue(msg *messages.RelayIncomingQueue) {
+	r.Server.LockManager.Enqueue(r.GetRelayId(), msg.Lock, msg.Ticket)
+
+	out, err := messages.NewRelayAck([]string{msg.Nonce, "0"})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnDequeue(msg *messages.RelayIncomingDequeue) {
+	r.Server.LockManager.Dequeue(r.GetRelayId(), msg.Lock, msg.Ticket)
+
+	out, err := messages.NewRelayAck([]string{msg.Nonce, "0"})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnRefresh(msg *messages.RelayIncomingRefresh) {
+	// status 0 = ok, 1 = err
+	status := 0
+
+	// The fence and the session have to match, but the lock may have been
+	// taken through another relay if the client moved over from it
+	lock := r.Server.LockManager.Adopt(r.GetRelayId(), msg.Session, msg.Lock, msg.Fence, msg.Timeout)
+
+	if lock == nil {
+		status = 1
+	}
+
+	out, err := messages.NewRelayConf([]string{msg.Nonce, strconv.Itoa(status)})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnIs(msg *messages.RelayIncomingIs) {
+	var out messages.Message
+	var err error
+
+	fence := r.Server.LockManager.IsLocked(msg.Lock)
+
+	if fence == "" {
+		out, err = messages.NewRelayNo([]string{msg.Nonce})
+	} else {
+		out, err = messages.NewRelayLock([]string{msg.Nonce, fence})
+	}
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnBye(msg *messages.RelayIncomingBye) {
+	log.Printf("%s is leaving the cluster", r.GetRelayId())
+
+	r.Leaving = true
+	r.Server.RelayManager.RelayDisconnected()
+
+	out, err := messages.NewRelayAck([]string{msg.Nonce, "0"})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+func (r *Relay) OnSync(msg *messages.RelayIncomingSync) {
+	snapshot := r.Server.LockManager.GetSnapshot()
+
+	for _, lock := range snapshot {
+		// Tell which server the lock is held through, the other end can't
+		// know about our clients
+		owner := r.Server.Id
+		if isRelayId(lock.ClientId) {
+			owner = lock.ClientId[len(RELAY_ID_PREFIX):]
+		}
+
+		out := messages.RelaySnap{}
+		out.Nonce = msg.Nonce
+		out.Lock = lock.Name
+		out.Owner = owner
+		out.Session = lock.Session
+		out.Fence = lock.Fence
+		out.Remaining = lock.Remaining
+		out.LockMode = messages.LockMode{Shared: lock.Shared, Slot: lock.Slot, Permits: lock.Permits}
+
+		r.SendBytes(out.ToBytes())
+	}
+
+	fence := FormatFence(r.Server.LockManager.LastFence())
+
+	out, err := messages.NewRelaySnapEnd([]string{msg.Nonce, strconv.Itoa(len(snapshot)), fence})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	r.SendBytes(out.ToBytes())
+}
+
+// Collect the SNAP responses until SNAPEND comes in
+func (r *Relay) onSnap(msg *messages.RelaySnap) {
+	r.responseMutex.Lock()
+	defer r.responseMutex.Unlock()
+
+	if _, ok := r.responseQueue[msg.Nonce]; ok {
+		r.snapshots[msg.Nonce] = append(r.snapshots[msg.Nonce], msg)
+	}
+}
+
+func (r *Relay) takeSnapshot(nonce string) []*messages.RelaySnap {
+	r.responseMutex.Lock()
+	defer r.responseMutex.Unlock()
+
+	snapshot := r.snapshots[nonce]
+	delete(r.snapshots, nonce)
+
+	return snapshot
+}
+
+// Ask for all the locks the other server knows of and the highest fence it
+// has seen, returns false if we didn't get all of them in time
+func (r *Relay) RequestSnapshot(timeout time.Duration) ([]*messages.RelaySnap, uint64, bool) {
+	nonce := r.Nonce.String()
+	response := make(chan messages.Message)
+	waitForMessage(nonce, r, response, timeout)
+
+	msg, err := messages.NewRelayIncomingSync([]string{nonce})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	go r.SendBytes(msg.ToBytes())
+
+	end := <-response
+
+	if end == nil {
+		// Ignore whatever still arrives for this request
+		r.responseMutex.Lock()
+		r.clearNonce(nonce)
+		r.responseMutex.Unlock()
+	}
+
+	snapshot := r.takeSnapshot(nonce)
+
+	if end == nil || end.(*messages.RelaySnapEnd).Count != len(snapshot) {
+		return nil, 0, false
+	}
+
+	return snapshot, end.(*messages.RelaySnapEnd).Fence, true
+}
+
 func (r *Relay) clearNonce(nonce string) {
 	responseQueue := map[string]chan messages.Message{}
 	for n, receiver := range r.responseQueue {
@@ -188,19 +603,60 @@ func (r *Relay) Incoming(src []byte) {
 	}
 
 	if messages.IsRelayResponse(keyword) {
+		if howdy, ok := msg.(*messages.RelayHowdy); ok && !r.isAuthenticated() {
+			r.onHowdy(howdy)
+		}
+
 		r.gotResponse(msg.(messages.RelayMessage))
 		return
 	}
 
+	if !r.isAuthenticated() {
+		// Nothing but the handshake until it has proven who it is
+		switch msg := msg.(type) {
+		case *messages.RelayIncomingHello:
+			r.OnHello(msg)
+		case *messages.RelayIncomingAuth:
+			r.OnAuth(msg)
+		default:
+			r.Error("Say HELLO first")
+		}
+		return
+	}
+
 	switch msg := msg.(type) {
 	case *messages.RelayIncomingHello:
-		r.OnHello(msg)
+		r.Error("Already said HELLO")
 	case *messages.RelayIncomingProp:
 		r.OnPropose(msg)
 	case *messages.RelayIncomingSched:
 		r.OnSchedule(msg)
 	case *messages.RelayIncomingComm:
 		r.OnCommit(msg)
+	case *messages.RelayIncomingMultiProp:
+		r.OnMultiPropose(msg)
+	case *messages.RelayIncomingMultiSched:
+		r.OnMultiSchedule(msg)
+	case *messages.RelayIncomingMultiComm:
+		r.OnMultiCommit(msg)
+	case *messages.RelayIncomingOff:
+		r.OnOff(msg)
+	case *messages.RelayIncomingAbort:
+		r.OnAbort(msg)
+	case *messages.RelayIncomingQueue:
+		r.OnQueue(msg)
+	case *messages.RelayIncomingDequeue:
+		r.OnDequeue(msg)
+	case *messages.RelayIncomingRefresh:
+		r.OnRefresh(msg)
+	case *messages.RelayIncomingIs:
+		r.OnIs(msg)
+	case *messages.RelayIncomingBye:
+		r.OnBye(msg)
+	case *messages.RelayIncomingSync:
+		r.OnSync(msg)
+	case *messages.RelaySnap:
+		r.onSnap(msg)
 	default:
 		r.Error(fmt.Sprintf("Unsupported incoming keyword: %s", keyword))
 		r.Close()
@@ -209,7 +665,7 @@ func (r *Relay) Incoming(src []byte) {
 
 func (r *Relay) Expect(nonce string, onReceive func(messages.Message)) {
 	if DEBUG {
-		//log.Printf("Relay %s waiting for message with nonce %s", r.RelayId, nonce)
+		//log.Printf("Relay %s waiting for message with nonce %s", r.GetRelayId(), nonce)
 	}
 
 	r.responseMutex.Lock()
@@ -219,47 +675,135 @@ func (r *Relay) Expect(nonce string, onReceive func(messages.Message)) {
 
 	go func() {
 		onReceive(<-receiver)
-		//log.Printf("Relay %s received msg for nonce %s", r.RelayId, nonce)
+		//log.Printf("Relay %s received msg for nonce %s", r.GetRelayId(), nonce)
 	}()
 
 	r.responseQueue[nonce] = receiver
 }
 
-func (r *Relay) DoHello(onComplete func()) {
+// Say HELLO, onComplete is told whether the other server turned out to be
+// who it should
+func (r *Relay) DoHello(onComplete func(ok bool)) {
+	key := r.Server.Config.ClusterKey
+	challenge := ""
+
+	if key != "" {
+		challenge = NewChallenge()
+	}
+
 	nonce := r.Nonce.String()
-	r.Expect(nonce, func(msg messages.Message) {
-		hello := msg.(*messages.RelayHowdy)
 
-		r.RelayId = RELAY_ID_PREFIX + hello.Id
+	// Read by onHowdy on the goroutine reading the connection
+	r.closeMutex.Lock()
+	r.helloNonce = nonce
+	r.challenge = challenge
+	r.closeMutex.Unlock()
+
+	response := make(chan messages.Message)
+	waitForMessage(nonce, r, response, r.Server.Config.RelayTimeout.Duration)
 
-		onComplete()
-	})
+	go func() {
+		hello, ok := (<-response).(*messages.RelayHowdy)
+
+		if !ok {
+			log.Printf("Relay %s didn't answer HELLO with HOWDY in time, disconnecting", r.GetRelayId())
+			r.Close()
+			onComplete(false)
+			return
+		}
+
+		// onHowdy already told why not
+		if !r.isAuthenticated() {
+			r.Close()
+			onComplete(false)
+			return
+		}
+
+		if key != "" && !r.doAuth(RelayProof(key, "AUTH", r.Server.Id, challenge, hello.Challenge)) {
+			log.Printf("Relay %s didn't accept our proof of the cluster key, disconnecting", r.GetRelayId())
+			r.Close()
+			onComplete(false)
+			return
+		}
+
+		onComplete(true)
+	}()
 
-	msg, err := messages.NewRelayIncomingHello([]string{r.Server.Id, r.Server.Version, nonce})
+	msg := messages.RelayIncomingHello{Id: r.Server.Id, Version: r.Server.Version, Nonce: nonce, Challenge: challenge}
+
+	r.SendBytes(msg.ToBytes())
+}
+
+// Check the HOWDY answering our HELLO as soon as it's read, the requests the
+// other server sends right after it are only let through once it's proven
+// who it is
+func (r *Relay) onHowdy(hello *messages.RelayHowdy) {
+	r.closeMutex.Lock()
+	nonce, challenge := r.helloNonce, r.challenge
+	r.closeMutex.Unlock()
+
+	if hello.Nonce != nonce {
+		return
+	}
+
+	if !PeerCertificateMatches(r.Connection, hello.Id) {
+		log.Printf("Relay %s has a certificate that is not for %s, disconnecting", r.GetRelayId(), hello.Id)
+		return
+	}
+
+	key := r.Server.Config.ClusterKey
+
+	if key != "" && !ValidRelayProof(key, hello.Proof, "HOWDY", hello.Id, challenge, hello.Challenge) {
+		log.Printf("Relay %s failed to prove it knows the cluster key, disconnecting", r.GetRelayId())
+		return
+	}
+
+	r.setAuthenticated(hello.Id)
+}
+
+// Answer the other server's challenge, returns whether it let us in
+func (r *Relay) doAuth(proof string) bool {
+	nonce := r.Nonce.String()
+	response := make(chan messages.Message)
+	waitForMessage(nonce, r, response, r.Server.Config.RelayTimeout.Duration)
+
+	msg, err := messages.NewRelayIncomingAuth([]string{proof, nonce})
 
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	r.SendBytes(msg.ToBytes())
+	go r.SendBytes(msg.ToBytes())
+
+	ack, ok := (<-response).(*messages.RelayAck)
+
+	return ok && ack.Status == 0
 }
 
 func (r *Relay) Run() {
-	log.Printf("Processing relay connection %s", r.RelayId)
+	log.Printf("Processing relay connection %s", r.GetRelayId())
 
 	go r.HandleOutgoing()
 
+	// The other server has to say who it is in time, or it could keep the
+	// connection open forever without ever being let in
+	r.Connection.SetReadDeadline(time.Now().Add(r.Server.Config.RelayTimeout.Duration))
+
 	scanner := bufio.NewScanner(r.Connection)
 	for scanner.Scan() {
 		// If this data is ever used for longer than a single iteration it
 		// must be copied.
 		line := scanner.Bytes()
-		//log.Printf("%s -> %s", r.RelayId, string(line[:]))
+		//log.Printf("%s -> %s", r.GetRelayId(), string(line[:]))
 		r.Incoming(line)
 	}
 
+	if err, ok := scanner.Err().(net.Error); ok && err.Timeout() {
+		log.Printf("%s didn't finish saying hellos in time", r.GetRelayId())
+	}
+
 	// Nothing more to read from the connection, so I guess it was closed
-	log.Printf("%s connection closed", r.RelayId)
+	log.Printf("%s connection closed", r.GetRelayId())
 	r.Close()
 }
 
@@ -268,17 +812,20 @@ func NewRelay(server *Server, connection net.Conn) *Relay {
 
 	r.Server = server
 	r.Alive = true
+	r.Leaving = false
 	r.Connection = connection
 	r.closeMutex = &sync.Mutex{}
 	r.outgoing = make(chan *OutMsg)
+	r.done = make(chan bool)
 	r.responseMutex = &sync.Mutex{}
 	r.responseQueue = map[string]chan messages.Message{}
+	r.snapshots = map[string][]*messages.RelaySnap{}
 	r.Nonce = NewNonceGenerator()
 
 	if connection != nil {
-		r.RelayId = connection.RemoteAddr().String()
+		r.relayId = connection.RemoteAddr().String()
 	} else {
-		r.RelayId = NewUUID()
+		r.relayId = NewUUID()
 	}
 
 	return &r
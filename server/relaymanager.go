@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/tls"
 	"github.com/lietu/godistlockd/messages"
 	"time"
 	"sync"
@@ -9,13 +10,14 @@ import (
 	"math"
 	"fmt"
 	"math/rand"
+	"strconv"
 )
 
 type RelayConnections map[string]*Relay
 type RelayList []*Relay
 type MessageList []messages.Message
 
-var WAIT_TIMEOUT = time.Second
+const SYNC_TIMEOUT = time.Second * 10
 
 type RelayManager struct {
 	Server                *Server
@@ -26,8 +28,12 @@ type RelayManager struct {
 	serverIds             map[string]string
 	serverMutex           *sync.Mutex
 	connectMutex          *sync.Mutex
-	quorumNeed            int
-	CanHaveQuorum         bool
+	quorumNeed            int // How many other servers need to agree with us
+	// These three are guarded by syncMutex
+	canHaveQuorum         bool
+	synced                bool
+	syncing               bool
+	syncMutex             *sync.Mutex
 	relayAddressesHasSelf bool
 	connecting            bool
 }
@@ -42,7 +48,7 @@ func (rm *RelayManager) GetRelayConnections() (relays RelayList) {
 
 	relays = RelayList{}
 	for _, r := range rm.relayConnections {
-		if r.Alive {
+		if r.Alive && !r.Leaving {
 			relays = append(relays, r)
 		}
 	}
@@ -50,7 +56,7 @@ func (rm *RelayManager) GetRelayConnections() (relays RelayList) {
 	return
 }
 
-func waitForMessage(nonce string, relay *Relay, out chan messages.Message) {
+func waitForMessage(nonce string, relay *Relay, out chan messages.Message, timeout time.Duration) {
 	lock := sync.Mutex{}
 	sent := false
 
@@ -65,7 +71,7 @@ func waitForMessage(nonce string, relay *Relay, out chan messages.Message) {
 	})
 
 	go func() {
-		time.Sleep(WAIT_TIMEOUT)
+		time.Sleep(timeout)
 
 		lock.Lock()
 		defer lock.Unlock()
@@ -81,10 +87,11 @@ func (rm *RelayManager) GetRelayResponses(request messages.RelayMessage) (result
 	count := len(relays)
 
 	responses := make(chan messages.Message)
+	timeout := rm.Server.Config.RelayTimeout.Duration
 
 	for _, relay := range relays {
 		nonce := relay.Nonce.String()
-		waitForMessage(nonce, relay, responses)
+		waitForMessage(nonce, relay, responses, timeout)
 		request.SetNonce(nonce)
 		go relay.SendBytes(request.ToBytes())
 	}
@@ -150,39 +157,150 @@ func (rm *RelayManager) setServerId(addr string, serverId string) {
 	rm.serverIds[addr] = serverId
 }
 
+// Whether enough servers are connected and synchronized to give out locks
+func (rm *RelayManager) CanHaveQuorum() bool {
+	rm.syncMutex.Lock()
+	defer rm.syncMutex.Unlock()
+
+	return rm.canHaveQuorum
+}
+
+// Whether the locks held in the cluster have been synchronized from the
+// other servers since we started
+func (rm *RelayManager) Synced() bool {
+	rm.syncMutex.Lock()
+	defer rm.syncMutex.Unlock()
+
+	return rm.synced
+}
+
+// How many other servers need to agree with us
+func (rm *RelayManager) othersNeeded() int {
+	rm.serverMutex.Lock()
+	defer rm.serverMutex.Unlock()
+
+	return rm.quorumNeed
+}
+
 func (rm *RelayManager) updateQuorum() {
 	connections := len(rm.GetRelayConnections())
-	rm.CanHaveQuorum = (connections >= rm.quorumNeed)
+	enough := connections >= rm.othersNeeded()
+
+	// Once synchronized we stay so while we're running, even without
+	// quorum: the locks given out without us are held by a majority we're
+	// not part of, and every quorum we take part in later overlaps it
+	rm.syncMutex.Lock()
+	startSync := enough && !rm.synced && !rm.syncing
+	if startSync {
+		rm.syncing = true
+	}
+
+	rm.canHaveQuorum = enough && rm.synced
+	canHaveQuorum := rm.canHaveQuorum
+	rm.syncMutex.Unlock()
+
+	if startSync {
+		go rm.syncLocks()
+	}
+
+	rm.Server.RelayManagerReady(canHaveQuorum)
+}
+
+// Pull the locks every connected server knows of before we take part in
+// any quorum, so we don't hand out locks the cluster considers held
+func (rm *RelayManager) syncLocks() {
+	relays := rm.GetRelayConnections()
+	log.Printf("Synchronizing locks from %d relays", len(relays))
+
+	results := make(chan bool)
+
+	for _, relay := range relays {
+		go func(relay *Relay) {
+			snapshot, fence, ok := relay.RequestSnapshot(SYNC_TIMEOUT)
+			rm.Server.LockManager.ObserveFence(fence)
+
+			for _, lock := range snapshot {
+				// Nobody can release locks our clients held before we
+				// restarted, so those are kept as held through us
+				owner := RELAY_ID_PREFIX + lock.Owner
+
+				if lock.Permits > 0 {
+					rm.Server.LockManager.MergePermit(owner, lock.Session, lock.Lock, lock.Slot, lock.Permits, lock.Fence, lock.Remaining)
+				} else if lock.Shared {
+					rm.Server.LockManager.MergeShared(owner, lock.Session, lock.Lock, lock.Fence, lock.Remaining)
+				} else {
+					rm.Server.LockManager.Merge(owner, lock.Session, lock.Lock, lock.Fence, lock.Remaining)
+				}
+			}
+
+			if !ok {
+				log.Printf("Failed to synchronize locks from %s", relay.GetRelayId())
+			}
+
+			results <- ok
+		}(relay)
+	}
+
+	synced := 0
+	for range relays {
+		if <-results {
+			synced += 1
+		}
+	}
+
+	need := rm.syncNeed()
+
+	rm.syncMutex.Lock()
+	rm.syncing = false
+	rm.synced = synced >= need
+	rm.syncMutex.Unlock()
+
+	if synced >= need {
+		log.Printf("Synchronized locks from %d relays", synced)
+	}
 
-	rm.Server.RelayManagerReady(rm.CanHaveQuorum)
+	rm.updateQuorum()
 }
 
 func (rm *RelayManager) SetRelay(relay *Relay) bool {
 	rm.serverMutex.Lock()
 	defer rm.serverMutex.Unlock()
 
-	if relay.RelayId == rm.Server.Id {
+	if relay.GetRelayId() == RELAY_ID_PREFIX + rm.Server.Id {
 		if !rm.relayAddressesHasSelf {
 			rm.relayAddressesHasSelf = true
-			rm.quorumNeed = calculateQuorum(len(rm.relayAddresses))
+			rm.quorumNeed = calculateQuorum(len(rm.relayAddresses)) - 1
 			go rm.updateQuorum()
 		}
 		// Connection to self
 		return false
 	}
 
-	if _, ok := rm.relayConnections[relay.RelayId]; ok {
-		if rm.relayConnections[relay.RelayId].Alive {
+	if _, ok := rm.relayConnections[relay.GetRelayId()]; ok {
+		if rm.relayConnections[relay.GetRelayId()].Alive {
 			return false
 		}
 	}
 
-	rm.relayConnections[relay.RelayId] = relay
+	rm.relayConnections[relay.GetRelayId()] = relay
 	go rm.updateQuorum()
 
 	return true
 }
 
+// How many other servers we need to synchronize from before taking part in
+// quorums. With what we remember ourselves they make up a quorum, which
+// overlaps every majority that could hold a lock, so a bare quorum is
+// enough to start or rejoin the cluster.
+func (rm *RelayManager) syncNeed() int {
+	return rm.othersNeeded()
+}
+
+// How many servers, us included, make up a majority of the cluster
+func (rm *RelayManager) QuorumSize() int {
+	return rm.othersNeeded() + 1
+}
+
 func (rm *RelayManager) RelayDisconnected() {
 	go rm.updateQuorum()
 }
@@ -215,7 +333,14 @@ func (rm *RelayManager) connect(addr string) {
 	rm.addPendingConnection(addr)
 
 	// Initiate connection to target address
-	conn, err := net.Dial("tcp", addr)
+	var conn net.Conn
+	var err error
+
+	if rm.Server.TLS != nil {
+		conn, err = tls.Dial("tcp", addr, rm.Server.TLS.RelayDialConfig())
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		log.Println(err)
 
@@ -231,13 +356,19 @@ func (rm *RelayManager) connect(addr string) {
 	go r.Run()
 
 	// Perform HELLO <-> HELLO exchange
-	r.DoHello(func() {
-		log.Printf("Finished saying hellos with %s (%s)", addr, r.RelayId)
+	r.DoHello(func(ok bool) {
+		if !ok {
+			// Try again later, maybe it gets a proper certificate
+			rm.removePendingConnection(addr)
+			return
+		}
+
+		log.Printf("Finished saying hellos with %s (%s)", addr, r.GetRelayId())
 		// Update server address<->ID map
-		rm.setServerId(addr, r.RelayId)
+		rm.setServerId(addr, r.GetRelayId())
 
 		if !rm.SetRelay(r) {
-			log.Printf("Already had a connection with %s, disconnecting", r.RelayId)
+			log.Printf("Already had a connection with %s, disconnecting", r.GetRelayId())
 			r.Close()
 		}
 
@@ -275,14 +406,16 @@ func (rm *RelayManager) checkRelays() {
 	rm.connecting = false
 }
 
-func (rm *RelayManager) ProposeLock(name string) bool {
-	if !rm.CanHaveQuorum {
+// Ask the relays for preliminary holds on the lock, or on a reader or permit
+// of it depending on mode. Also returns the highest fence any of them has seen.
+func (rm *RelayManager) ProposeLock(name string, mode messages.LockMode) (bool, uint64) {
+	if !rm.CanHaveQuorum() {
 		log.Print("Can't have quorum, not gonna propose locking")
-		return false
+		return false, 0
 	}
 
 	log.Printf("Proposing locking of %s", name)
-	msg, err := messages.NewRelayIncomingProp([]string{name, "nonce"})
+	msg, err := messages.NewRelayIncomingProp(lockArgs(mode, name, "nonce"))
 
 	if err != nil {
 		log.Fatal("Failed to create outgoing PROP")
@@ -291,6 +424,9 @@ func (rm *RelayManager) ProposeLock(name string) bool {
 	responses := rm.GetRelayResponses(msg.(messages.RelayMessage))
 
 	ok := 0
+	writerWaiting := false
+	inLine := false
+	var fence uint64
 	for _, response := range responses {
 		if response == nil {
 			continue
@@ -299,20 +435,42 @@ func (rm *RelayManager) ProposeLock(name string) bool {
 		r := response.(*messages.RelayStat)
 		if r.Status == 0 {
 			ok += 1
+		} else if r.Status == 4 {
+			writerWaiting = true
+		} else if r.Status == 5 {
+			inLine = true
+		}
+
+		if r.Fence > fence {
+			fence = r.Fence
 		}
 	}
 
-	return ok >= rm.quorumNeed
+	if writerWaiting {
+		// Any server with a writer waiting is enough to hold back readers,
+		// otherwise readers through the other servers could starve it
+		log.Printf("A writer is waiting for %s, backing off", name)
+		return false, fence
+	}
+
+	if inLine {
+		// Only some of the servers might know of the ones in line before
+		// us, but any of them is enough to keep their turn
+		log.Printf("Others are in line for %s before us, backing off", name)
+		return false, fence
+	}
+
+	return ok >= rm.othersNeeded(), fence
 }
 
-func (rm *RelayManager) SchedLock(name string) bool {
-	if !rm.CanHaveQuorum {
+func (rm *RelayManager) SchedLock(name string, mode messages.LockMode) bool {
+	if !rm.CanHaveQuorum() {
 		log.Print("Can't have quorum, not gonna request locking")
 		return false
 	}
 
 	log.Printf("Requesting lock of %s", name)
-	msg, err := messages.NewRelayIncomingSched([]string{name, "nonce"})
+	msg, err := messages.NewRelayIncomingSched(lockArgs(mode, name, "nonce"))
 
 	if err != nil {
 		log.Fatal("Failed to create outgoing SCHED")
@@ -332,17 +490,17 @@ func (rm *RelayManager) SchedLock(name string) bool {
 		}
 	}
 
-	return ok >= rm.quorumNeed
+	return ok >= rm.othersNeeded()
 }
 
-func (rm *RelayManager) CommLock(name string, timeout time.Duration) bool {
-	if !rm.CanHaveQuorum {
+func (rm *RelayManager) CommLock(name string, timeout time.Duration, fence string, session string, mode messages.LockMode) bool {
+	if !rm.CanHaveQuorum() {
 		log.Print("Can't have quorum, can't commit lock")
 		return false
 	}
 
 	log.Printf("Committing lock %s", name)
-	msg, err := messages.NewRelayIncomingComm([]string{name, messages.DurationToString(timeout), "nonce"})
+	msg, err := messages.NewRelayIncomingComm(lockArgs(mode, name, messages.DurationToString(timeout), fence, session, "nonce"))
 
 	if err != nil {
 		log.Fatal("Failed to create outgoing COMM")
@@ -362,12 +520,256 @@ func (rm *RelayManager) CommLock(name string, timeout time.Duration) bool {
 		}
 	}
 
-	return ok >= rm.quorumNeed
+	return ok >= rm.othersNeeded()
+}
+
+// Like ProposeLock, but for all the locks at once in a single round. A relay
+// only agrees if it can give us all of them.
+func (rm *RelayManager) ProposeLocks(names []string) (bool, uint64) {
+	if !rm.CanHaveQuorum() {
+		log.Print("Can't have quorum, not gonna propose locking")
+		return false, 0
+	}
+
+	log.Printf("Proposing locking of %v", names)
+	msg, err := messages.NewRelayIncomingMultiProp(append([]string{"nonce"}, names...))
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing MPROP")
+	}
+
+	responses := rm.GetRelayResponses(msg.(messages.RelayMessage))
+
+	ok := 0
+	inLine := false
+	var fence uint64
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+
+		r := response.(*messages.RelayStat)
+		if r.Status == 0 {
+			ok += 1
+		} else if r.Status == 5 {
+			inLine = true
+		}
+
+		if r.Fence > fence {
+			fence = r.Fence
+		}
+	}
+
+	return ok >= rm.othersNeeded() && !inLine, fence
+}
+
+func (rm *RelayManager) SchedLocks(names []string) bool {
+	if !rm.CanHaveQuorum() {
+		log.Print("Can't have quorum, not gonna request locking")
+		return false
+	}
+
+	log.Printf("Requesting locks of %v", names)
+	msg, err := messages.NewRelayIncomingMultiSched(append([]string{"nonce"}, names...))
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing MSCHED")
+	}
+
+	responses := rm.GetRelayResponses(msg.(messages.RelayMessage))
+
+	ok := 0
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+
+		r := response.(*messages.RelayAck)
+		if r.Status == 0 {
+			ok += 1
+		}
+	}
+
+	return ok >= rm.othersNeeded()
+}
+
+// Commit all the locks at once, fences has the fence for each of names
+func (rm *RelayManager) CommLocks(names []string, timeout time.Duration, fences []string, session string) bool {
+	if !rm.CanHaveQuorum() {
+		log.Print("Can't have quorum, can't commit locks")
+		return false
+	}
+
+	log.Printf("Committing locks %v", names)
+	args := []string{messages.DurationToString(timeout), session, "nonce"}
+	for i, name := range names {
+		args = append(args, name, fences[i])
+	}
+
+	msg, err := messages.NewRelayIncomingMultiComm(args)
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing MCOMM")
+	}
+
+	responses := rm.GetRelayResponses(msg.(messages.RelayMessage))
+
+	ok := 0
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+
+		r := response.(*messages.RelayConf)
+		if r.Status == 0 {
+			ok += 1
+		}
+	}
+
+	return ok >= rm.othersNeeded()
+}
+
+func (rm *RelayManager) RefreshLock(name string, fence string, session string, timeout time.Duration) bool {
+	if !rm.CanHaveQuorum() {
+		log.Print("Can't have quorum, can't refresh lock")
+		return false
+	}
+
+	log.Printf("Refreshing lock %s", name)
+	msg, err := messages.NewRelayIncomingRefresh([]string{name, fence, session, messages.DurationToString(timeout), "nonce"})
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing REFRESH")
+	}
+
+	responses := rm.GetRelayResponses(msg.(messages.RelayMessage))
+
+	ok := 0
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+
+		r := response.(*messages.RelayConf)
+		if r.Status == 0 {
+			ok += 1
+		}
+	}
+
+	return ok >= rm.othersNeeded()
+}
+
+// Let every relay know session released the lock or reader with fence.
+// Returns true if a quorum confirmed, but the lock is released on our end
+// either way.
+func (rm *RelayManager) ReleaseLock(name string, fence string, session string) bool {
+	log.Printf("Releasing lock %s", name)
+	msg, err := messages.NewRelayIncomingOff([]string{name, fence, session, "nonce"})
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing OFF")
+	}
+
+	responses := rm.GetRelayResponses(msg.(messages.RelayMessage))
+
+	ok := 0
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+
+		r := response.(*messages.RelayConf)
+		if r.Status == 0 {
+			ok += 1
+		}
+	}
+
+	return ok >= rm.othersNeeded()
+}
+
+// Tell every relay to drop the holds they gave us for a failed proposal, so
+// other proposers don't have to wait for them to time out
+func (rm *RelayManager) AbortLock(name string, fence string) {
+	log.Printf("Aborting lock %s", name)
+	msg, err := messages.NewRelayIncomingAbort([]string{name, fence, "nonce"})
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing ABORT")
+	}
+
+	rm.GetRelayResponses(msg.(messages.RelayMessage))
+}
+
+// Tell every relay our client with ticket is in line for the lock, so they
+// won't give it to anybody after them
+func (rm *RelayManager) QueueLock(name string, ticket uint64) {
+	log.Printf("Getting in line for %s with ticket %d", name, ticket)
+	msg, err := messages.NewRelayIncomingQueue([]string{name, strconv.FormatUint(ticket, 10), "nonce"})
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing QUEUE")
+	}
+
+	rm.GetRelayResponses(msg.(messages.RelayMessage))
+}
+
+// Tell every relay our client with ticket isn't in line for the lock anymore
+func (rm *RelayManager) DequeueLock(name string, ticket uint64) {
+	msg, err := messages.NewRelayIncomingDequeue([]string{name, strconv.FormatUint(ticket, 10), "nonce"})
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing DEQUEUE")
+	}
+
+	rm.GetRelayResponses(msg.(messages.RelayMessage))
+}
+
+// Ask every relay if they have the lock engaged. Returns the fence most of
+// them agree on and how many relays reported the lock as engaged.
+func (rm *RelayManager) QueryLock(name string) (fence string, engaged int) {
+	msg, err := messages.NewRelayIncomingIs([]string{name, "nonce"})
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing IS")
+	}
+
+	responses := rm.GetRelayResponses(msg.(messages.RelayMessage))
+
+	fences := map[string]int{}
+	for _, response := range responses {
+		if r, ok := response.(*messages.RelayLock); ok {
+			fences[r.Fence] += 1
+			engaged += 1
+		}
+	}
+
+	for f, count := range fences {
+		if count > fences[fence] {
+			fence = f
+		}
+	}
+
+	return
+}
+
+// Let the other servers know we're going away so they stop counting on us
+func (rm *RelayManager) Leave() {
+	log.Print("Telling other servers we're leaving")
+	msg, err := messages.NewRelayIncomingBye([]string{"nonce"})
+
+	if err != nil {
+		log.Fatal("Failed to create outgoing BYE")
+	}
+
+	rm.GetRelayResponses(msg.(messages.RelayMessage))
 }
 
 func (rm *RelayManager) Run() {
 	rm.checkRelays()
 
+	// Without any peers to connect to nothing else would tell us we're ready
+	rm.updateQuorum()
+
 	checks := time.Millisecond * 5
 
 	status := time.Now()
@@ -382,6 +784,11 @@ func (rm *RelayManager) Run() {
 			if time.Since(relayCheck) > time.Second {
 				relayCheck = time.Now()
 				rm.checkRelays()
+
+				if !rm.CanHaveQuorum() {
+					// Retry synchronizing if it failed earlier
+					rm.updateQuorum()
+				}
 			}
 
 			if time.Since(status) > time.Second * 5 {
@@ -390,7 +797,7 @@ func (rm *RelayManager) Run() {
 				connections := rm.GetRelayConnections()
 				log.Printf("%d relays connected", len(connections))
 				for _, c := range connections {
-					log.Printf(" - %s", c.RelayId)
+					log.Printf(" - %s", c.GetRelayId())
 				}
 			}
 
@@ -402,7 +809,7 @@ func (rm *RelayManager) Run() {
 				}
 				go func() {
 					lock := fmt.Sprintf("mah-lock-%d", rand.Int31())
-					log.Printf("%+v", rm.Server.DoLock("janne", lock, time.Minute))
+					log.Printf("%+v", rm.Server.DoLock("janne", lock, time.Minute, false, 0, messages.LockMode{}))
 				}()
 			}
 
@@ -410,6 +817,15 @@ func (rm *RelayManager) Run() {
 	}
 }
 
+// Arguments for a lock request, with the mode unless it's exclusive
+func lockArgs(mode messages.LockMode, args ...string) []string {
+	if mode.Shared {
+		return append(args, mode.String())
+	}
+
+	return args
+}
+
 func calculateQuorum(servers int) int {
 	return (int)(math.Ceil((float64)(servers) / 100.0 * 50.01))
 }
@@ -424,9 +840,13 @@ func NewRelayManager(server *Server) *RelayManager {
 	rm.serverIds = map[string]string{}
 	rm.relayConnections = RelayConnections{}
 	rm.pendingConnections = []string{}
-	rm.quorumNeed = calculateQuorum(len(rm.relayAddresses) + 1)
+	// Until we find ourselves in the list assume we're not in it
+	rm.quorumNeed = calculateQuorum(len(rm.relayAddresses) + 1) - 1
 	rm.relayAddressesHasSelf = false
-	rm.CanHaveQuorum = false
+	rm.canHaveQuorum = false
+	rm.synced = false
+	rm.syncing = false
+	rm.syncMutex = &sync.Mutex{}
 	rm.connecting = false
 
 	return &rm
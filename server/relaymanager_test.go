@@ -1,8 +1,10 @@
 package server
 
 import (
+	"github.com/lietu/godistlockd/messages"
 	"testing"
 	"fmt"
+	"time"
 )
 
 func TestRelayManagerCalculateQuorum(t *testing.T) {
@@ -40,4 +42,191 @@ func TestRelayManagerCalculateQuorum(t *testing.T) {
 	if quorum != 4 {
 		t.Error(fmt.Sprintf("Quorum for 7 servers should be 4, not %d", quorum))
 	}
-}
\ No newline at end of file
+}
+
+// A server of a 3 server cluster, with the other two as peers
+func newClusterServer(id string) *Server {
+	server := newKeyedServer(id, "")
+	server.RelayManager.relayAddresses = []string{"other-1:20000", "other-2:20000"}
+	server.RelayManager.quorumNeed = calculateQuorum(3) - 1
+
+	return server
+}
+
+// Wait for all of the servers to have quorum, or none of them
+func waitForQuorum(quorum bool, servers ...*Server) bool {
+	deadline := time.Now().Add(time.Second * 5)
+
+	for time.Now().Before(deadline) {
+		done := true
+		for _, s := range servers {
+			done = done && s.RelayManager.CanHaveQuorum() == quorum
+		}
+
+		if done {
+			return true
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return false
+}
+
+func TestRelayManagerBareQuorum(t *testing.T) {
+	// The third server of the cluster never shows up
+	server0 := newClusterServer("server-0")
+	server1 := newClusterServer("server-1")
+
+	if !relayAuthHandshake(server0, server1) {
+		t.Fatal("Servers couldn't connect")
+	}
+
+	if !waitForQuorum(true, server0, server1) {
+		t.Fatal("2 servers of 3 didn't become ready")
+	}
+
+	if server0.LockManager.TryGet("client", "foo", time.Minute) == nil {
+		t.Fatal("Failed to get lock")
+	}
+
+	// server-1 restarts
+	for _, relay := range server0.RelayManager.GetRelayConnections() {
+		relay.Close()
+	}
+
+	if !waitForQuorum(false, server0) {
+		t.Error("Quorum without the other servers")
+	}
+
+	restarted := newClusterServer("server-1")
+
+	if !relayAuthHandshake(restarted, server0) {
+		t.Fatal("Restarted server couldn't connect")
+	}
+
+	if !waitForQuorum(true, server0, restarted) {
+		t.Fatal("Restarted server couldn't rejoin with a bare quorum")
+	}
+
+	if restarted.LockManager.WhoHas("foo") != RELAY_ID_PREFIX + "server-0" {
+		t.Error("Restarted server didn't synchronize the lock")
+	}
+}
+
+func TestRelayManagerLostDequeue(t *testing.T) {
+	server0 := newClusterServer("server-0")
+	server1 := newClusterServer("server-1")
+	server1.LockManager.TicketTimeout = time.Millisecond * 200
+
+	if !relayAuthHandshake(server0, server1) {
+		t.Fatal("Servers couldn't connect")
+	}
+
+	if !waitForQuorum(true, server0, server1) {
+		t.Fatal("2 servers of 3 didn't become ready")
+	}
+
+	// A client of server-0 got in line, but the DEQUEUE after it never made
+	// it to server-1
+	server0.RelayManager.QueueLock("foo", 10)
+
+	if server1.LockManager.Position(RELAY_ID_PREFIX + "server-0", "foo") != 1 {
+		t.Fatal("Ticket didn't get to the other server")
+	}
+
+	if server1.DoLock("client", "foo", time.Minute, false, 0, messages.LockMode{}) != nil {
+		t.Error("Got a lock somebody else is in line for")
+	}
+
+	time.Sleep(time.Millisecond * 300)
+
+	if server1.DoLock("client", "foo", time.Minute, false, 0, messages.LockMode{}) == nil {
+		t.Error("Lost DEQUEUE kept the lock from everybody")
+	}
+}
+
+func TestRelayManagerSessionOwnership(t *testing.T) {
+	server0 := newClusterServer("server-0")
+	server1 := newClusterServer("server-1")
+
+	if !relayAuthHandshake(server0, server1) {
+		t.Fatal("Servers couldn't connect")
+	}
+
+	if !waitForQuorum(true, server0, server1) {
+		t.Fatal("2 servers of 3 didn't become ready")
+	}
+
+	lock := server0.DoLock("session-a", "foo", time.Minute, false, 0, messages.LockMode{})
+
+	if lock == nil {
+		t.Fatal("Failed to get lock")
+	}
+
+	// Anybody can find out the fence with IS
+	if server1.DoRefresh("session-b", "foo", lock.Fence, time.Minute) != nil {
+		t.Error("Another session took the lock over through another server")
+	}
+
+	if server1.RelayManager.RefreshLock("foo", lock.Fence, "session-b", time.Minute) {
+		t.Error("Relay let another session refresh the lock")
+	}
+
+	if server1.RelayManager.ReleaseLock("foo", lock.Fence, "session-b") {
+		t.Error("Relay let another session release the lock")
+	}
+
+	if server0.LockManager.WhoHas("foo") != "session-a" || server1.LockManager.WhoHas("foo") != RELAY_ID_PREFIX + "server-0" {
+		t.Error("Lock changed hands")
+	}
+
+	// The session the lock was given to can move over
+	if server1.DoRefresh("session-a", "foo", lock.Fence, time.Minute) == nil {
+		t.Fatal("Session couldn't refresh its lock through another server")
+	}
+
+	if server1.LockManager.WhoHas("foo") != "session-a" || server0.LockManager.WhoHas("foo") != RELAY_ID_PREFIX + "server-1" {
+		t.Error("Lock wasn't moved over")
+	}
+}
+
+func TestRelayManagerFailedRetryKeepsLock(t *testing.T) {
+	server0 := newClusterServer("server-0")
+	server1 := newClusterServer("server-1")
+
+	if !relayAuthHandshake(server0, server1) {
+		t.Fatal("Servers couldn't connect")
+	}
+
+	if !waitForQuorum(true, server0, server1) {
+		t.Fatal("2 servers of 3 didn't become ready")
+	}
+
+	lock := server0.DoLock("session-a", "foo", time.Minute, false, 0, messages.LockMode{})
+
+	if lock == nil {
+		t.Fatal("Failed to get lock")
+	}
+
+	for _, relay := range server0.RelayManager.GetRelayConnections() {
+		relay.Close()
+	}
+
+	if !waitForQuorum(false, server0, server1) {
+		t.Fatal("Quorum without the other servers")
+	}
+
+	// The client asks for the lock again, which can't get through now
+	if server0.DoLock("session-a", "foo", time.Minute, false, 0, messages.LockMode{}) != nil {
+		t.Fatal("Got a lock without a quorum")
+	}
+
+	if server0.LockManager.WhoHas("foo") != "session-a" || server0.LockManager.FindHold("foo", lock.Fence) == nil {
+		t.Error("Failed attempt let go of the lock held before it")
+	}
+
+	if server1.LockManager.WhoHas("foo") != RELAY_ID_PREFIX + "server-0" {
+		t.Error("Failed attempt aborted the lock on the relay")
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/lietu/godistlockd/messages"
+	"math/rand"
+)
+
+// Semaphores are shared locks that up to Permits holders can have at once.
+// Each holder has one of the numbered permits, and every permit is agreed on
+// by a quorum just like an exclusive lock. Counting holders on each server
+// wouldn't do, with majorities that only overlap in part more than Permits
+// holders could get in.
+//
+// Servers pick a random free permit for their clients, so competing servers
+// don't keep going for the same one.
+
+// Pick a free permit of the semaphore, slot if it's given and free, or -1 if
+// there are none
+func (l *Lock) freeSlot(slot int) int {
+	taken := map[int]bool{}
+	for _, holder := range l.Readers {
+		taken[holder.Slot] = true
+	}
+
+	if slot >= 0 {
+		if slot >= l.Permits || taken[slot] {
+			return -1
+		}
+
+		return slot
+	}
+
+	free := []int{}
+	for slot := 0; slot < l.Permits; slot++ {
+		if !taken[slot] {
+			free = append(free, slot)
+		}
+	}
+
+	if len(free) == 0 {
+		return -1
+	}
+
+	return free[rand.Intn(len(free))]
+}
+
+// How the lock is held, as told to the other servers
+func (l *Lock) mode() messages.LockMode {
+	return messages.LockMode{Shared: l.Shared, Slot: l.Slot, Permits: l.Permits}
+}
+
+// A shared lock, or a semaphore when permits is given
+func newSemaphore(permits int) *Lock {
+	lock := newSharedLock()
+	lock.Permits = permits
+
+	return lock
+}
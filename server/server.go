@@ -1,14 +1,19 @@
 package server
 
 import (
+	"crypto/tls"
 	"net"
 	"log"
-	"fmt"
 	"sync"
 	"time"
+	"math/rand"
+	"path/filepath"
+	"os"
+	"github.com/lietu/godistlockd/messages"
 )
 
-const TEMP_TIMEOUT = time.Second
+const RETRY_DELAY = time.Millisecond * 50
+const DRAIN_CHECK_INTERVAL = time.Millisecond * 100
 
 type LockStatus map[string]Lock;
 
@@ -16,31 +21,115 @@ type Server struct {
 	Id                  string
 	Version             string
 	Testing             bool
+	Config              *Config
+	// nil if TLS isn't configured
+	TLS                 *TLSFiles
 	lockStatus          LockStatus
 	LockManager         *LockManager
 	RelayManager        *RelayManager
-	clientPort          int
 	statusMutex         sync.Mutex
 	listeningForClients bool
+	clientSocket        net.Listener
+	draining            bool
+	stopped             chan bool
+	clientMutex         sync.Mutex
+	clientsConnected    int
+	clientsTotal        uint64
 }
 
 func (s *Server) GetRelayAddresses() []string {
-	return []string{"localhost:20000", "localhost:20001", "localhost:20002", "localhost:20003"}
+	return s.Config.Peers
 }
 
-func NewServer() *Server {
+func NewServer(config *Config) *Server {
 	s := Server{}
+	s.Config = config
+	s.Id = config.Id
+	s.Version = config.Version
+	s.Testing = config.Testing
 	s.lockStatus = LockStatus{}
-	s.LockManager = NewLockManager()
-	// TODO: Ensure settings are loaded before this line
+	s.LockManager = loadLockManager(config)
+	s.TLS = loadTLS(config)
+
+	if config.ClusterKey == "" && s.TLS == nil {
+		log.Println("No cluster_key or tls_cert set, anybody who can reach the relay port can join the cluster")
+	}
+
 	s.RelayManager = NewRelayManager(&s)
 	s.statusMutex = sync.Mutex{}
 	s.listeningForClients = false
+	s.draining = false
+	s.stopped = make(chan bool)
+	s.clientMutex = sync.Mutex{}
 
 	return &s
 }
 
+// Pick up the fences and locks we had before restarting
+func loadLockManager(config *Config) *LockManager {
+	if config.DataDir == "" {
+		log.Println("No data_dir set, fences and locks will only survive restarts if other servers remember them")
+		return NewLockManager()
+	}
+
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		log.Fatalf("Failed to create data_dir %s: %s", config.DataDir, err)
+	}
+
+	path := filepath.Join(config.DataDir, "fence")
+	fences, err := LoadFenceCounter(path)
+
+	if err != nil {
+		log.Fatalf("Failed to load fences from %s: %s", path, err)
+	}
+
+	wal, err := OpenLockLog(config.DataDir, config.WalSync, config.SnapshotInterval.Duration)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	locks, err := wal.Replay()
+
+	if err != nil {
+		log.Fatalf("Failed to replay locks from %s: %s", config.DataDir, err)
+	}
+
+	return NewDurableLockManager(fences, wal, locks)
+}
+
+func loadTLS(config *Config) *TLSFiles {
+	files, err := LoadTLS(config)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if files == nil {
+		log.Println("No tls_cert set, client and relay connections are not encrypted")
+	}
+
+	return files
+}
+
+// Pick up renewed certificates, for the connections made from now on
+func (s *Server) ReloadTLS() {
+	if s.TLS == nil {
+		return
+	}
+
+	if err := s.TLS.Reload(); err != nil {
+		log.Printf("Failed to reload TLS certificates, keeping the old ones: %s", err)
+		return
+	}
+
+	log.Println("Reloaded TLS certificates")
+}
+
 func startClient(server *Server, connection net.Conn) {
+	server.clientConnected()
+	defer server.clientDisconnected()
+
 	c := NewClient(server, connection)
 	c.Run()
 }
@@ -50,19 +139,38 @@ func startRelay(server *Server, connection net.Conn) {
 	r.Run()
 }
 
-func (s *Server) clientListener(port int) {
-	server, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+func (s *Server) clientListener(addr string) {
+	server, err := net.Listen("tcp", addr)
 
-	log.Printf("Started listening for client connections on TCP port %d", port)
+	log.Printf("Started listening for client connections on %s", addr)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if s.TLS != nil {
+		server = tls.NewListener(server, s.TLS.ClientListenerConfig())
+	}
+
+	s.statusMutex.Lock()
+	s.clientSocket = server
+	draining := s.draining
+	s.statusMutex.Unlock()
+
+	if draining {
+		// Started draining while we were opening the socket
+		server.Close()
+		return
+	}
+
 	for {
 		conn, err := server.Accept()
 
 		if err != nil {
+			if s.IsDraining() {
+				log.Println("Stopped listening for client connections")
+				return
+			}
 			log.Fatal(err)
 		}
 
@@ -70,15 +178,19 @@ func (s *Server) clientListener(port int) {
 	}
 }
 
-func (s *Server) relayListener(port int) {
-	server, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+func (s *Server) relayListener(addr string) {
+	server, err := net.Listen("tcp", addr)
 
-	log.Printf("Started listening for relay connections on TCP port %d", port)
+	log.Printf("Started listening for relay connections on %s", addr)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if s.TLS != nil {
+		server = tls.NewListener(server, s.TLS.RelayListenerConfig())
+	}
+
 	for {
 		conn, err := server.Accept()
 
@@ -94,48 +206,169 @@ func (s *Server) RelayManagerReady(ready bool) {
 	s.statusMutex.Lock()
 	defer s.statusMutex.Unlock()
 
-	if ready && !s.listeningForClients {
+	if ready && !s.listeningForClients && !s.draining {
 		s.listeningForClients = true
 
 		log.Println("RelayManager is ready and we can start listening for clients")
-		go s.clientListener(s.clientPort)
+		go s.clientListener(s.Config.ClientAddress)
 	}
 }
 
-func (s *Server) DoLock(clientId string, name string, timeout time.Duration) *Lock {
-	// TODO: Retry until successful
+// Get the lock through the relay quorum. With wait set we park in the local
+// queue until the lock is free and keep retrying until we get it, otherwise
+// nil is returned as soon as it's clear we can't have it. The mode can ask
+// for a reader of a shared lock or a permit of a semaphore instead. Draining
+// servers don't give out locks.
+//
+// Waiting for an exclusive lock first gets the client in line for it across
+// the cluster, so the clients get it in the order they started waiting. With
+// maxWait set the client gives up its place after waiting that long, and nil
+// is returned.
+func (s *Server) DoLock(clientId string, name string, timeout time.Duration, wait bool, maxWait time.Duration, mode messages.LockMode) *Lock {
+	var ticket uint64
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	defer func() {
+		if ticket != 0 {
+			close(stop)
+			<-stopped
+		}
+		s.leaveLine(clientId, name, ticket)
+	}()
+
+	var deadline time.Time
+	if maxWait > 0 {
+		deadline = time.Now().Add(maxWait)
+	}
+
+	for {
+		if s.IsDraining() {
+			return nil
+		}
+
+		// Nobody waits without a ticket, just tries
+		park := wait && (ticket != 0 || mode.Shared)
+		lock := s.attemptLock(clientId, name, timeout, park, deadline, mode)
+
+		if lock != nil || !wait {
+			return lock
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			log.Printf("%s gave up waiting for %s", clientId, name)
+			return nil
+		}
+
+		if ticket == 0 && !mode.Shared {
+			ticket = s.getInLine(clientId, name)
+			go s.stayInLine(clientId, name, ticket, stop, stopped)
+			continue
+		}
+
+		if ticket != 0 {
+			// In case a relay lost track of us, e.g. after reconnecting
+			s.RelayManager.QueueLock(name, ticket)
+		}
 
+		// Somebody else in the cluster got there first, back off a bit so
+		// competing servers don't keep proposing in lockstep
+		delay := RETRY_DELAY + time.Duration(rand.Int63n(int64(RETRY_DELAY)))
+		if !deadline.IsZero() && time.Until(deadline) < delay {
+			delay = time.Until(deadline)
+		}
+		time.Sleep(delay)
+	}
+}
+
+func (s *Server) attemptLock(clientId string, name string, timeout time.Duration, wait bool, deadline time.Time, mode messages.LockMode) *Lock {
 	start := time.Now()
+
 	// Establish a temporary lock locally
-	lock := s.LockManager.TryGet(clientId, name, TEMP_TIMEOUT)
+	var lock *Lock
+	prepareTimeout := s.Config.PrepareTimeout.Duration
+	if wait && mode.Permits > 0 {
+		lock = s.LockManager.GetPermit(clientId, name, mode.Permits, prepareTimeout)
+	} else if wait && mode.Shared {
+		lock = s.LockManager.GetShared(clientId, name, prepareTimeout)
+	} else if wait && !deadline.IsZero() {
+		lock = s.LockManager.GetLockWithin(clientId, name, prepareTimeout, time.Until(deadline))
+	} else if wait {
+		lock = s.LockManager.GetLock(clientId, name, prepareTimeout)
+	} else if mode.Permits > 0 {
+		lock = s.LockManager.TryPermit(clientId, name, -1, mode.Permits, prepareTimeout)
+	} else if mode.Shared {
+		lock = s.LockManager.TryShared(clientId, name, prepareTimeout)
+	} else {
+		lock = s.LockManager.TryGet(clientId, name, prepareTimeout)
+	}
 
 	if lock == nil {
 		return nil
 	}
 
-	ok := s.RelayManager.ProposeLock(name)
-	if !ok {
-		s.LockManager.Release(clientId, name)
+	// The other servers have to agree on the permit we got here
+	mode.Slot = lock.Slot
+
+	// The session may be asking for a lock it holds already, which failing
+	// here shouldn't take away from it
+	fresh := lock.Prelim
+
+	if s.IsDraining() {
+		// We may have been waiting in the queue for a long time
+		if fresh {
+			s.LockManager.Release(clientId, name)
+		}
 		return nil
 	}
 
-	lock.MakeValidFor(timeout)
+	// The fence of the temporary lock stays the same while we extend our hold
+	// between the rounds, if the lock times out on us meanwhile we've lost it
+	prelimFence := lock.Fence
+	fence := prelimFence
+
+	ok, seen := s.RelayManager.ProposeLock(name, mode)
+	if ok {
+		lock = s.LockManager.Refresh(clientId, name, prelimFence, timeout)
+		ok = lock != nil
+	}
 
-	ok = s.RelayManager.SchedLock(name)
 	if !ok {
-		s.LockManager.Release(clientId, name)
+		s.abortLock(clientId, name, fence, fresh)
 		return nil
 	}
 
-	lock.MakeValidFor(timeout)
+	// A quorum has told us the highest fence they've seen, and any earlier
+	// holder of the lock got a quorum to agree on theirs, so going above all
+	// of them keeps the fences of the lock increasing
+	fence = FormatFence(s.LockManager.NextFence(seen))
+
+	ok = s.RelayManager.SchedLock(name, mode)
+	if ok {
+		lock = s.LockManager.Refresh(clientId, name, prelimFence, timeout)
+		ok = lock != nil
+	}
 
-	ok = s.RelayManager.CommLock(name, timeout)
 	if !ok {
-		s.LockManager.Release(clientId, name)
+		s.abortLock(clientId, name, fence, fresh)
 		return nil
 	}
 
-	lock.MakeValidFor(timeout)
+	ok = s.RelayManager.CommLock(name, timeout, fence, clientId, mode)
+	if ok && mode.Permits > 0 {
+		lock = s.LockManager.CommitPermit(clientId, clientId, name, mode.Slot, mode.Permits, fence, timeout)
+		ok = lock != nil
+	} else if ok && mode.Shared {
+		lock = s.LockManager.CommitShared(clientId, clientId, name, fence, timeout)
+		ok = lock != nil
+	} else if ok {
+		lock = s.LockManager.Commit(clientId, clientId, name, fence, timeout)
+		ok = lock != nil
+	}
+
+	if !ok {
+		s.abortLock(clientId, name, fence, fresh)
+		return nil
+	}
 
 	duration := time.Since(start)
 
@@ -144,9 +377,302 @@ func (s *Server) DoLock(clientId string, name string, timeout time.Duration) *Lo
 	return lock
 }
 
-func (s *Server) Run(clientPort int, relayPort int) {
-	go s.LockManager.Run()
+// Get all the locks at once through a single quorum round for the whole set,
+// or none of them. Otherwise like DoLock with wait set, returns nil only if
+// the server is draining. The locks come back in the order of names.
+func (s *Server) DoLocks(clientId string, names []string, timeout time.Duration) []*Lock {
+	for {
+		if s.IsDraining() {
+			return nil
+		}
+
+		locks := s.attemptLocks(clientId, names, timeout)
+
+		if locks != nil {
+			return locks
+		}
+
+		delay := RETRY_DELAY + time.Duration(rand.Int63n(int64(RETRY_DELAY)))
+		time.Sleep(delay)
+	}
+}
+
+func (s *Server) attemptLocks(clientId string, names []string, timeout time.Duration) []*Lock {
+	start := time.Now()
+
+	// Wait until we can hold all of them here
+	locks := s.LockManager.GetLocks(clientId, names, s.Config.PrepareTimeout.Duration)
+
+	// Only the ones we didn't hold already are rolled back if this fails
+	fresh := []bool{}
+	for _, lock := range locks {
+		fresh = append(fresh, lock.Prelim)
+	}
+
+	if s.IsDraining() {
+		s.abortLocks(clientId, names, nil, fresh)
+		return nil
+	}
+
+	prelimFences := []string{}
+	for _, lock := range locks {
+		prelimFences = append(prelimFences, lock.Fence)
+	}
+
+	ok, seen := s.RelayManager.ProposeLocks(names)
+	if ok {
+		ok = s.refreshLocks(clientId, names, prelimFences, timeout)
+	}
+
+	if !ok {
+		s.abortLocks(clientId, names, prelimFences, fresh)
+		return nil
+	}
+
+	// Every lock gets a fence above anything the quorum has seen, like in
+	// attemptLock
+	fences := []string{}
+	for range names {
+		fences = append(fences, FormatFence(s.LockManager.NextFence(seen)))
+	}
+
+	ok = s.RelayManager.SchedLocks(names)
+	if ok {
+		ok = s.refreshLocks(clientId, names, prelimFences, timeout)
+	}
+
+	if ok && s.RelayManager.CommLocks(names, timeout, fences, clientId) {
+		locks = s.LockManager.CommitLocks(clientId, clientId, names, fences, timeout)
+		ok = locks != nil
+	} else {
+		ok = false
+	}
+
+	if !ok {
+		s.abortLocks(clientId, names, fences, fresh)
+		return nil
+	}
+
+	duration := time.Since(start)
+
+	log.Printf("Locked %v in %f s", names, float32(duration) / float32(time.Second))
+
+	return locks
+}
+
+// Extend our holds on the locks between the rounds, false if any was lost
+func (s *Server) refreshLocks(clientId string, names []string, fences []string, timeout time.Duration) bool {
+	for i, name := range names {
+		if s.LockManager.Refresh(clientId, name, fences[i], timeout) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Roll back a failed attempt at several locks, fences can be nil if we
+// haven't asked the relays yet. Only the fresh ones were taken for it.
+func (s *Server) abortLocks(clientId string, names []string, fences []string, fresh []bool) {
+	for i, name := range names {
+		if !fresh[i] {
+			continue
+		}
+
+		s.LockManager.Release(clientId, name)
+
+		if fences != nil {
+			s.RelayManager.AbortLock(name, fences[i])
+		}
+	}
+}
+
+// The permit count of semaphore name, the one the client asked for unless
+// it's configured. Returns 0 if neither knows or they don't agree.
+func (s *Server) Permits(name string, asked int) int {
+	configured := s.Config.Semaphores[name]
+
+	if configured > 0 && asked > 0 && configured != asked {
+		return 0
+	}
+
+	if configured > 0 {
+		return configured
+	}
+
+	return asked
+}
+
+// Get a ticket for the lock that's higher than any fence or ticket this
+// server knows of, and let everybody know we're in line with it
+func (s *Server) getInLine(clientId string, name string) uint64 {
+	ticket := s.LockManager.NextFence(0)
+
+	s.LockManager.Enqueue(clientId, name, ticket)
+	s.RelayManager.QueueLock(name, ticket)
+
+	return ticket
+}
+
+// Keep queueing the ticket so it doesn't run out while we wait, until stop is
+// closed. Closes stopped when done, so the DEQUEUE can't overtake a QUEUE.
+func (s *Server) stayInLine(clientId string, name string, ticket uint64, stop chan bool, stopped chan bool) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(s.LockManager.TicketTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.LockManager.Enqueue(clientId, name, ticket)
+			s.RelayManager.QueueLock(name, ticket)
+		}
+	}
+}
+
+// Get out of line for the lock, whether we got it or gave up on it
+func (s *Server) leaveLine(clientId string, name string, ticket uint64) {
+	if ticket == 0 {
+		return
+	}
+
+	s.LockManager.Dequeue(clientId, name, ticket)
+	s.RelayManager.DequeueLock(name, ticket)
+}
+
+// Roll back a failed attempt, here and on the relays that already agreed.
+// A lock that wasn't fresh was held before the attempt and is kept.
+func (s *Server) abortLock(clientId string, name string, fence string, fresh bool) {
+	if !fresh {
+		return
+	}
+
+	s.LockManager.Release(clientId, name)
+	s.RelayManager.AbortLock(name, fence)
+}
+
+// Extend a lock held by clientId, the fence has to match the one we gave out
+// and the new expiry needs to reach a quorum. Returns nil if the lock is lost.
+//
+// A lock given out through another server can be refreshed too, as long as
+// the fence matches and it was given to the same session. The lock is then
+// held through this server.
+func (s *Server) DoRefresh(clientId string, name string, fence string, timeout time.Duration) *Lock {
+	hold := s.LockManager.FindHold(name, fence)
+
+	if hold == nil || hold.Session != clientId {
+		return nil
+	}
+
+	ok := s.RelayManager.RefreshLock(name, fence, clientId, timeout)
+	if !ok {
+		return nil
+	}
+
+	return s.LockManager.Adopt(clientId, clientId, name, fence, timeout)
+}
+
+// Release a lock held by clientId here and on the other servers, so whoever
+// is waiting for it anywhere in the cluster gets it right away. The fence
+// picks the hold to release, "" releases whatever clientId holds. Returns
+// false if clientId didn't hold the lock.
+func (s *Server) DoRelease(clientId string, name string, fence string) bool {
+	hold := s.LockManager.ReleaseHold(clientId, clientId, name, fence)
+
+	if hold == nil {
+		return false
+	}
+
+	// Whoever doesn't hear about it lets the lock expire on its own
+	s.RelayManager.ReleaseLock(name, hold.Fence, clientId)
+
+	return true
+}
+
+// Check who has the lock, returns the fence or "" if it's not engaged. When
+// asking the cluster the lock counts as engaged only if a quorum says so.
+func (s *Server) DoIs(name string, cluster bool) string {
+	fence := s.LockManager.IsLocked(name)
+
+	if !cluster {
+		return fence
+	}
+
+	relayFence, engaged := s.RelayManager.QueryLock(name)
+
+	if fence != "" {
+		// Our own view counts as a vote, and we trust our own fence
+		engaged += 1
+	} else {
+		fence = relayFence
+	}
+
+	if engaged < s.RelayManager.QuorumSize() {
+		return ""
+	}
+
+	return fence
+}
+
+func (s *Server) IsDraining() bool {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	return s.draining
+}
+
+// Stop taking in new clients and lock requests, let the other servers know
+// we're leaving, and wait until the locks our clients hold are released or
+// expire, up to the configured drain timeout. Run returns once done.
+func (s *Server) Drain() {
+	s.statusMutex.Lock()
+	if s.draining {
+		s.statusMutex.Unlock()
+		return
+	}
+	s.draining = true
+	socket := s.clientSocket
+	s.statusMutex.Unlock()
+
+	log.Println("Draining, no longer accepting new clients or lock requests")
+
+	if socket != nil {
+		socket.Close()
+	}
+
+	s.RelayManager.Leave()
+
+	deadline := time.Now().Add(s.Config.DrainTimeout.Duration)
+	lastHeld := -1
+	for {
+		held := s.LockManager.GetStats().HeldLocal
+
+		if held == 0 {
+			log.Println("All locks released, done draining")
+			break
+		}
+
+		if time.Now().After(deadline) {
+			log.Printf("Drain timeout reached with %d locks still held", held)
+			break
+		}
+
+		if held != lastHeld {
+			log.Printf("Waiting for %d locks to be released", held)
+			lastHeld = held
+		}
+
+		time.Sleep(DRAIN_CHECK_INTERVAL)
+	}
+
+	close(s.stopped)
+}
+
+func (s *Server) Run() {
 	go s.RelayManager.Run()
-	s.clientPort = clientPort
-	s.relayListener(relayPort)
+	go s.relayListener(s.Config.RelayAddress)
+	<-s.stopped
 }
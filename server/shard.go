@@ -0,0 +1,646 @@
+package server
+
+import (
+	"github.com/aristanetworks/goarista/monotime"
+	"time"
+	"log"
+)
+
+// One part of the LockManager's locks, served by a goroutine of its own. All
+// the requests for a lock go to the same shard, so the shard's goroutine is
+// the only one touching them.
+type lockShard struct {
+	requestChan chan *LockRequest
+	quitChan    chan bool
+	locks       Locks
+	fences      *FenceCounter
+	wal         *LockLog
+	// When writers last had to wait for a lock, see shared.go
+	writersWaiting map[string]uint64
+	// When to look at the locks next, see expiry.go
+	expiries    expiryHeap
+	scheduled   map[string]uint64
+	// When the timer goes off, 0 if it's stopped
+	timerAt     uint64
+	// Requests waiting for each lock, in the order they came in. Requests
+	// for several locks wait for all of them.
+	waiters     LockQueue
+	queued      int
+	// Who's in line for each lock across the cluster, see tickets.go
+	tickets     map[string]waitLine
+	granted     uint64
+	expired     uint64
+	released    uint64
+}
+
+func newLockShard(fences *FenceCounter, wal *LockLog, locks Locks) *lockShard {
+	sh := lockShard{}
+
+	sh.locks = locks
+	sh.fences = fences
+	sh.wal = wal
+	sh.writersWaiting = map[string]uint64{}
+	sh.expiries = expiryHeap{}
+	sh.scheduled = map[string]uint64{}
+	sh.waiters = LockQueue{}
+	sh.tickets = map[string]waitLine{}
+
+	for name := range locks {
+		sh.schedule(name)
+	}
+
+	sh.requestChan = make(chan *LockRequest)
+	sh.quitChan = make(chan bool)
+
+	return &sh
+}
+
+// A copy of the locks that the lock log can read while we go on
+func (sh *lockShard) copyLocks() Locks {
+	locks := Locks{}
+
+	for name, lock := range sh.locks {
+		held := *lock
+		held.Readers = nil
+
+		for _, reader := range lock.Readers {
+			copied := *reader
+			held.Readers = append(held.Readers, &copied)
+		}
+
+		locks[name] = &held
+	}
+
+	return locks
+}
+
+// A new hold for the receiver, with the fence it was committed with
+func (sh *lockShard) newHold(receiver *LockRequest) *Lock {
+	lock := Lock{}
+
+	// Use monotonic clocks, time.Now() can jump around
+	lock.Fence = receiver.Fence
+	if lock.Fence == "" {
+		// Preliminary holds get a fence of their own until committed
+		lock.Fence = FormatFence(sh.fences.Next(0))
+	} else {
+		sh.fences.Observe(ParseFence(lock.Fence))
+	}
+	lock.ClientId = receiver.ClientId
+	lock.Session = receiver.Session
+	if lock.Session == "" {
+		lock.Session = receiver.ClientId
+	}
+	lock.Prelim = receiver.Type != TYPE_COMMIT
+	lock.Shared = receiver.Shared
+	lock.Permits = receiver.Permits
+	lock.Slot = receiver.Slot
+	lock.MakeValidFor(receiver.Timeout)
+
+	sh.granted += 1
+
+	return &lock
+}
+
+func (sh *lockShard) giveLock(receiver *LockRequest) {
+	receiver.Done <- sh.putLock(receiver)
+}
+
+// Take the free lock for the receiver
+func (sh *lockShard) putLock(receiver *LockRequest) *Lock {
+	lock := sh.newHold(receiver)
+
+	sh.locks[receiver.Name] = lock
+	delete(sh.writersWaiting, receiver.Name)
+
+	if !lock.Prelim {
+		sh.wal.Grant(receiver.Name, lock)
+	}
+
+	if DEBUG {
+		log.Printf("Giving lock %s away until %d", receiver.Name, lock.Expires)
+	}
+
+	return lock
+}
+
+// Extend the lock the requester already holds
+func (sh *lockShard) reestablish(name string, timeout time.Duration) *Lock {
+	lock := sh.locks[name]
+	lock.MakeValidFor(timeout)
+	if !lock.Prelim {
+		sh.wal.Refresh(name, lock)
+	}
+
+	return lock
+}
+
+// Turn the requester's hold on the lock into a firm one with fence, given to
+// session
+func (sh *lockShard) commitHeld(name string, fence string, session string, timeout time.Duration) *Lock {
+	lock := sh.locks[name]
+	lock.Fence = fence
+	lock.Session = session
+	lock.Prelim = false
+	lock.MakeValidFor(timeout)
+	sh.fences.Observe(ParseFence(lock.Fence))
+	sh.wal.Grant(name, lock)
+
+	return lock
+}
+
+func (sh *lockShard) isLocked(name string) (clientId string) {
+	clientId = ""
+	lock, ok := sh.locks[name]
+	if ok && lock.Expires > monotime.Now() {
+		clientId = lock.ClientId
+	}
+	return
+}
+
+// Release the hold clientId has for session, "" for any session
+func (sh *lockShard) release(clientId string, session string, name string, fence string) *Lock {
+	var released *Lock
+	held, ok := sh.locks[name]
+
+	if ok && held.Shared {
+		reader := held.findReader(clientId, fence)
+		if reader == nil || (session != "" && reader.Session != session) {
+			return nil
+		}
+
+		return sh.releaseReader(name, held, reader)
+	}
+
+	if ok && held.ClientId == clientId && (fence == "" || held.Fence == fence) && (session == "" || held.Session == session) {
+		if DEBUG {
+			log.Printf("Lock %s was released.", name)
+		}
+		delete(sh.locks, name)
+		sh.released += 1
+		released = held
+	}
+
+	if released != nil && !released.Prelim {
+		sh.wal.Release(name, released.Fence)
+	}
+
+	return released
+}
+
+// Wait for the locks of the request to free up
+func (sh *lockShard) enqueue(request *LockRequest) {
+	for _, name := range requestNames(request) {
+		sh.waiters[name] = append(sh.waiters[name], request)
+	}
+
+	sh.queued += 1
+}
+
+// Give the lock name to whoever is waiting for it and can have it now
+func (sh *lockShard) wake(name string) {
+	requests, ok := sh.waiters[name]
+
+	if !ok {
+		return
+	}
+
+	waiting := []*LockRequest{}
+
+	for _, request := range requests {
+		if !sh.serve(request) {
+			waiting = append(waiting, request)
+			continue
+		}
+
+		sh.queued -= 1
+
+		for _, other := range requestNames(request) {
+			if other != name {
+				sh.removeWaiter(other, request)
+			}
+			sh.schedule(other)
+		}
+	}
+
+	if len(waiting) == 0 {
+		delete(sh.waiters, name)
+	} else {
+		sh.waiters[name] = waiting
+	}
+}
+
+// Try to give a waiting request what it asked for
+func (sh *lockShard) serve(request *LockRequest) bool {
+	if len(request.Names) > 0 {
+		return sh.takeAll(request)
+	}
+
+	if request.Type == TYPE_WATCH {
+		if !sh.watched(request) {
+			return false
+		}
+
+		request.Done <- nil
+		return true
+	}
+
+	if request.Shared {
+		return sh.joinShared(request)
+	}
+
+	if sh.isLocked(request.Name) != "" || sh.ahead(request.Name, request.ClientId) {
+		return false
+	}
+
+	if DEBUG {
+		log.Printf("Lock %s is free, giving it to the next one in queue.", request.Name)
+	}
+	sh.giveLock(request)
+
+	return true
+}
+
+// Whether the lock the watch request waits for is free for it, or held by it
+func (sh *lockShard) watched(request *LockRequest) bool {
+	clientId := sh.isLocked(request.Name)
+
+	if clientId == "" {
+		return !sh.ahead(request.Name, request.ClientId)
+	}
+
+	return clientId == request.ClientId
+}
+
+func (sh *lockShard) removeWaiter(name string, request *LockRequest) {
+	waiting := []*LockRequest{}
+
+	for _, r := range sh.waiters[name] {
+		if r != request {
+			waiting = append(waiting, r)
+		}
+	}
+
+	if len(waiting) == 0 {
+		delete(sh.waiters, name)
+	} else {
+		sh.waiters[name] = waiting
+	}
+}
+
+func (sh *lockShard) handleGet(clientId string, request *LockRequest) (result bool) {
+	result = false
+	if clientId == "" && sh.ahead(request.Name, request.ClientId) {
+		if DEBUG {
+			log.Printf("Lock %s is free, but others are in line for it before %s.", request.Name, request.ClientId)
+		}
+	} else if clientId == "" {
+		if DEBUG {
+			log.Printf("Lock %s was free, so giving it as requested.", request.Name)
+		}
+
+		sh.giveLock(request)
+		result = true
+	} else if clientId == request.ClientId {
+		if DEBUG {
+			log.Printf("Client %s asked to re-establish lock %s", clientId, request.Name)
+		}
+
+		request.Done <- sh.reestablish(request.Name, request.Timeout)
+		result = true
+	}
+
+	return
+}
+
+func (sh *lockShard) handleTry(clientId string, request *LockRequest) {
+	if clientId == "" && sh.ahead(request.Name, request.ClientId) {
+		if DEBUG {
+			log.Printf("Lock %s is free, but others are in line for it before %s.", request.Name, request.ClientId)
+		}
+		request.Done <- nil
+	} else if clientId == "" {
+		if DEBUG {
+			log.Printf("Lock %s was free, so giving it as requested.", request.Name)
+		}
+
+		sh.giveLock(request)
+	} else if clientId == request.ClientId {
+		if DEBUG {
+			log.Printf("Client %s asked to re-establish lock %s", clientId, request.Name)
+		}
+
+		request.Done <- sh.reestablish(request.Name, request.Timeout)
+	} else {
+		if DEBUG {
+			log.Printf("Lock %s was taken, and request did not want to wait for it.", request.Name)
+		}
+		sh.turnedAwayWriter(request.Name)
+		request.Done <- nil
+	}
+}
+
+func (sh *lockShard) handleRefresh(clientId string, request *LockRequest) {
+	if clientId == SHARED_HOLDER {
+		sh.handleRefreshShared(request)
+		return
+	}
+
+	if clientId == "" || clientId != request.ClientId {
+		if DEBUG {
+			log.Printf("Client %s tried to refresh lock %s it does not hold.", request.ClientId, request.Name)
+		}
+		request.Done <- nil
+		return
+	}
+
+	lock := sh.locks[request.Name]
+
+	if request.Fence != "" && request.Fence != lock.Fence {
+		if DEBUG {
+			log.Printf("Client %s tried to refresh lock %s with stale fence %s.", request.ClientId, request.Name, request.Fence)
+		}
+		request.Done <- nil
+		return
+	}
+
+	lock.MakeValidFor(request.Timeout)
+	if !lock.Prelim {
+		sh.wal.Refresh(request.Name, lock)
+	}
+	request.Done <- lock
+}
+
+func (sh *lockShard) getStats() LockStats {
+	stats := LockStats{}
+	stats.Granted = sh.granted
+	stats.Expired = sh.expired
+	stats.Released = sh.released
+
+	now := monotime.Now()
+	for _, lock := range sh.locks {
+		if lock.Expires > now {
+			stats.Held += 1
+
+			for _, hold := range lock.holds() {
+				if hold.Expires > now && !isRelayId(hold.ClientId) {
+					stats.HeldLocal += 1
+					break
+				}
+			}
+		}
+	}
+
+	stats.Queued = sh.queued
+
+	return stats
+}
+
+func (sh *lockShard) handleCommit(clientId string, request *LockRequest) {
+	if clientId == "" {
+		sh.giveLock(request)
+	} else if clientId == request.ClientId {
+		request.Done <- sh.commitHeld(request.Name, request.Fence, request.Session, request.Timeout)
+	} else {
+		if DEBUG {
+			log.Printf("Lock %s is held by %s, can't commit it for %s.", request.Name, clientId, request.ClientId)
+		}
+		request.Done <- nil
+	}
+}
+
+func (sh *lockShard) handleAdopt(clientId string, request *LockRequest) {
+	if clientId == SHARED_HOLDER {
+		sh.handleAdoptShared(request)
+		return
+	}
+
+	lock := sh.locks[request.Name]
+
+	if clientId == "" || lock.Fence != request.Fence || lock.Session != request.Session {
+		if DEBUG {
+			log.Printf("Client %s can't adopt lock %s with fence %s for %s.", request.ClientId, request.Name, request.Fence, request.Session)
+		}
+		request.Done <- nil
+		return
+	}
+
+	if DEBUG && clientId != request.ClientId {
+		log.Printf("Lock %s moves from %s to %s.", request.Name, clientId, request.ClientId)
+	}
+
+	lock.ClientId = request.ClientId
+	lock.Prelim = false
+	lock.MakeValidFor(request.Timeout)
+	sh.wal.Grant(request.Name, lock)
+	request.Done <- lock
+}
+
+func (sh *lockShard) handleAbort(clientId string, request *LockRequest) *Lock {
+	if clientId == SHARED_HOLDER {
+		return sh.handleAbortShared(request)
+	}
+
+	if clientId == "" || clientId != request.ClientId {
+		return nil
+	}
+
+	lock := sh.locks[request.Name]
+
+	if !lock.Prelim && lock.Fence != request.Fence {
+		if DEBUG {
+			log.Printf("Not aborting lock %s, it was committed with another fence.", request.Name)
+		}
+		return nil
+	}
+
+	return sh.release(request.ClientId, "", request.Name, "")
+}
+
+func (sh *lockShard) getSnapshot() []LockSnapshot {
+	snapshot := []LockSnapshot{}
+
+	now := monotime.Now()
+	for name, lock := range sh.locks {
+		for _, hold := range lock.holds() {
+			if hold.Expires > now {
+				snapshot = append(snapshot, LockSnapshot{
+					name,
+					hold.ClientId,
+					hold.Session,
+					hold.Fence,
+					time.Duration(hold.Expires - now),
+					hold.Shared,
+					hold.Permits,
+					hold.Slot,
+				})
+			}
+		}
+	}
+
+	return snapshot
+}
+
+// The hold on the lock with the request's fence
+func (sh *lockShard) findHold(clientId string, request *LockRequest) *Lock {
+	if clientId == "" {
+		return nil
+	}
+
+	now := monotime.Now()
+	for _, hold := range sh.locks[request.Name].holds() {
+		if hold.Fence == request.Fence && hold.Expires > now {
+			return hold
+		}
+	}
+
+	return nil
+}
+
+func (sh *lockShard) handleMerge(clientId string, request *LockRequest) {
+	sh.fences.Observe(ParseFence(request.Fence))
+
+	if clientId == "" {
+		lock := Lock{}
+		lock.Fence = request.Fence
+		lock.ClientId = request.ClientId
+		lock.Session = request.Session
+		lock.MakeValidFor(request.Timeout)
+
+		sh.locks[request.Name] = &lock
+		sh.wal.Grant(request.Name, &lock)
+
+		if DEBUG {
+			log.Printf("Merged lock %s held by %s until %d", request.Name, lock.ClientId, lock.Expires)
+		}
+	} else if clientId == request.ClientId {
+		lock := sh.locks[request.Name]
+		expires := monotime.Now() + uint64(request.Timeout)
+
+		if lock.Fence == request.Fence && expires > lock.Expires {
+			lock.Expires = expires
+			sh.wal.Refresh(request.Name, lock)
+		}
+	}
+
+	request.Done <- nil
+}
+
+func (sh *lockShard) Run() {
+	// Nothing is due until something gets scheduled
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		due := sh.resetTimer(timer)
+
+		select {
+		case request := <-sh.requestChan:
+			clientId := sh.isLocked(request.Name)
+
+			if request.Type == TYPE_GET && len(request.Names) > 0 {
+				if !sh.takeAll(request) {
+					if DEBUG {
+						log.Printf("Locks %v are not all free, and request wants to wait for them.", request.Names)
+					}
+					sh.enqueue(request)
+				}
+			} else if request.Type == TYPE_TRY && len(request.Names) > 0 {
+				if !sh.takeAll(request) {
+					request.Holds <- nil
+				}
+			} else if request.Type == TYPE_COMMIT && len(request.Names) > 0 {
+				if !sh.takeAll(request) {
+					request.Holds <- nil
+				}
+			} else if request.Type == TYPE_GET && request.Shared {
+				if !sh.joinShared(request) {
+					if DEBUG {
+						log.Printf("Lock %s can't be shared now, and request wants to wait for it.", request.Name)
+					}
+					sh.enqueue(request)
+				}
+			} else if request.Type == TYPE_GET {
+				if !sh.handleGet(clientId, request) {
+					if DEBUG {
+						log.Printf("Lock %s was taken, and request wants to wait for it.", request.Name)
+					}
+					sh.turnedAwayWriter(request.Name)
+					sh.enqueue(request)
+				}
+			} else if request.Type == TYPE_TRY && request.Shared {
+				if !sh.joinShared(request) {
+					request.Done <- nil
+				}
+			} else if request.Type == TYPE_TRY {
+				sh.handleTry(clientId, request)
+			} else if request.Type == TYPE_CHECK {
+				if clientId == "" {
+					request.Done <- nil
+				} else {
+					request.Done <- sh.locks[request.Name]
+				}
+			} else if request.Type == TYPE_STATS {
+				request.Stats <- sh.getStats()
+			} else if request.Type == TYPE_SNAPSHOT {
+				request.Snapshot <- sh.getSnapshot()
+			} else if request.Type == TYPE_FIND {
+				request.Done <- sh.findHold(clientId, request)
+			} else if request.Type == TYPE_MERGE && request.Shared {
+				sh.handleMergeShared(clientId, request)
+			} else if request.Type == TYPE_MERGE {
+				sh.handleMerge(clientId, request)
+			} else if request.Type == TYPE_COMMIT && request.Shared {
+				sh.handleCommitShared(clientId, request)
+			} else if request.Type == TYPE_COMMIT {
+				sh.handleCommit(clientId, request)
+			} else if request.Type == TYPE_ADOPT {
+				sh.handleAdopt(clientId, request)
+			} else if request.Type == TYPE_REFRESH {
+				sh.handleRefresh(clientId, request)
+			} else if request.Type == TYPE_WATCH {
+				if sh.watched(request) {
+					request.Done <- nil
+				} else {
+					sh.turnedAwayWriter(request.Name)
+					sh.enqueue(request)
+				}
+			} else if request.Type == TYPE_COPY {
+				request.Locks <- sh.copyLocks()
+			} else if request.Type == TYPE_ENQUEUE {
+				sh.addTicket(request.Name, request.ClientId, request.Ticket, request.Timeout)
+				request.Done <- nil
+			} else if request.Type == TYPE_DEQUEUE {
+				sh.handleDequeue(request)
+				request.Done <- nil
+			} else if request.Type == TYPE_LINE {
+				request.Line <- append(waitLine{}, sh.tickets[request.Name]...)
+			} else if request.Type == TYPE_RELEASE || request.Type == TYPE_ABORT {
+				var released *Lock
+				if request.Type == TYPE_ABORT {
+					released = sh.handleAbort(clientId, request)
+				} else if clientId != "" {
+					released = sh.release(request.ClientId, request.Session, request.Name, request.Fence)
+				}
+				request.Done <- released
+
+				if released != nil {
+					sh.wake(request.Name)
+				}
+			}
+
+			for _, name := range requestNames(request) {
+				if name != "" {
+					sh.schedule(name)
+				}
+			}
+
+		case <-due:
+			sh.timerAt = 0
+			sh.expireDue()
+
+		case <-sh.quitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package server
+
+import (
+	"github.com/aristanetworks/goarista/monotime"
+	"time"
+	"log"
+)
+
+// Shared locks can be held by any number of readers at once, but not while
+// somebody holds the lock exclusively. To exclusive requests a shared lock
+// looks like it's held by SHARED_HOLDER, the readers are kept in Readers and
+// each of them has a fence of its own.
+//
+// A steady stream of readers could keep a shared lock engaged forever, so
+// new readers are turned away for WRITER_WAIT every time a writer couldn't
+// get the lock. Readers that already hold the lock can still refresh it.
+const SHARED_HOLDER = "*"
+const WRITER_WAIT = time.Millisecond * 500
+
+// The holds on the lock, i.e. the readers of a shared lock or the lock itself
+func (l *Lock) holds() []*Lock {
+	if l.Shared {
+		return l.Readers
+	}
+
+	return []*Lock{l}
+}
+
+// Find the reader held by clientId with fence, "" matches any of either
+func (l *Lock) findReader(clientId string, fence string) *Lock {
+	for _, reader := range l.Readers {
+		if (clientId == "" || reader.ClientId == clientId) && (fence == "" || reader.Fence == fence) {
+			return reader
+		}
+	}
+
+	return nil
+}
+
+// Find the reader clientId got for a proposal that hasn't been committed,
+// for semaphores the one with the given permit slot unless it's -1
+func (l *Lock) prelimReader(clientId string, slot int) *Lock {
+	for _, reader := range l.Readers {
+		if reader.ClientId == clientId && reader.Prelim && (slot < 0 || reader.Slot == slot) {
+			return reader
+		}
+	}
+
+	return nil
+}
+
+func (l *Lock) removeReader(reader *Lock) {
+	readers := []*Lock{}
+
+	for _, r := range l.Readers {
+		if r != reader {
+			readers = append(readers, r)
+		}
+	}
+
+	l.Readers = readers
+}
+
+// The lock stays engaged as long as any of the readers holds it, and reports
+// the highest fence among them
+func (l *Lock) updateShared() {
+	var fence uint64
+	l.Expires = 0
+	l.Fence = ""
+
+	for _, reader := range l.Readers {
+		if reader.Expires > l.Expires {
+			l.Expires = reader.Expires
+		}
+
+		if ParseFence(reader.Fence) >= fence {
+			fence = ParseFence(reader.Fence)
+			l.Fence = reader.Fence
+		}
+	}
+}
+
+func newSharedLock() *Lock {
+	lock := Lock{}
+	lock.ClientId = SHARED_HOLDER
+	lock.Shared = true
+	lock.Readers = []*Lock{}
+
+	return &lock
+}
+
+// Put reader into the shared lock name in locks, replacing the one with the
+// same fence
+func (locks Locks) putReader(name string, reader *Lock) {
+	lock, ok := locks[name]
+	if !ok || !lock.Shared {
+		lock = newSemaphore(reader.Permits)
+		locks[name] = lock
+	}
+
+	if old := lock.findReader("", reader.Fence); old != nil {
+		lock.removeReader(old)
+	}
+
+	lock.Readers = append(lock.Readers, reader)
+	lock.updateShared()
+}
+
+// Remove the reader with fence from the shared lock name in locks
+func (locks Locks) dropReader(name string, fence string) {
+	lock, ok := locks[name]
+	if !ok || !lock.Shared {
+		return
+	}
+
+	if reader := lock.findReader("", fence); reader != nil {
+		lock.removeReader(reader)
+	}
+
+	if len(lock.Readers) == 0 {
+		delete(locks, name)
+	} else {
+		lock.updateShared()
+	}
+}
+
+func (sh *lockShard) turnedAwayWriter(name string) {
+	sh.writersWaiting[name] = monotime.Now() + uint64(WRITER_WAIT)
+	// Readers waiting here get their turn once this runs out
+	sh.schedule(name)
+}
+
+// Writers waiting for the lock here, or that had to wait for it a moment ago
+// here or elsewhere, hold back new readers
+func (sh *lockShard) writerWaiting(name string) bool {
+	if sh.writersWaiting[name] > monotime.Now() {
+		return true
+	}
+
+	for _, request := range sh.waiters[name] {
+		if !request.Shared {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Give the request a reader of the lock, or a permit of a semaphore, unless
+// it's held in another mode, a writer is waiting for it, or there are no
+// permits left. Returns false if the request didn't get it.
+func (sh *lockShard) joinShared(request *LockRequest) bool {
+	lock, ok := sh.locks[request.Name]
+	held := ok && lock.Expires > monotime.Now()
+
+	if held && (!lock.Shared || lock.Permits != request.Permits) {
+		return false
+	}
+
+	if held {
+		var reader *Lock
+		if isRelayId(request.ClientId) {
+			// Relays hold a reader for each lock given out through them,
+			// only the one for the proposal in progress is re-established
+			reader = lock.prelimReader(request.ClientId, request.Slot)
+		} else {
+			reader = lock.findReader(request.ClientId, "")
+		}
+
+		if reader != nil {
+			if DEBUG {
+				log.Printf("Client %s asked to re-establish reader of lock %s", request.ClientId, request.Name)
+			}
+
+			reader.MakeValidFor(request.Timeout)
+			lock.updateShared()
+			if !reader.Prelim {
+				sh.wal.Refresh(request.Name, reader)
+			}
+			request.Done <- reader
+			return true
+		}
+	}
+
+	if sh.writerWaiting(request.Name) || sh.ahead(request.Name, request.ClientId) {
+		if DEBUG {
+			log.Printf("A writer is waiting for lock %s, not letting more readers in.", request.Name)
+		}
+		return false
+	}
+
+	if !held {
+		lock = newSemaphore(request.Permits)
+	}
+
+	if lock.Permits > 0 {
+		slot := lock.freeSlot(request.Slot)
+
+		if slot < 0 {
+			if DEBUG {
+				log.Printf("No permits of semaphore %s left.", request.Name)
+			}
+			return false
+		}
+
+		request.Slot = slot
+	}
+
+	if !held {
+		sh.locks[request.Name] = lock
+	}
+
+	reader := sh.newHold(request)
+	sh.addReader(request.Name, lock, reader)
+
+	if DEBUG {
+		log.Printf("Sharing lock %s with %d readers until %d", request.Name, len(lock.Readers), reader.Expires)
+	}
+
+	request.Done <- reader
+	return true
+}
+
+func (sh *lockShard) addReader(name string, lock *Lock, reader *Lock) {
+	lock.Readers = append(lock.Readers, reader)
+	lock.updateShared()
+
+	if !reader.Prelim {
+		sh.wal.Grant(name, reader)
+	}
+}
+
+func (sh *lockShard) releaseReader(name string, lock *Lock, reader *Lock) *Lock {
+	lock.removeReader(reader)
+	sh.released += 1
+
+	if len(lock.Readers) == 0 {
+		delete(sh.locks, name)
+	} else {
+		lock.updateShared()
+	}
+
+	if !reader.Prelim {
+		sh.wal.Release(name, reader.Fence)
+	}
+
+	if DEBUG {
+		log.Printf("Reader of lock %s was released, %d left.", name, len(lock.Readers))
+	}
+
+	return reader
+}
+
+func (sh *lockShard) expireReaders(name string, lock *Lock, now uint64) {
+	for _, reader := range lock.Readers {
+		if reader.Expires <= now {
+			lock.removeReader(reader)
+			sh.expired += 1
+		}
+	}
+
+	if len(lock.Readers) == 0 {
+		if DEBUG {
+			log.Printf("Lock %s expired.", name)
+		}
+		delete(sh.locks, name)
+	} else {
+		lock.updateShared()
+	}
+}
+
+func (sh *lockShard) handleCommitShared(clientId string, request *LockRequest) {
+	lock := sh.locks[request.Name]
+
+	if clientId != "" && (clientId != SHARED_HOLDER || lock.Permits != request.Permits) {
+		if DEBUG {
+			log.Printf("Lock %s is held by %s, can't commit a reader for %s.", request.Name, clientId, request.ClientId)
+		}
+		request.Done <- nil
+		return
+	}
+
+	if clientId == "" {
+		lock = newSemaphore(request.Permits)
+		sh.locks[request.Name] = lock
+	}
+
+	reader := lock.findReader(request.ClientId, request.Fence)
+	if reader == nil {
+		reader = lock.prelimReader(request.ClientId, request.Slot)
+	}
+	if reader == nil && !isRelayId(request.ClientId) {
+		reader = lock.findReader(request.ClientId, "")
+	}
+
+	if reader == nil && lock.Permits > 0 && lock.freeSlot(request.Slot) < 0 {
+		if DEBUG {
+			log.Printf("Permit %d of semaphore %s is held by somebody else, can't commit it for %s.", request.Slot, request.Name, request.ClientId)
+		}
+		request.Done <- nil
+		return
+	}
+
+	if reader == nil {
+		// The hold we had timed out or was aborted by another proposal,
+		// but readers don't get in each other's way
+		reader = sh.newHold(request)
+		sh.addReader(request.Name, lock, reader)
+		request.Done <- reader
+		return
+	}
+
+	reader.Fence = request.Fence
+	reader.Session = request.Session
+	reader.Prelim = false
+	reader.MakeValidFor(request.Timeout)
+	lock.updateShared()
+	sh.fences.Observe(ParseFence(reader.Fence))
+	sh.wal.Grant(request.Name, reader)
+	request.Done <- reader
+}
+
+func (sh *lockShard) handleRefreshShared(request *LockRequest) {
+	lock := sh.locks[request.Name]
+	reader := lock.findReader(request.ClientId, request.Fence)
+
+	if reader == nil {
+		if DEBUG {
+			log.Printf("Client %s tried to refresh a reader of lock %s it does not hold.", request.ClientId, request.Name)
+		}
+		request.Done <- nil
+		return
+	}
+
+	reader.MakeValidFor(request.Timeout)
+	lock.updateShared()
+	if !reader.Prelim {
+		sh.wal.Refresh(request.Name, reader)
+	}
+	request.Done <- reader
+}
+
+func (sh *lockShard) handleAdoptShared(request *LockRequest) {
+	lock := sh.locks[request.Name]
+	reader := lock.findReader("", request.Fence)
+
+	if reader == nil || reader.Session != request.Session {
+		if DEBUG {
+			log.Printf("Client %s can't adopt reader of lock %s with fence %s for %s.", request.ClientId, request.Name, request.Fence, request.Session)
+		}
+		request.Done <- nil
+		return
+	}
+
+	reader.ClientId = request.ClientId
+	reader.Prelim = false
+	reader.MakeValidFor(request.Timeout)
+	lock.updateShared()
+	sh.wal.Grant(request.Name, reader)
+	request.Done <- reader
+}
+
+func (sh *lockShard) handleAbortShared(request *LockRequest) *Lock {
+	lock := sh.locks[request.Name]
+
+	reader := lock.findReader(request.ClientId, request.Fence)
+	if reader == nil {
+		reader = lock.prelimReader(request.ClientId, -1)
+	}
+
+	if reader == nil {
+		return nil
+	}
+
+	return sh.releaseReader(request.Name, lock, reader)
+}
+
+func (sh *lockShard) handleMergeShared(clientId string, request *LockRequest) {
+	sh.fences.Observe(ParseFence(request.Fence))
+
+	lock := sh.locks[request.Name]
+
+	if clientId != "" && (clientId != SHARED_HOLDER || lock.Permits != request.Permits) {
+		// Held in another mode on our end, ours wins
+		request.Done <- nil
+		return
+	}
+
+	if clientId == "" {
+		lock = newSemaphore(request.Permits)
+		sh.locks[request.Name] = lock
+	}
+
+	expires := monotime.Now() + uint64(request.Timeout)
+	reader := lock.findReader("", request.Fence)
+
+	if reader == nil && lock.Permits > 0 && lock.freeSlot(request.Slot) < 0 {
+		// Somebody else has the permit on our end
+		request.Done <- nil
+		return
+	}
+
+	if reader == nil {
+		reader = &Lock{}
+		reader.Fence = request.Fence
+		reader.ClientId = request.ClientId
+		reader.Session = request.Session
+		reader.Shared = true
+		reader.Permits = request.Permits
+		reader.Slot = request.Slot
+		reader.Expires = expires
+		sh.addReader(request.Name, lock, reader)
+
+		if DEBUG {
+			log.Printf("Merged reader of lock %s held by %s until %d", request.Name, reader.ClientId, reader.Expires)
+		}
+	} else if reader.ClientId == request.ClientId && expires > reader.Expires {
+		reader.Expires = expires
+		lock.updateShared()
+		sh.wal.Refresh(request.Name, reader)
+	}
+
+	request.Done <- nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"strconv"
+)
+
+type Stat struct {
+	Name  string
+	Value string
+}
+
+type Stats []Stat
+
+func (s *Server) clientConnected() {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	s.clientsConnected += 1
+	s.clientsTotal += 1
+}
+
+func (s *Server) clientDisconnected() {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	s.clientsConnected -= 1
+}
+
+func (s *Server) clientStats() (connected int, total uint64) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	return s.clientsConnected, s.clientsTotal
+}
+
+func boolToString(value bool) string {
+	if value {
+		return "1"
+	}
+
+	return "0"
+}
+
+// Collect the numbers that tell how this node is doing, in the order they
+// should be reported to clients
+func (s *Server) GetStats() Stats {
+	locks := s.LockManager.GetStats()
+	relays := len(s.RelayManager.GetRelayConnections())
+	clients, clientsTotal := s.clientStats()
+
+	return Stats{
+		{"locks_held", strconv.Itoa(locks.Held)},
+		{"locks_held_local", strconv.Itoa(locks.HeldLocal)},
+		{"locks_queued", strconv.Itoa(locks.Queued)},
+		{"locks_granted", strconv.FormatUint(locks.Granted, 10)},
+		{"locks_expired", strconv.FormatUint(locks.Expired, 10)},
+		{"locks_released", strconv.FormatUint(locks.Released, 10)},
+		{"relays_connected", strconv.Itoa(relays)},
+		{"relays_quorum", strconv.Itoa(s.RelayManager.QuorumSize())},
+		{"relays_can_have_quorum", boolToString(s.RelayManager.CanHaveQuorum())},
+		{"relays_synced", boolToString(s.RelayManager.Synced())},
+		{"clients_connected", strconv.Itoa(clients)},
+		{"clients_total", strconv.FormatUint(clientsTotal, 10)},
+		{"draining", boolToString(s.IsDraining())},
+	}
+}
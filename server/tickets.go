@@ -0,0 +1,211 @@
+package server
+
+import (
+	"github.com/aristanetworks/goarista/monotime"
+	"log"
+	"sort"
+	"time"
+)
+
+// Clients waiting with ON get in line for the lock with a ticket, and get it
+// in the order of their tickets no matter which server they're waiting
+// through. Tickets are drawn from this server's fences, which have seen the
+// tickets other servers sent us, so a client that starts waiting after
+// another one's ticket got here has a higher ticket. Nobody asks a quorum for
+// it though, so a ticket still on its way, or one that never made it here,
+// can end up behind a later one. Every server orders the same tickets the
+// same way, ties broken by who's waiting, so they still agree who's first.
+//
+// Every server keeps the tickets it knows of for each lock, its own clients'
+// and the ones the other servers told about, and only gives out the lock to
+// whoever holds the lowest ticket. Requests without a ticket wait behind all
+// of them.
+//
+// A ticket only lasts for TICKET_TIMEOUT unless it's queued again, so a
+// DEQUEUE that never made it doesn't keep everybody else waiting forever.
+// Servers keep queueing their clients' tickets for as long as they wait.
+
+const TICKET_TIMEOUT = time.Second * 10
+
+type waitTicket struct {
+	holder  string
+	ticket  uint64
+	expires uint64
+}
+
+type waitLine []waitTicket
+
+func (l waitLine) Len() int {
+	return len(l)
+}
+
+func (l waitLine) Less(i, j int) bool {
+	if l[i].ticket != l[j].ticket {
+		return l[i].ticket < l[j].ticket
+	}
+
+	return l[i].holder < l[j].holder
+}
+
+func (l waitLine) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Put holder in line for lock name with ticket, or keep it there for another
+// TicketTimeout if it already is
+func (lm *LockManager) Enqueue(holder string, name string, ticket uint64) {
+	receiver := NewLockReceiver()
+	receiver.ClientId = holder
+	receiver.Name = name
+	receiver.Ticket = ticket
+	receiver.Timeout = lm.TicketTimeout
+	receiver.Type = TYPE_ENQUEUE
+
+	lm.send(receiver)
+	<-receiver.Done
+}
+
+// Take holder's ticket for lock name out of the line, letting whoever is next
+// have the lock
+func (lm *LockManager) Dequeue(holder string, name string, ticket uint64) {
+	receiver := NewLockReceiver()
+	receiver.ClientId = holder
+	receiver.Name = name
+	receiver.Ticket = ticket
+	receiver.Type = TYPE_DEQUEUE
+
+	lm.send(receiver)
+	<-receiver.Done
+}
+
+// Take all of holder's tickets out of the lines, e.g. when a relay goes away
+func (lm *LockManager) DropTickets(holder string) {
+	for _, shard := range lm.shards {
+		receiver := NewLockReceiver()
+		receiver.ClientId = holder
+		receiver.Type = TYPE_DEQUEUE
+
+		shard.requestChan <- receiver
+		<-receiver.Done
+	}
+}
+
+// Where holder is in line for lock name, 1 being next. 0 if holder isn't in
+// line for it.
+func (lm *LockManager) Position(holder string, name string) int {
+	return lm.line(name).position(holder)
+}
+
+// Whether somebody else is in line for lock name before holder
+func (lm *LockManager) Ahead(holder string, name string) bool {
+	return lm.line(name).ahead(holder)
+}
+
+func (lm *LockManager) line(name string) waitLine {
+	receiver := NewLockReceiver()
+	receiver.Name = name
+	receiver.Type = TYPE_LINE
+	receiver.Line = make(chan waitLine)
+
+	lm.send(receiver)
+
+	return <-receiver.Line
+}
+
+func (sh *lockShard) addTicket(name string, holder string, ticket uint64, timeout time.Duration) {
+	sh.fences.Observe(ticket)
+	expires := monotime.Now() + uint64(timeout)
+
+	for i, entry := range sh.tickets[name] {
+		if entry.holder == holder && entry.ticket == ticket {
+			sh.tickets[name][i].expires = expires
+			return
+		}
+	}
+
+	line := append(sh.tickets[name], waitTicket{holder, ticket, expires})
+	sort.Sort(line)
+	sh.tickets[name] = line
+}
+
+// Forget the tickets for lock name nobody has queued again in time
+func (sh *lockShard) expireTickets(name string, now uint64) {
+	line := waitLine{}
+
+	for _, entry := range sh.tickets[name] {
+		if entry.expires <= now {
+			if DEBUG {
+				log.Printf("Ticket %d of %s for lock %s expired.", entry.ticket, entry.holder, name)
+			}
+			continue
+		}
+
+		line = append(line, entry)
+	}
+
+	if len(line) == 0 {
+		delete(sh.tickets, name)
+	} else {
+		sh.tickets[name] = line
+	}
+}
+
+// Remove holder's ticket for lock name, or all of holder's tickets for it if
+// ticket is 0
+func (sh *lockShard) removeTicket(name string, holder string, ticket uint64) bool {
+	line := waitLine{}
+	removed := false
+
+	for _, entry := range sh.tickets[name] {
+		if entry.holder == holder && (ticket == 0 || entry.ticket == ticket) {
+			removed = true
+			continue
+		}
+
+		line = append(line, entry)
+	}
+
+	if len(line) == 0 {
+		delete(sh.tickets, name)
+	} else {
+		sh.tickets[name] = line
+	}
+
+	return removed
+}
+
+func (sh *lockShard) handleDequeue(request *LockRequest) {
+	if request.Name != "" {
+		if sh.removeTicket(request.Name, request.ClientId, request.Ticket) {
+			sh.wake(request.Name)
+		}
+		return
+	}
+
+	for name := range sh.tickets {
+		if sh.removeTicket(name, request.ClientId, 0) {
+			if DEBUG {
+				log.Printf("Dropped the tickets of %s for lock %s.", request.ClientId, name)
+			}
+			sh.wake(name)
+		}
+	}
+}
+
+func (sh *lockShard) ahead(name string, holder string) bool {
+	return sh.tickets[name].ahead(holder)
+}
+
+func (l waitLine) ahead(holder string) bool {
+	return len(l) > 0 && l[0].holder != holder
+}
+
+func (l waitLine) position(holder string) int {
+	for i, entry := range l {
+		if entry.holder == holder {
+			return i + 1
+		}
+	}
+
+	return 0
+}
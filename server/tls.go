@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// With tls_cert and tls_key set both ports only speak TLS. Relays always
+// have to show a certificate signed by tls_ca, and the ID they say HELLO with
+// has to be one of the names in it, so only servers we gave certificates to
+// can join the cluster. Clients have to show one only with tls_client_auth.
+//
+// The certificates are read again on Reload, connections made after it use
+// the new ones.
+
+var ErrNoPeerCertificate = errors.New("No peer certificate")
+
+type TLSFiles struct {
+	config *Config
+	mutex  *sync.RWMutex
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+}
+
+// Read the certificates set in config, nil if TLS isn't configured
+func LoadTLS(config *Config) (*TLSFiles, error) {
+	if config.TLSCert == "" && config.TLSKey == "" {
+		return nil, nil
+	}
+
+	if config.TLSCert == "" || config.TLSKey == "" || config.TLSCA == "" {
+		return nil, fmt.Errorf("TLS needs tls_cert, tls_key and tls_ca")
+	}
+
+	t := TLSFiles{}
+	t.config = config
+	t.mutex = &sync.RWMutex{}
+
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Read the certificates from disk again, keeping the old ones if that fails
+func (t *TLSFiles) Reload() error {
+	cert, err := tls.LoadX509KeyPair(t.config.TLSCert, t.config.TLSKey)
+
+	if err != nil {
+		return fmt.Errorf("Failed to load %s: %s", t.config.TLSCert, err)
+	}
+
+	pem, err := ioutil.ReadFile(t.config.TLSCA)
+
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No certificates found in %s", t.config.TLSCA)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.cert = &cert
+	t.pool = pool
+
+	return nil
+}
+
+func (t *TLSFiles) certificate() *tls.Certificate {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.cert
+}
+
+func (t *TLSFiles) roots() *x509.CertPool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.pool
+}
+
+// Check the chain the other end showed against tls_ca. Which name it should
+// have is only known once it says HELLO, see PeerCertificateMatches.
+func (t *TLSFiles) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrNoPeerCertificate
+	}
+
+	certs := []*x509.Certificate{}
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+
+		if err != nil {
+			return err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	options := x509.VerifyOptions{}
+	options.Roots = t.roots()
+	options.Intermediates = x509.NewCertPool()
+	// The same certificate is used to listen and to connect to other servers
+	options.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+
+	for _, cert := range certs[1:] {
+		options.Intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(options)
+
+	return err
+}
+
+func (t *TLSFiles) ClientListenerConfig() *tls.Config {
+	config := &tls.Config{}
+	config.MinVersion = tls.VersionTLS12
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return t.certificate(), nil
+	}
+
+	if t.config.TLSClientAuth {
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = t.verifyPeer
+	}
+
+	return config
+}
+
+func (t *TLSFiles) RelayListenerConfig() *tls.Config {
+	config := t.ClientListenerConfig()
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyPeerCertificate = t.verifyPeer
+
+	return config
+}
+
+func (t *TLSFiles) RelayDialConfig() *tls.Config {
+	config := &tls.Config{}
+	config.MinVersion = tls.VersionTLS12
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return t.certificate(), nil
+	}
+	// Peers are known by address until they say who they are, the chain is
+	// checked by verifyPeer and the name once they do
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = t.verifyPeer
+
+	return config
+}
+
+// Whether the other end of conn showed a certificate for id. Always true for
+// connections without TLS.
+func PeerCertificateMatches(conn net.Conn, id string) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+
+	if !ok {
+		return true
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+
+	if len(certs) == 0 {
+		return false
+	}
+
+	return certs[0].Subject.CommonName == id || certs[0].VerifyHostname(id) == nil
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert, key}
+}
+
+// Write the CA and a certificate it signed for name to dir
+func (ca *testCA) write(t *testing.T, dir string, name string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	writePem(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+	writePem(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", der)
+	writePem(t, filepath.Join(dir, "key.pem"), "EC PRIVATE KEY", keyDer)
+}
+
+func writePem(t *testing.T, path string, kind string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadTestTLS(t *testing.T, dir string) *TLSFiles {
+	config := NewConfig()
+	config.TLSCert = filepath.Join(dir, "cert.pem")
+	config.TLSKey = filepath.Join(dir, "key.pem")
+	config.TLSCA = filepath.Join(dir, "ca.pem")
+
+	files, err := LoadTLS(config)
+
+	if err != nil {
+		t.Fatal("Failed to load TLS files:", err)
+	}
+
+	return files
+}
+
+// Connect the two servers like relays do, returns the dialing side's
+// connection, or nil if the handshake failed on either end
+func relayHandshake(listening *TLSFiles, dialing *TLSFiles) *tls.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		server := tls.Server(conn, listening.RelayListenerConfig())
+		server.SetDeadline(time.Now().Add(time.Second * 2))
+
+		// Let the other end know we accepted it
+		if server.Handshake() == nil {
+			server.Write([]byte("\n"))
+		}
+
+		server.Close()
+	}()
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+
+	if err != nil {
+		return nil
+	}
+
+	client := tls.Client(conn, dialing.RelayDialConfig())
+	client.SetDeadline(time.Now().Add(time.Second * 2))
+
+	// With TLS 1.3 our handshake is done before the server has checked our
+	// certificate, so wait for it to say so
+	if client.Handshake() != nil {
+		client.Close()
+		return nil
+	}
+
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		client.Close()
+		return nil
+	}
+
+	return client
+}
+
+func TestTLSNotConfigured(t *testing.T) {
+	files, err := LoadTLS(NewConfig())
+
+	if files != nil || err != nil {
+		t.Error("TLS enabled without a certificate")
+	}
+
+	config := NewConfig()
+	config.TLSCert = "cert.pem"
+	config.TLSKey = "key.pem"
+
+	if _, err := LoadTLS(config); err == nil {
+		t.Error("TLS enabled without a CA to check relays against")
+	}
+}
+
+func TestTLSRelayIdentity(t *testing.T) {
+	dir1, _ := ioutil.TempDir("", "godistlockd")
+	dir2, _ := ioutil.TempDir("", "godistlockd")
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+
+	ca := newTestCA(t)
+	ca.write(t, dir1, "server-1")
+	ca.write(t, dir2, "server-2")
+
+	server1 := loadTestTLS(t, dir1)
+	server2 := loadTestTLS(t, dir2)
+
+	conn := relayHandshake(server1, server2)
+
+	if conn == nil {
+		t.Fatal("Servers with certificates from the same CA couldn't connect")
+	}
+
+	if !PeerCertificateMatches(conn, "server-1") {
+		t.Error("Certificate didn't match its server")
+	}
+
+	if PeerCertificateMatches(conn, "server-3") {
+		t.Error("Certificate matched another server")
+	}
+
+	if !PeerCertificateMatches(nil, "server-3") {
+		t.Error("Connections without TLS should not be checked")
+	}
+
+	// Somebody with a certificate from another CA
+	newTestCA(t).write(t, dir2, "server-2")
+	server2.Reload()
+
+	if relayHandshake(server1, server2) != nil {
+		t.Error("Relay with a certificate from another CA got in")
+	}
+
+	if relayHandshake(server2, server1) != nil {
+		t.Error("Connected to a relay with a certificate from another CA")
+	}
+
+	// Everybody has the new CA
+	newCA := newTestCA(t)
+	newCA.write(t, dir1, "server-1")
+	newCA.write(t, dir2, "server-2")
+
+	if err := server1.Reload(); err != nil {
+		t.Error("Failed to reload certificates:", err)
+	}
+	server2.Reload()
+
+	if relayHandshake(server1, server2) == nil {
+		t.Error("Reloaded certificates were not used")
+	}
+}
@@ -2,9 +2,13 @@ package server
 
 import (
 	"log"
+	"regexp"
 	"github.com/twinj/uuid"
 )
 
+// What NewUUID gives out, in any case
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
 func NewUUID() string {
 	id := uuid.NewV4()
 
@@ -14,3 +18,7 @@ func NewUUID() string {
 
 	return id.String()
 }
+
+func isUUID(id string) bool {
+	return uuidPattern.MatchString(id)
+}
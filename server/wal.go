@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aristanetworks/goarista/monotime"
+	"github.com/lietu/godistlockd/messages"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When to fsync the lock log
+const (
+	// After every entry, nothing is lost on power loss
+	WAL_SYNC_ALWAYS = "always"
+	// About once every WAL_SYNC_INTERVAL_DURATION, up to that much can be lost
+	WAL_SYNC_INTERVAL = "interval"
+	// Leave it up to the OS
+	WAL_SYNC_NEVER = "never"
+)
+
+const WAL_SYNC_INTERVAL_DURATION = time.Second
+
+const WAL_SNAPSHOT_FILE = "locks.snapshot"
+
+// An append-only log of the committed locks, so they survive restarts. Every
+// now and then the log is started over in a new generation and the locks are
+// written to a snapshot. The snapshot tells which generation of the log
+// continues from it, the generations after that one follow in order.
+//
+// Entries are lines like in the protocols:
+//
+//   GRANT <lock> <holder> <session> <fence> <expires> [<mode>]
+//   REFRESH <lock> <holder> <session> <fence> <expires> [<mode>]
+//   RELEASE <lock> <fence>
+//
+// where <session> is the client the lock was given to, <expires> is wall clock time in unix milliseconds, since monotonic
+// clocks don't survive reboots, and <mode> marks readers of shared locks and
+// permits of semaphores like in the relay protocol. Snapshots start with
+// `GEN <generation>` followed by a GRANT for each lock, reader and permit.
+//
+// All the shards of the LockManager write to it, so it's safe for concurrent
+// use. A nil *LockLog doesn't persist anything.
+type LockLog struct {
+	mutex        sync.Mutex
+	dir          string
+	sync         string
+	interval     time.Duration
+	generation   uint64
+	// The generation the snapshot continues with
+	base         uint64
+	file         *os.File
+	writer       *bufio.Writer
+	dirty        bool
+	lastSync     time.Time
+	lastSnapshot time.Time
+}
+
+func OpenLockLog(dir string, sync string, snapshotInterval time.Duration) (*LockLog, error) {
+	if sync != WAL_SYNC_ALWAYS && sync != WAL_SYNC_INTERVAL && sync != WAL_SYNC_NEVER {
+		return nil, fmt.Errorf("Invalid wal_sync %s", sync)
+	}
+
+	ll := LockLog{}
+	ll.dir = dir
+	ll.sync = sync
+	ll.interval = snapshotInterval
+	ll.lastSync = time.Now()
+
+	return &ll, nil
+}
+
+func (ll *LockLog) logPath(generation uint64) string {
+	return filepath.Join(ll.dir, fmt.Sprintf("locks.%d.log", generation))
+}
+
+// Read the locks from the latest snapshot and the logs after it, and start a
+// new generation from them. Locks that have expired meanwhile are dropped.
+func (ll *LockLog) Replay() (Locks, error) {
+	locks := Locks{}
+
+	if ll == nil {
+		return locks, nil
+	}
+
+	err := ll.replayFile(filepath.Join(ll.dir, WAL_SNAPSHOT_FILE), locks, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ll.base = ll.generation
+
+	// If we went down while taking a snapshot, the log was already started
+	// over but the snapshot still points to the one before
+	for {
+		path := ll.logPath(ll.generation)
+
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+
+		err = ll.replayFile(path, locks, false)
+		if err != nil {
+			return nil, err
+		}
+
+		ll.generation += 1
+	}
+
+	if ll.generation > ll.base {
+		ll.generation -= 1
+	}
+
+	// The log might end in a half written entry, start over from a clean
+	// snapshot instead of appending to it
+	if err := ll.Snapshot(locks); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Replayed %d locks from %s", len(locks), ll.dir)
+
+	return locks, nil
+}
+
+func (ll *LockLog) replayFile(path string, locks Locks, snapshot bool) error {
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	now := time.Now()
+	mono := monotime.Now()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		args := strings.Split(scanner.Text(), " ")
+
+		switch {
+		case snapshot && len(args) == 2 && args[0] == "GEN":
+			ll.generation, err = strconv.ParseUint(args[1], 10, 64)
+		case (len(args) == 6 || len(args) == 7) && (args[0] == "GRANT" || args[0] == "REFRESH"):
+			var expires int64
+			var mode messages.LockMode
+			expires, err = strconv.ParseInt(args[5], 10, 64)
+
+			if err == nil && len(args) == 7 {
+				mode, err = messages.ParseLockMode(args[6])
+			}
+			shared := mode.Shared
+
+			remaining := time.Unix(0, expires * int64(time.Millisecond)).Sub(now)
+			if err == nil && remaining > 0 {
+				lock := Lock{}
+				lock.ClientId = args[2]
+				lock.Session = args[3]
+				lock.Fence = args[4]
+				lock.Expires = mono + uint64(remaining)
+				lock.Shared = shared
+				lock.Permits = mode.Permits
+				lock.Slot = mode.Slot
+
+				if shared {
+					locks.putReader(args[1], &lock)
+				} else {
+					locks[args[1]] = &lock
+				}
+			} else if shared {
+				locks.dropReader(args[1], args[4])
+			} else {
+				delete(locks, args[1])
+			}
+		case len(args) == 3 && args[0] == "RELEASE":
+			if lock, ok := locks[args[1]]; ok && lock.Shared {
+				locks.dropReader(args[1], args[2])
+			} else {
+				delete(locks, args[1])
+			}
+		default:
+			err = fmt.Errorf("Invalid entry %q", scanner.Text())
+		}
+
+		if err != nil {
+			if snapshot {
+				return fmt.Errorf("Corrupted snapshot %s: %s", path, err)
+			}
+
+			// Most likely the last entry was cut short by a crash
+			log.Printf("Stopped replaying %s: %s", path, err)
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (ll *LockLog) Grant(name string, lock *Lock) {
+	ll.write("GRANT", name, lock)
+}
+
+func (ll *LockLog) Refresh(name string, lock *Lock) {
+	ll.write("REFRESH", name, lock)
+}
+
+func (ll *LockLog) Release(name string, fence string) {
+	if ll == nil {
+		return
+	}
+
+	ll.append("RELEASE " + name + " " + fence + "\n")
+}
+
+func (ll *LockLog) write(keyword string, name string, lock *Lock) {
+	if ll == nil {
+		return
+	}
+
+	ll.append(formatLogEntry(keyword, name, lock))
+}
+
+func formatLogEntry(keyword string, name string, lock *Lock) string {
+	// Good enough, the clocks of the monotonic and wall time have the
+	// same idea of how long a millisecond is
+	remaining := time.Duration(lock.Expires - monotime.Now())
+	if lock.Expires < monotime.Now() {
+		remaining = 0
+	}
+	expires := time.Now().Add(remaining).UnixNano() / int64(time.Millisecond)
+
+	mode := ""
+	if lock.Shared {
+		mode = " " + lock.mode().String()
+	}
+
+	return fmt.Sprintf("%s %s %s %s %s %d%s\n", keyword, name, lock.ClientId, lock.Session, lock.Fence, expires, mode)
+}
+
+func (ll *LockLog) append(entry string) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+
+	_, err := ll.writer.WriteString(entry)
+
+	if err == nil && ll.sync == WAL_SYNC_ALWAYS {
+		err = ll.flush()
+	} else {
+		ll.dirty = true
+	}
+
+	if err != nil {
+		// Going on would give out locks we'll forget about on restart
+		log.Fatalf("Failed to write lock log: %s", err)
+	}
+}
+
+func (ll *LockLog) flush() error {
+	err := ll.writer.Flush()
+
+	if err == nil && ll.sync != WAL_SYNC_NEVER {
+		err = ll.file.Sync()
+	}
+
+	ll.dirty = false
+	ll.lastSync = time.Now()
+
+	return err
+}
+
+// Write all the locks into a new snapshot and start a new log after it.
+// Preliminary holds aren't worth keeping, they time out long before we're
+// back up.
+func (ll *LockLog) Snapshot(locks Locks) error {
+	if ll == nil {
+		return nil
+	}
+
+	return ll.snapshot(func() Locks {
+		return locks
+	})
+}
+
+// Start a new log and write the locks collect returns into a snapshot that
+// continues with it. The locks can keep changing while they're collected,
+// whatever makes it to the new log is replayed on top of the snapshot.
+func (ll *LockLog) snapshot(collect func() Locks) error {
+	generation, err := ll.rotate()
+
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(ll.dir, WAL_SNAPSHOT_FILE + ".tmp")
+	file, err := os.Create(tmp)
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "GEN %d\n", generation)
+
+	for name, lock := range collect() {
+		for _, hold := range lock.holds() {
+			if !hold.Prelim {
+				writer.WriteString(formatLogEntry("GRANT", name, hold))
+			}
+		}
+	}
+
+	err = writer.Flush()
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(ll.dir, WAL_SNAPSHOT_FILE)); err != nil {
+		return err
+	}
+
+	if err := syncDir(ll.dir); err != nil {
+		return err
+	}
+
+	// Only now the logs before the new one aren't needed anymore
+	for old := ll.base; old < generation; old++ {
+		os.Remove(ll.logPath(old))
+	}
+	ll.base = generation
+
+	return nil
+}
+
+// Start the next generation of the log, returns its number. The new log has
+// to exist before a snapshot points to it.
+func (ll *LockLog) rotate() (uint64, error) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+
+	generation := ll.generation + 1
+	logFile, err := os.OpenFile(ll.logPath(generation), os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0644)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if ll.file != nil {
+		// Replaying the old log still needs everything in it
+		if err := ll.flush(); err != nil {
+			logFile.Close()
+			return 0, err
+		}
+		ll.file.Close()
+	}
+
+	ll.generation = generation
+	ll.file = logFile
+	ll.writer = bufio.NewWriter(logFile)
+	ll.dirty = false
+	ll.lastSnapshot = time.Now()
+
+	return generation, nil
+}
+
+// Make sure renames in dir make it to the disk
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// Sync and compact as the policies say, should be called regularly. For a
+// snapshot the locks are asked from collect.
+func (ll *LockLog) Maintain(collect func() Locks) {
+	if ll == nil {
+		return
+	}
+
+	var err error
+
+	ll.mutex.Lock()
+	due := ll.interval > 0 && time.Since(ll.lastSnapshot) > ll.interval
+
+	if !due && ll.dirty && time.Since(ll.lastSync) > WAL_SYNC_INTERVAL_DURATION {
+		err = ll.flush()
+	}
+	ll.mutex.Unlock()
+
+	if due {
+		err = ll.snapshot(collect)
+	}
+
+	if err != nil {
+		log.Fatalf("Failed to write lock log: %s", err)
+	}
+}
+
+func (ll *LockLog) Close() {
+	if ll == nil {
+		return
+	}
+
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+
+	if ll.file == nil {
+		return
+	}
+
+	ll.flush()
+	ll.file.Close()
+}
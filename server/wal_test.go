@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func TestLockLogReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godistlockd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locks, err := wal.Replay()
+	if err != nil || len(locks) != 0 {
+		t.Error("Failed to start from an empty data dir:", err)
+		return
+	}
+
+	lm := NewDurableLockManager(NewFenceCounter(), wal, locks)
+	lm.Commit("relay:one", "client", "foo", "5", time.Minute)
+	lm.Commit("client", "client", "bar", "6", time.Minute)
+	lm.Commit("client", "client", "short", "7", time.Millisecond)
+	lm.Release("client", "bar")
+	lm.TryGet("client", "prelim", time.Minute)
+	lm.Stop()
+
+	// A crash in the middle of writing an entry
+	file, _ := os.OpenFile(wal.logPath(wal.generation), os.O_APPEND | os.O_WRONLY, 0644)
+	file.WriteString("GRANT half")
+	file.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	wal, _ = OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	locks, err = wal.Replay()
+
+	if err != nil {
+		t.Error("Failed to replay:", err)
+		return
+	}
+
+	if len(locks) != 1 || locks["foo"] == nil || locks["foo"].Fence != "5" || locks["foo"].ClientId != "relay:one" || locks["foo"].Session != "client" {
+		t.Errorf("Unexpected locks after replay %+v", locks)
+	}
+
+	// Compacted into a new generation
+	if _, err := os.Stat(filepath.Join(dir, "locks.1.log")); !os.IsNotExist(err) {
+		t.Error("Old log was not removed")
+	}
+
+	wal.Close()
+}
+
+func TestLockLogReplayShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godistlockd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, _ := OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	locks, _ := wal.Replay()
+
+	lm := NewDurableLockManager(NewFenceCounter(), wal, locks)
+	lm.CommitShared("one", "one", "foo", "5", time.Minute)
+	lm.CommitShared("two", "two", "foo", "6", time.Minute)
+	lm.CommitShared("three", "three", "foo", "7", time.Minute)
+	lm.ReleaseHold("two", "two", "foo", "6")
+	lm.TryShared("four", "foo", time.Minute)
+	lm.Stop()
+
+	time.Sleep(time.Millisecond * 5)
+
+	wal, _ = OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	locks, err = wal.Replay()
+
+	if err != nil {
+		t.Error("Failed to replay:", err)
+		return
+	}
+
+	lock := locks["foo"]
+	if lock == nil || !lock.Shared || len(lock.Readers) != 2 || lock.findReader("three", "7") == nil || lock.Fence != "7" {
+		t.Errorf("Unexpected shared lock after replay %+v", lock)
+	}
+
+	wal.Close()
+}
+
+func TestLockLogReplaySemaphore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godistlockd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, _ := OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	locks, _ := wal.Replay()
+
+	lm := NewDurableLockManager(NewFenceCounter(), wal, locks)
+	lm.CommitPermit("one", "one", "foo", 0, 3, "5", time.Minute)
+	lm.CommitPermit("two", "two", "foo", 2, 3, "6", time.Minute)
+	lm.Stop()
+
+	time.Sleep(time.Millisecond * 5)
+
+	wal, _ = OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	locks, err = wal.Replay()
+
+	if err != nil {
+		t.Error("Failed to replay:", err)
+		return
+	}
+
+	lock := locks["foo"]
+	if lock == nil || lock.Permits != 3 || len(lock.Readers) != 2 || lock.findReader("two", "6").Slot != 2 || lock.freeSlot(-1) != 1 {
+		t.Errorf("Unexpected semaphore after replay %+v", lock)
+	}
+
+	wal.Close()
+}
+
+func TestLockLogReplayGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godistlockd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, _ := OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	locks, _ := wal.Replay()
+
+	lm := NewDurableLockManager(NewFenceCounter(), wal, locks)
+	lm.Commit("client", "client", "foo", "5", time.Minute)
+
+	// Went down after starting a new log, before the snapshot was written
+	wal.rotate()
+	lm.Commit("client", "client", "bar", "6", time.Minute)
+	lm.Release("client", "foo")
+	lm.Stop()
+
+	wal, _ = OpenLockLog(dir, WAL_SYNC_ALWAYS, time.Minute)
+	locks, err = wal.Replay()
+
+	if err != nil {
+		t.Error("Failed to replay:", err)
+		return
+	}
+
+	if len(locks) != 1 || locks["bar"] == nil || locks["bar"].Fence != "6" {
+		t.Errorf("Unexpected locks after replay %+v", locks)
+	}
+
+	for _, generation := range []int{1, 2} {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("locks.%d.log", generation))); !os.IsNotExist(err) {
+			t.Error("Old log was not removed")
+		}
+	}
+
+	wal.Close()
+}